@@ -2,6 +2,7 @@
 from __future__ import (absolute_import, division, print_function)
 __metaclass__ = type
 
+import base64
 import errno
 import json
 import logging
@@ -19,11 +20,18 @@ from threading import Thread, Lock, Condition
 class Client(object):
     logger = logging.getLogger('rci.client')
 
-    def __init__(self, url=None, password=None, client_name=None):
+    def __init__(self, url=None, password=None, client_name=None, user=None):
         if not url:
             url = os.getenv("RCI_ADDRESS", "ws://localhost:8502/api/ws")
         if not password:
             password = os.getenv("RCI_PASSWORD")
+        if not user:
+            user = os.getenv("RCI_USER")
+        if user and password:
+            # Users log in with "user:password" encoded as a subprotocol;
+            # a password alone is a shared password.
+            password = base64.urlsafe_b64encode(
+                (user + ':' + password).encode('utf-8')).rstrip(b'=').decode('ascii')
         if '?' in url:
             url += '&'
         else:
@@ -37,6 +45,7 @@ class Client(object):
         self._lock = Lock()
         self._cv = Condition(self._lock)
         self._status = {}
+        self._lease_renewed = 0
         t = Thread(target=self._recv_loop)
         t.daemon = True
         t.start()
@@ -56,6 +65,7 @@ class Client(object):
                     with self._cv:
                         self._status = json.loads(message)
                         self._cv.notifyAll()
+                    self._renew_lease()
             except websocket.WebSocketConnectionClosedException:
                 self.logger.warning('Lost connection to %s', self._url)
                 pass
@@ -63,6 +73,15 @@ class Client(object):
     def _send(self, message):
         self._ws.send(json.dumps(message))
 
+    def _renew_lease(self):
+        # The server stops velocity moves unless the client renews its
+        # lease, so that they don't outlive the client.
+        if self._status.get('VelocityLeaseHeld') and time.time() - self._lease_renewed > 1:
+            self._lease_renewed = time.time()
+            self._send({
+                'command': 'renew_lease',
+            })
+
     def __str__(self):
         with self._lock:
             return str(self._status)
@@ -97,6 +116,8 @@ class Client(object):
     def set_azimuth_velocity(self, velocity):
         """Set azimuth velocity.
 
+        The move is stopped if this client disconnects.
+
         Args:
             velocity: velocity in degrees/sec
         """
@@ -108,6 +129,8 @@ class Client(object):
     def set_elevation_velocity(self, velocity):
         """Set elevation velocity.
 
+        The move is stopped if this client disconnects.
+
         Args:
             velocity: velocity in degrees/sec
         """
@@ -132,23 +155,349 @@ class Client(object):
         'position': elevation_offset,
         })
 
+    def set_cable_wrap(self, azimuth):
+        """Correct the server's count of cable wrap turns.
+
+        Args:
+            azimuth: current azimuth in degrees counting turns, e.g. 370
+                if the antenna is at 10 degrees after turning clockwise
+                past north
+        """
+        self._send({
+            'command': 'set_cable_wrap',
+            'position': azimuth,
+        })
+
+    def set_refraction(self, enabled):
+        """Enable or disable refraction corrections.
+
+        Args:
+            enabled: whether to correct positions for atmospheric refraction
+        """
+        self._send({
+            'command': 'set_refraction',
+            'enabled': enabled,
+        })
+
+    @property
+    def weather(self):
+        """Return the weather used for refraction.
+
+        Returns:
+            Dictionary with the keys Refraction, Source, Conditions, Age, and Stale
+        """
+        return self.status.get('Weather')
+
     def stop(self):
         """Stop commanding movement."""
         self._send({
 	    'command': 'stop',
         })
 
+    def emergency_stop(self, reason=''):
+        """Stop the antenna and all transmitters until the stop is reset.
+
+        Args:
+            reason: why the antenna was stopped, shown to other clients
+        """
+        self._send({
+            'command': 'emergency_stop',
+            'reason': reason,
+        })
+
+    def reset_emergency_stop(self):
+        """Release a latched emergency stop. Needs the operator role."""
+        self._send({
+            'command': 'reset_emergency_stop',
+        })
+
+    @property
+    def emergency_stopped(self):
+        """Return the latched emergency stop, if any.
+
+        Returns:
+            Dictionary with the keys Time, Source, User, RemoteAddr, and
+            Reason, or None
+        """
+        return self.status.get('EmergencyStop')
+
+    def take_control(self):
+        """Take exclusive control of the antenna.
+
+        Other clients can't move the antenna until this client releases
+        control, disconnects, or stops sending commands for the control
+        timeout. The request is ignored if another client has control.
+        """
+        self._send({
+            'command': 'take_control',
+        })
+
+    def release_control(self):
+        """Release exclusive control of the antenna."""
+        self._send({
+            'command': 'release_control',
+        })
+
+    def steal_control(self):
+        """Take control of the antenna from another client.
+
+        Requires the admin role. Clients on the local host are always admins.
+        """
+        self._send({
+            'command': 'steal_control',
+        })
+
+    @property
+    def control(self):
+        """Return the client that has exclusive control, if any.
+
+        Returns:
+            Dictionary with the keys Source, RemoteAddr, Name, Since, and
+            Expires, or None
+        """
+        return self.status.get('Control')
+
+    @property
+    def control_held(self):
+        """Return whether this client has exclusive control."""
+        return bool(self.status.get('ControlHeld'))
+
+    def park(self, name=None):
+        """Park the antenna.
+
+        Args:
+            name: name of a park position from self.park_positions, or
+                None for the default position
+        """
+        self._send({
+            'command': 'park',
+            'name': name or '',
+        })
+
+    @property
+    def park_positions(self):
+        """Return the positions the antenna can be parked at.
+
+        Returns:
+            List of dictionaries with the keys Name, Az, and El; the first
+            is the default
+        """
+        return self.status.get('ParkPositions')
+
     def track(self, body):
         """Track a known body.
 
         Args:
-            body: index of a body as returned by self.bodies
+            body: ID of a body as returned by self.body_details, or
+                its index in self.bodies
         """
         self._send({
 	    'command': 'track',
 	    'body': body,
         })
 
+    def track_radec(self, ra, dec, epoch=2000):
+        """Track a fixed position in equatorial coordinates.
+
+        Args:
+            ra: right ascension in hours
+            dec: declination in degrees
+            epoch: Julian year of the equinox
+        """
+        self._send({
+            'command': 'track_radec',
+            'ra': ra,
+            'dec': dec,
+            'epoch': epoch,
+        })
+
+    def track_galactic(self, l, b):
+        """Track a fixed position in galactic coordinates.
+
+        Args:
+            l: galactic longitude in degrees
+            b: galactic latitude in degrees
+        """
+        self._send({
+            'command': 'track_galactic',
+            'l': l,
+            'b': b,
+        })
+
+    def set_track_offsets(self, xel=0, el=0, ra=0, dec=0):
+        """Offset the position of the tracked body.
+
+        Offsets are reset when a different body is tracked. The RA/Dec
+        offset is applied before the cross-elevation/elevation offset.
+
+        Args:
+            xel: cross-elevation offset in degrees on the sky
+            el: elevation offset in degrees
+            ra: right ascension offset in degrees on the sky
+            dec: declination offset in degrees
+        """
+        self._send({
+            'command': 'set_track_offsets',
+            'offsets': {
+                'xel': xel,
+                'el': el,
+                'ra': ra,
+                'dec': dec,
+            },
+        })
+
+    def scan(self, pattern, step, dwell, width, height=0, body=0, azimuth=0, elevation=0):
+        """Run a scan pattern.
+
+        Args:
+            pattern: 'raster' (az/el), 'grid' (RA/Dec), or 'spiral' (cross-el/el)
+            step: spacing between points in degrees
+            dwell: seconds to remain at each point
+            width: extent of the scan in degrees (diameter for spirals)
+            height: extent of the scan in degrees
+            body: ID or index of a body to center the scan on, or 0 to use azimuth/elevation
+            azimuth: center azimuth in degrees if body is 0
+            elevation: center elevation in degrees if body is 0
+        """
+        self._send({
+            'command': 'scan',
+            'scan': {
+                'pattern': pattern,
+                'body': body,
+                'az': azimuth,
+                'el': elevation,
+                'width': width,
+                'height': height,
+                'step': step,
+                'dwell': dwell,
+            },
+        })
+
+    def drift_scan(self, body, lead):
+        """Point ahead of a body and let it drift through the beam.
+
+        The antenna stays still until the body has passed by as far as
+        it was ahead. The drift is reported in the drift property and
+        recorded in the server's -drift_log file.
+
+        Args:
+            body: ID or index of the body
+            lead: how far ahead of the body to point, in seconds
+        """
+        self._send({
+            'command': 'drift_scan',
+            'drift': {
+                'body': body,
+                'lead': lead,
+            },
+        })
+
+    @property
+    def drift(self):
+        """Return the current or last drift scan.
+
+        Returns:
+            Dictionary with the keys ID, Name, BodyID, Lead, Commanded,
+            Az, El, Transit, TransitRA, Start, End, State, and Late, or None
+        """
+        return self.status.get('Drift')
+
+    def calibrate(self, body, pattern='fivepoint', offset=1, step=0.25, dwell=5, settle=2, off=0, apply=False):
+        """Measure the pointing error on a bright source.
+
+        Power samples must be sent to the server's -power_udp address or
+        POSTed to /api/power while the calibration runs. The result is
+        reported in the calibration_result property.
+
+        Args:
+            body: ID or index of the source
+            pattern: 'fivepoint' or 'crossscan'
+            offset: distance of the outer points from the source in degrees
+            step: spacing of cross-scan points in degrees
+            dwell: seconds to integrate power at each point
+            settle: seconds to wait at each point before integrating
+            off: cross-elevation offset of a baseline reference point in degrees, or 0
+            apply: whether to correct the rotator's offsets with the result
+        """
+        self._send({
+            'command': 'calibrate',
+            'calibration': {
+                'pattern': pattern,
+                'body': body,
+                'offset': offset,
+                'step': step,
+                'dwell': dwell,
+                'settle': settle,
+                'off': off,
+                'apply': apply,
+            },
+        })
+
+    @property
+    def calibration_result(self):
+        """Return the result of the last pointing calibration.
+
+        Returns:
+            Dictionary with the fitted XelOffset, ElOffset, AzOffset,
+            BeamwidthXel, and BeamwidthEl in degrees, or None
+        """
+        return self.status.get('CalibrationResult')
+
+    def schedule_add(self, start, duration, body=0, name='', priority=0, scan=None, bands=None, park=False):
+        """Schedule a job to track a body or run a scan.
+
+        Jobs that overlap a job of equal or higher priority are
+        rejected. Lower-priority pending jobs that overlap are preempted.
+
+        Args:
+            start: start time as an RFC 3339 string
+            duration: length of the job in seconds
+            body: ID or index of the body to track
+            name: description of the job
+            priority: higher priority jobs preempt lower priority ones
+            scan: optional scan parameters, as passed to scan()
+            bands: optional list of {'band': n, 'rx': bool, 'tx': bool}
+                settings applied for the job
+            park: whether to park the antenna when the job ends
+        """
+        job = {
+            'name': name,
+            'start': start,
+            'duration': duration,
+            'priority': priority,
+            'body': body,
+            'park': park,
+        }
+        if scan:
+            job['scan'] = scan
+        if bands:
+            job['bands'] = bands
+        self._send({
+            'command': 'schedule_add',
+            'job': job,
+        })
+
+    def schedule_cancel(self, job_id):
+        """Cancel a pending or running job.
+
+        Args:
+            job_id: ID of the job as returned by self.schedule
+        """
+        self._send({
+            'command': 'schedule_cancel',
+            'id': job_id,
+        })
+
+    @property
+    def schedule(self):
+        """Return the pending and running jobs.
+
+        Returns:
+            List of dictionaries with the keys id, name, start, duration,
+            priority, body, scan, bands, park, state, and error
+        """
+        return self.status.get('Schedule')
+
     def set_band_tx(self, band, enabled, wait=True, timeout=5):
         """Set a band to transmit.
 
@@ -220,6 +569,19 @@ class Client(object):
         """
         return self.status.get('Bodies')
 
+    @property
+    def body_details(self):
+        """Return metadata for each known body.
+
+        Each element is a dictionary with the keys ID, Index, Name, Kind,
+        Catalog, User, RA, Dec, Az, El, and Visible. The ID does not
+        change when bodies are added or removed.
+
+        Returns:
+            List of dictionaries
+        """
+        return self.status.get('BodyDetails')
+
     @property
     def status(self):
         """Returns the latest status dictionary."""
@@ -265,6 +627,58 @@ class Client(object):
             }
         })
 
+    def add_tle(self, name, line1, line2):
+        """Add an earth satellite to the list of known bodies.
+
+        Args:
+            name: name of the satellite
+            line1: first line of the two-line element set
+            line2: second line of the two-line element set
+        """
+        self._send({
+            'command': 'add_tle',
+            'tle': {
+                'name': name,
+                'line1': line1,
+                'line2': line2,
+            }
+        })
+
+    def add_catalog(self, name):
+        """Add an object from the server's catalogs to the list of known bodies.
+
+        Args:
+            name: name or designation of the object (e.g. "3C 273")
+        """
+        self._send({
+            'command': 'add_catalog',
+            'name': name,
+        })
+
+    def remove_body(self, body):
+        """Remove a body that was added by a client.
+
+        Args:
+            body: ID or index of the body
+        """
+        self._send({
+            'command': 'remove_body',
+            'body': body,
+        })
+
+    def rename_body(self, body, name):
+        """Rename a body that was added by a client.
+
+        Args:
+            body: ID or index of the body
+            name: new name of the body
+        """
+        self._send({
+            'command': 'rename_body',
+            'body': body,
+            'name': name,
+        })
+
 if __name__ == "__main__":
     import time
     client = Client("ws://w1xm-radar-1.mit.edu:8502/api/ws")
@@ -0,0 +1,114 @@
+// Command pointing_fit fits a pointing model to calibration observations.
+//
+// Each input file is CSV with the columns encoder_az, encoder_el,
+// observed_az, observed_el (degrees). Lines starting with # and a header
+// line are ignored.
+package main
+
+import (
+	"encoding/csv"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/w1xm/rci_interface/pointing"
+)
+
+var (
+	terms  = flag.String("terms", "IA,IE,CA,NPAE,AN,AW,TF", "comma-separated list of terms to fit")
+	output = flag.String("o", "", "file to write the model to (default stdout)")
+)
+
+func readObservations(path string) ([]pointing.Observation, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r := csv.NewReader(f)
+	r.Comment = '#'
+	r.FieldsPerRecord = 4
+	r.TrimLeadingSpace = true
+	var out []pointing.Observation
+	for line := 1; ; line++ {
+		rec, err := r.Read()
+		if err == io.EOF {
+			return out, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		var v [4]float64
+		for i := range v {
+			if v[i], err = strconv.ParseFloat(rec[i], 64); err != nil {
+				break
+			}
+		}
+		if err != nil {
+			if line == 1 {
+				// Header
+				continue
+			}
+			return nil, fmt.Errorf("%s: record %d: %w", path, line, err)
+		}
+		out = append(out, pointing.Observation{
+			EncoderAz:  v[0],
+			EncoderEl:  v[1],
+			ObservedAz: v[2],
+			ObservedEl: v[3],
+		})
+	}
+}
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] observations.csv...\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	var obs []pointing.Observation
+	for _, path := range flag.Args() {
+		o, err := readObservations(path)
+		if err != nil {
+			log.Fatal(err)
+		}
+		obs = append(obs, o...)
+	}
+	var names []string
+	for _, t := range strings.Split(*terms, ",") {
+		if t = strings.ToUpper(strings.TrimSpace(t)); t != "" {
+			names = append(names, t)
+		}
+	}
+	res, err := pointing.Fit(obs, names)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("%d observations, RMS %.4f -> %.4f degrees", len(obs), res.InitialRMS, res.RMS)
+	sort.Strings(names)
+	for _, name := range names {
+		log.Printf("%-5s %10.6f +/- %.6f", name, res.Model[name], res.Sigma[name])
+	}
+	w := os.Stdout
+	if *output != "" {
+		f, err := os.Create(*output)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer f.Close()
+		w = f
+	}
+	fmt.Fprintf(w, "# Fit to %d observations, RMS %.4f degrees\n", len(obs), res.RMS)
+	if err := res.Model.Write(w); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// AuditEntry records a command that could change the state of the antenna.
+type AuditEntry struct {
+	Time time.Time
+	// Surface is "websocket", "rotctld", "rest", "scheduler", or "signal".
+	Surface string
+	// User is the authenticated user, if any, and Client is the name the
+	// client gave for itself.
+	User       string `json:",omitempty"`
+	Client     string `json:",omitempty"`
+	Role       Role
+	RemoteAddr string `json:",omitempty"`
+	Command    string
+	Args       json.RawMessage `json:",omitempty"`
+	// Outcome is "ok", "refused" if the client wasn't allowed to send the
+	// command, or "failed".
+	Outcome string
+	Error   string `json:",omitempty"`
+}
+
+// unauditedCommands are sent periodically and don't change what the antenna is doing.
+var unauditedCommands = map[string]bool{
+	"renew_lease": true,
+}
+
+// AuditLog appends entries to a JSONL file. When the file grows past
+// MaxSize bytes it is renamed with the suffix ".1", and older files are
+// shifted up to the suffix ".Keep".
+type AuditLog struct {
+	Path    string
+	MaxSize int64
+	Keep    int
+
+	mu   sync.Mutex
+	f    *os.File
+	size int64
+}
+
+func (a *AuditLog) open() error {
+	f, err := os.OpenFile(a.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	a.f, a.size = f, fi.Size()
+	return nil
+}
+
+// rotate must be called with a.mu locked.
+func (a *AuditLog) rotate() error {
+	if a.f != nil {
+		a.f.Close()
+		a.f = nil
+	}
+	if a.Keep < 1 {
+		return os.Remove(a.Path)
+	}
+	for i := a.Keep - 1; i >= 1; i-- {
+		if err := os.Rename(fmt.Sprintf("%s.%d", a.Path, i), fmt.Sprintf("%s.%d", a.Path, i+1)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return os.Rename(a.Path, a.Path+".1")
+}
+
+// Record appends entries to the log. Errors are logged.
+func (a *AuditLog) Record(entries ...AuditEntry) {
+	if a == nil || len(entries) == 0 {
+		return
+	}
+	var data []byte
+	for _, e := range entries {
+		if e.Time.IsZero() {
+			e.Time = time.Now()
+		}
+		line, err := json.Marshal(e)
+		if err != nil {
+			log.Printf("audit: %v", err)
+			continue
+		}
+		data = append(append(data, line...), '\n')
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.f != nil && a.MaxSize > 0 && a.size > 0 && a.size+int64(len(data)) > a.MaxSize {
+		if err := a.rotate(); err != nil {
+			log.Printf("audit: rotating %s: %v", a.Path, err)
+		}
+	}
+	if a.f == nil {
+		if err := a.open(); err != nil {
+			log.Printf("audit: %v", err)
+			return
+		}
+	}
+	n, err := a.f.Write(data)
+	a.size += int64(n)
+	if err != nil {
+		log.Printf("audit: %v", err)
+	}
+}
+
+// auditFile is a log file as it was when a query started.
+type auditFile struct {
+	f    *os.File
+	size int64
+}
+
+// snapshot opens the log files, oldest first, and notes their sizes, so
+// that they can be read without blocking Record.
+func (a *AuditLog) snapshot() ([]auditFile, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	var files []auditFile
+	for i := a.Keep; i >= 0; i-- {
+		path := a.Path
+		if i > 0 {
+			path = fmt.Sprintf("%s.%d", a.Path, i)
+		}
+		f, err := os.Open(path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		var fi os.FileInfo
+		if err == nil {
+			if fi, err = f.Stat(); err != nil {
+				f.Close()
+			}
+		}
+		if err != nil {
+			for _, af := range files {
+				af.f.Close()
+			}
+			return nil, err
+		}
+		files = append(files, auditFile{f, fi.Size()})
+	}
+	return files, nil
+}
+
+// Query returns the entries at or after since, from user if it is not
+// empty, oldest first.
+func (a *AuditLog) Query(since time.Time, user string) ([]AuditEntry, error) {
+	files, err := a.snapshot()
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		for _, af := range files {
+			af.f.Close()
+		}
+	}()
+	entries := []AuditEntry{}
+	for _, af := range files {
+		// Entries written since the snapshot are left for the next query.
+		scanner := bufio.NewScanner(io.LimitReader(af.f, af.size))
+		scanner.Buffer(nil, 1<<20)
+		for scanner.Scan() {
+			var e AuditEntry
+			if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+				continue
+			}
+			if e.Time.Before(since) || (user != "" && e.User != user) {
+				continue
+			}
+			entries = append(entries, e)
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return entries, nil
+}
+
+// queueAudit holds an entry until takeAudit is called, so that it can be
+// recorded after s.mu is unlocked. It must be called with s.mu locked.
+func (s *Server) queueAudit(e AuditEntry) {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	s.auditQueue = append(s.auditQueue, e)
+}
+
+// takeAudit returns and clears the entries held by queueAudit.
+// It must be called with s.mu locked.
+func (s *Server) takeAudit() []AuditEntry {
+	entries := s.auditQueue
+	s.auditQueue = nil
+	return entries
+}
+
+// auditArgs encodes the arguments of a command for the audit log.
+func auditArgs(args interface{}) json.RawMessage {
+	if args == nil {
+		return nil
+	}
+	data, err := json.Marshal(args)
+	if err != nil {
+		return nil
+	}
+	return data
+}
+
+// auditOutcome returns the outcome and error of a command for the audit log.
+func auditOutcome(err error) (string, string) {
+	if err != nil {
+		return "failed", err.Error()
+	}
+	return "ok", ""
+}
+
+// auditRequest records the outcome of a command sent with the REST API,
+// given the entry returned by authorizeRequest.
+func (s *Server) auditRequest(entry *AuditEntry, args interface{}, err error) {
+	e := *entry
+	e.Args = auditArgs(args)
+	e.Outcome, e.Error = auditOutcome(err)
+	s.audit.Record(e)
+}
+
+// AuditHandler returns the entries of the audit log. The since parameter
+// (RFC 3339) and user parameter filter the entries.
+func (s *Server) AuditHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if _, role := s.requestAuth(r); role < RoleOperator {
+		w.Header().Set("WWW-Authenticate", `Basic realm="radar"`)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if s.audit == nil {
+		http.Error(w, "audit log is not enabled", http.StatusNotFound)
+		return
+	}
+	var since time.Time
+	if v := r.FormValue("since"); v != "" {
+		var err error
+		if since, err = time.Parse(time.RFC3339, v); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	entries, err := s.audit.Query(since, r.FormValue("user"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, entries)
+}
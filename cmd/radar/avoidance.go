@@ -0,0 +1,375 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pebbe/novas"
+)
+
+const (
+	// avoidanceStep is the spacing (degrees) of the points checked along the path of a move.
+	avoidanceStep = 0.5
+	// avoidanceLookahead is how far ahead motion is extrapolated when checking velocity commands.
+	avoidanceLookahead = 2 * time.Second
+	// avoidanceLogInterval limits how often repeated avoidance events are logged.
+	avoidanceLogInterval = 10 * time.Second
+)
+
+type MaskPoint struct {
+	Az, El float64
+}
+
+// HorizonMask is a table of the minimum elevation at each azimuth, sorted by azimuth.
+// Elevations between points are linearly interpolated.
+type HorizonMask []MaskPoint
+
+// loadHorizonMask reads a horizon mask file. Each line contains an azimuth
+// and a minimum elevation in degrees, separated by whitespace or a comma.
+// Blank lines and lines starting with # are ignored.
+func loadHorizonMask(path string) (HorizonMask, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var mask HorizonMask
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.FieldsFunc(line, func(r rune) bool { return r == ',' || r == ' ' || r == '\t' })
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected azimuth and elevation", path, n)
+		}
+		az, err := strconv.ParseFloat(fields[0], 64)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, n, err)
+		}
+		el, err := strconv.ParseFloat(fields[1], 64)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, n, err)
+		}
+		if el < -90 || el > 90 {
+			return nil, fmt.Errorf("%s:%d: elevation %v out of range", path, n, el)
+		}
+		mask = append(mask, MaskPoint{clampAngle(az), el})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	sort.Slice(mask, func(i, j int) bool { return mask[i].Az < mask[j].Az })
+	return mask, nil
+}
+
+// MinElevation returns the minimum elevation at az.
+func (m HorizonMask) MinElevation(az float64) float64 {
+	if len(m) == 0 {
+		return math.Inf(-1)
+	}
+	az = clampAngle(az)
+	i := sort.Search(len(m), func(i int) bool { return m[i].Az > az })
+	// Interpolate between the points on either side, wrapping around north.
+	prev, next := m[(i+len(m)-1)%len(m)], m[i%len(m)]
+	span := clampAngle(next.Az - prev.Az)
+	if span == 0 {
+		return prev.El
+	}
+	frac := clampAngle(az-prev.Az) / span
+	return prev.El + frac*(next.El-prev.El)
+}
+
+// AvoidanceEvent records a move that was rejected or modified.
+type AvoidanceEvent struct {
+	Time time.Time
+	// Source is the interface that issued the move, e.g. "websocket" or "rotctld".
+	Source string
+	// Az and El are the requested position.
+	Az, El float64
+	// Action is "rejected", "clipped", or "stopped".
+	Action string
+	Reason string
+}
+
+type AvoidanceStatus struct {
+	// SunRadius and MoonRadius are the exclusion radii (degrees), or 0 if disabled.
+	SunRadius, MoonRadius float64
+	HorizonMask           HorizonMask
+	// LastEvent is the most recent move that was rejected or modified.
+	LastEvent *AvoidanceEvent
+}
+
+// avoidance holds the configuration of forbidden regions of the sky.
+type avoidance struct {
+	mask       HorizonMask
+	sunRadius  float64
+	moonRadius float64
+	sun, moon  *novas.Body
+}
+
+// exclusion describes a body that must not be approached.
+type exclusion struct {
+	name   string
+	az, el float64
+	radius float64
+}
+
+// exclusions returns the current positions of the Sun and Moon, if they are avoided.
+func (a *avoidance) exclusions(place *novas.Place, refr novas.RefractType) []exclusion {
+	now := novas.Now()
+	var out []exclusion
+	for _, e := range []struct {
+		body   *novas.Body
+		radius float64
+	}{
+		{a.sun, a.sunRadius},
+		{a.moon, a.moonRadius},
+	} {
+		if e.radius <= 0 {
+			continue
+		}
+		topo := bodyTopo(e.body, now, place, refr)
+		out = append(out, exclusion{e.body.Name(), topo.Az, topo.Alt, e.radius})
+	}
+	return out
+}
+
+// violation returns a description of why az/el is forbidden, or "" if it is allowed.
+func (a *avoidance) violation(az, el float64, excl []exclusion) string {
+	if min := a.mask.MinElevation(az); el < min {
+		return fmt.Sprintf("elevation %.2f is below the horizon mask (%.2f at azimuth %.2f)", el, min, az)
+	}
+	for _, e := range excl {
+		if d := angularSeparation(az, el, e.az, e.el); d < e.radius {
+			return fmt.Sprintf("%.2f degrees from the %s (minimum %.2f)", d, e.name, e.radius)
+		}
+	}
+	return ""
+}
+
+// checkMove checks a move from the current position to the target.
+// If the target is below the horizon mask it is clipped to the mask, and
+// clipped is true. An error is returned if the target is forbidden, or if
+// the path to it passes through a forbidden region. Forbidden regions that
+// contain the current position are ignored along the path, so that the
+// antenna can always move out of them.
+func (a *avoidance) checkMove(place *novas.Place, refr novas.RefractType, fromAz, fromEl, az, el float64) (newEl float64, clipped bool, err error) {
+	if min := a.mask.MinElevation(az); el < min {
+		el, clipped = min, true
+	}
+	excl := a.exclusions(place, refr)
+	if v := a.violation(az, el, excl); v != "" {
+		return el, clipped, fmt.Errorf("target %s", v)
+	}
+	if a.violation(fromAz, fromEl, excl) != "" {
+		return el, clipped, nil
+	}
+	dAz := math.Remainder(az-fromAz, 360)
+	dEl := el - fromEl
+	n := int(math.Max(math.Abs(dAz), math.Abs(dEl)) / avoidanceStep)
+	for i := 1; i < n; i++ {
+		frac := float64(i) / float64(n)
+		pAz, pEl := clampAngle(fromAz+frac*dAz), fromEl+frac*dEl
+		if v := a.violation(pAz, pEl, excl); v != "" {
+			return el, clipped, fmt.Errorf("path passes %s", v)
+		}
+	}
+	return el, clipped, nil
+}
+
+// checkMotion checks that moving from az/el at the given velocities
+// (degrees/second) does not enter a forbidden region.
+func (a *avoidance) checkMotion(place *novas.Place, refr novas.RefractType, az, el, azVel, elVel float64) error {
+	excl := a.exclusions(place, refr)
+	if a.violation(az, el, excl) != "" {
+		// Allow moving out of a forbidden region.
+		return nil
+	}
+	t := avoidanceLookahead.Seconds()
+	if v := a.violation(clampAngle(az+azVel*t), el+elVel*t, excl); v != "" {
+		return fmt.Errorf("motion would reach %s", v)
+	}
+	return nil
+}
+
+// recordAvoidance reports an avoidance event in the status.
+func (s *Server) recordAvoidance(source string, az, el float64, action string, err error) {
+	ev := &AvoidanceEvent{
+		Time:   time.Now(),
+		Source: source,
+		Az:     az,
+		El:     el,
+		Action: action,
+		Reason: err.Error(),
+	}
+	s.statusMu.Lock()
+	last := s.status.Avoidance.LastEvent
+	if last == nil || last.Action != ev.Action || last.Source != ev.Source || ev.Time.Sub(last.Time) > avoidanceLogInterval {
+		log.Printf("%s move to (%.2f, %.2f) %s: %v", source, az, el, action, err)
+	} else {
+		// Keep the time of the first of a series of repeated events, to limit logging.
+		ev.Time = last.Time
+	}
+	// Replace rather than modify the status, which may be shared with clones.
+	avoid := *s.status.Avoidance
+	avoid.LastEvent = ev
+	s.status.Avoidance = &avoid
+	s.statusCond.Broadcast()
+	s.statusMu.Unlock()
+}
+
+// currentPosition returns the actual position of the antenna, and the
+// commanded position of each axis if it is in position mode (or the actual
+// position otherwise).
+func (s *Server) currentPosition() (az, el float64, commandAz, commandEl float64) {
+	s.statusMu.RLock()
+	defer s.statusMu.RUnlock()
+	if s.status.Status == nil {
+		return 0, 0, 0, 0
+	}
+	az, el = s.status.AzimuthPosition(), s.status.ElevationPosition()
+	commandAz, commandEl = az, el
+	if flags, pos := s.status.AzimuthCommand(); flags == "POSITION" {
+		commandAz = pos
+	}
+	if flags, pos := s.status.ElevationCommand(); flags == "POSITION" {
+		commandEl = pos
+	}
+	return az, el, commandAz, commandEl
+}
+
+// moveTo commands the antenna to az/el, subject to avoidance.
+// It must be called with s.mu locked.
+func (s *Server) moveTo(source string, az, el float64) error {
+	if err := s.checkEmergencyStop(); err != nil {
+		return err
+	}
+	if s.avoid != nil {
+		curAz, curEl, _, _ := s.currentPosition()
+		newEl, clipped, err := s.avoid.checkMove(s.place, s.refraction, curAz, curEl, az, el)
+		if err != nil {
+			s.recordAvoidance(source, az, el, "rejected", err)
+			return err
+		}
+		if clipped {
+			s.recordAvoidance(source, az, el, "clipped", fmt.Errorf("elevation clipped to horizon mask (%.2f)", newEl))
+		}
+		el = newEl
+	}
+	s.commandAzimuth(az)
+	s.r.SetElevationPosition(el)
+	s.noteMove()
+	return nil
+}
+
+// moveAzimuth commands the azimuth axis to az, subject to avoidance.
+// It must be called with s.mu locked.
+func (s *Server) moveAzimuth(source string, az float64) error {
+	if err := s.checkEmergencyStop(); err != nil {
+		return err
+	}
+	if s.avoid != nil {
+		curAz, curEl, _, commandEl := s.currentPosition()
+		if _, _, err := s.avoid.checkMove(s.place, s.refraction, curAz, curEl, az, commandEl); err != nil {
+			s.recordAvoidance(source, az, commandEl, "rejected", err)
+			return err
+		}
+	}
+	s.commandAzimuth(az)
+	s.noteMove()
+	return nil
+}
+
+// moveElevation commands the elevation axis to el, subject to avoidance.
+// It must be called with s.mu locked.
+func (s *Server) moveElevation(source string, el float64) error {
+	if err := s.checkEmergencyStop(); err != nil {
+		return err
+	}
+	if s.avoid != nil {
+		curAz, curEl, commandAz, _ := s.currentPosition()
+		newEl, clipped, err := s.avoid.checkMove(s.place, s.refraction, curAz, curEl, commandAz, el)
+		if err != nil {
+			s.recordAvoidance(source, commandAz, el, "rejected", err)
+			return err
+		}
+		if clipped {
+			s.recordAvoidance(source, commandAz, el, "clipped", fmt.Errorf("elevation clipped to horizon mask (%.2f)", newEl))
+		}
+		el = newEl
+	}
+	s.r.SetElevationPosition(el)
+	s.noteMove()
+	return nil
+}
+
+// setVelocity commands the velocity of each axis, subject to avoidance.
+// It must be called with s.mu locked.
+func (s *Server) setVelocity(source string, azVel, elVel float64, setAz, setEl bool) error {
+	if err := s.checkEmergencyStop(); err != nil {
+		return err
+	}
+	if s.avoid != nil {
+		az, el, _, _ := s.currentPosition()
+		// Include the current motion of the axis that isn't being changed.
+		s.statusMu.RLock()
+		var curAzVel, curElVel float64
+		if s.status.Status != nil {
+			curAzVel, curElVel = s.status.AzElVelocity()
+		}
+		s.statusMu.RUnlock()
+		if !setAz {
+			azVel = curAzVel
+		}
+		if !setEl {
+			elVel = curElVel
+		}
+		if err := s.avoid.checkMotion(s.place, s.refraction, az, el, azVel, elVel); err != nil {
+			s.recordAvoidance(source, az, el, "rejected", err)
+			return err
+		}
+	}
+	if setAz {
+		s.r.SetAzimuthVelocity(azVel)
+	}
+	if setEl {
+		s.r.SetElevationVelocity(elVel)
+	}
+	if (setAz && azVel != 0) || (setEl && elVel != 0) {
+		s.noteMove()
+	}
+	return nil
+}
+
+// guardMotion stops the antenna if its current motion is about to enter a forbidden region.
+// It must be called with s.mu locked.
+func (s *Server) guardMotion() {
+	if s.avoid == nil {
+		return
+	}
+	s.statusMu.RLock()
+	if s.status.Status == nil {
+		s.statusMu.RUnlock()
+		return
+	}
+	az, el := s.status.AzimuthPosition(), s.status.ElevationPosition()
+	azVel, elVel := s.status.AzElVelocity()
+	s.statusMu.RUnlock()
+	if azVel == 0 && elVel == 0 {
+		return
+	}
+	if err := s.avoid.checkMotion(s.place, s.refraction, az, el, azVel, elVel); err != nil {
+		s.track(nil)
+		s.r.Stop()
+		s.recordAvoidance("guard", az, el, "stopped", err)
+	}
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pebbe/novas"
+)
+
+// Body is an object that can be tracked. *novas.Body implements Body.
+type Body interface {
+	Name() string
+	Topo(t novas.Time, place *novas.Place, refr novas.RefractType) novas.BodyTopoData
+}
+
+// novasMu serializes calls into NOVAS, which is not reentrant.
+var novasMu sync.Mutex
+
+// bodyTopo returns the position of a body. Positions must only be computed
+// with bodyTopo, so that NOVAS is called by one goroutine at a time.
+func bodyTopo(b Body, t novas.Time, place *novas.Place, refr novas.RefractType) novas.BodyTopoData {
+	novasMu.Lock()
+	defer novasMu.Unlock()
+	return b.Topo(t, place, refr)
+}
+
+// bodyApp returns the apparent place of a body, holding novasMu.
+func bodyApp(b *novas.Body, t novas.Time) novas.BodyData {
+	novasMu.Lock()
+	defer novasMu.Unlock()
+	return b.App(t)
+}
+
+// Kinds of bodies.
+const (
+	kindSun       = "sun"
+	kindMoon      = "moon"
+	kindPlanet    = "planet"
+	kindStar      = "star"
+	kindSatellite = "satellite"
+)
+
+// bodyEntry is an element of the list of bodies.
+type bodyEntry struct {
+	Body
+	// id identifies the body. It does not change when bodies are added or removed.
+	id      string
+	kind    string
+	catalog string
+	// saved is non-nil for bodies added by a client.
+	saved *savedBody
+	// target is non-nil for positions tracked with track_radec or track_galactic.
+	target *TrackTarget
+}
+
+// trackTarget describes b for Status.Target.
+func (b *bodyEntry) trackTarget() *TrackTarget {
+	if b.target != nil {
+		return b.target
+	}
+	return &TrackTarget{
+		Frame:  "body",
+		Name:   b.Name(),
+		BodyID: b.id,
+	}
+}
+
+// BodyInfo describes a body in the status.
+type BodyInfo struct {
+	ID string
+	// Index is the position of the body in Status.Bodies.
+	Index   int
+	Name    string
+	Kind    string
+	Catalog string `json:",omitempty"`
+	// User is true if the body was added by a client.
+	User bool
+	// RA (hours) and Dec (degrees) are the apparent place of date. They are omitted for satellites.
+	RA  *float64 `json:",omitempty"`
+	Dec *float64 `json:",omitempty"`
+	// Az and El are the current topocentric position (degrees).
+	Az, El float64
+	// Visible is true if the body is above the horizon.
+	Visible bool
+}
+
+// bodyInfoInterval is how often the positions in Status.BodyDetails are refreshed.
+const bodyInfoInterval = 5 * time.Second
+
+// BodyRef refers to a body by ID, or by index for compatibility with older clients.
+// It is encoded in JSON as either a string or a number.
+type BodyRef struct {
+	ID    string
+	Index int
+}
+
+func (r *BodyRef) UnmarshalJSON(data []byte) error {
+	*r = BodyRef{}
+	if err := json.Unmarshal(data, &r.ID); err == nil {
+		return nil
+	}
+	return json.Unmarshal(data, &r.Index)
+}
+
+func (r BodyRef) MarshalJSON() ([]byte, error) {
+	if r.ID != "" {
+		return json.Marshal(r.ID)
+	}
+	return json.Marshal(r.Index)
+}
+
+// lookupBody returns the body referred to by ref, or nil if ref is zero.
+// It must be called with s.mu locked.
+func (s *Server) lookupBody(ref BodyRef) (*bodyEntry, error) {
+	if ref.ID != "" {
+		for _, b := range s.bodies {
+			if b.id == ref.ID {
+				return b, nil
+			}
+		}
+		return nil, fmt.Errorf("unknown body %q", ref.ID)
+	}
+	if ref.Index == 0 {
+		return nil, nil
+	}
+	if ref.Index < 0 || ref.Index > len(s.bodies) {
+		return nil, fmt.Errorf("invalid body %d", ref.Index)
+	}
+	return s.bodies[ref.Index-1], nil
+}
+
+// bodyIndex returns the index of b in Status.Bodies, or 0 if b is nil or not in the list.
+func (s *Server) bodyIndex(b *bodyEntry) int {
+	for i, b2 := range s.bodies {
+		if b2 == b {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+// slug converts a name into an ID, e.g. "Cygnus A" into "cygnus-a".
+func slug(name string) string {
+	var b strings.Builder
+	dash := false
+	for _, r := range strings.ToLower(name) {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') {
+			if dash && b.Len() > 0 {
+				b.WriteByte('-')
+			}
+			dash = false
+			b.WriteRune(r)
+			continue
+		}
+		dash = true
+	}
+	if b.Len() == 0 {
+		return "body"
+	}
+	return b.String()
+}
+
+// uniqueID returns base, with a numeric suffix if it is already in use or
+// reserved for a saved body.
+func (s *Server) uniqueID(base string) string {
+	used := make(map[string]bool)
+	for id := range s.reservedIDs {
+		used[id] = true
+	}
+	for _, b := range s.bodies {
+		used[b.id] = true
+	}
+	id := base
+	for n := 2; used[id]; n++ {
+		id = base + "-" + strconv.Itoa(n)
+	}
+	return id
+}
+
+// addBody appends body to the list of bodies with a unique ID derived from id.
+// It must be called with statusMu locked, or before the server is started.
+func (s *Server) addBody(body Body, id, kind, catalog string, saved *savedBody) *bodyEntry {
+	b := &bodyEntry{
+		Body:    body,
+		id:      s.uniqueID(id),
+		kind:    kind,
+		catalog: catalog,
+		saved:   saved,
+	}
+	s.bodies = append(s.bodies, b)
+	return b
+}
+
+func designation(catalog string, number int64) string {
+	if catalog == "" {
+		return ""
+	}
+	return fmt.Sprintf("%s %d", catalog, number)
+}
+
+// updateBodies syncs the status with s.bodies.
+// It must be called with statusMu locked.
+func (s *Server) updateBodies() {
+	s.status.Bodies = []string{"NONE"}
+	details := make([]BodyInfo, 0, len(s.bodies))
+	old := make(map[string]BodyInfo)
+	for _, info := range s.status.BodyDetails {
+		old[info.ID] = info
+	}
+	for i, b := range s.bodies {
+		s.status.Bodies = append(s.status.Bodies, b.Name())
+		// Keep the last computed position until the next refresh.
+		info := old[b.id]
+		info.ID = b.id
+		info.Index = i + 1
+		info.Name = b.Name()
+		info.Kind = b.kind
+		info.Catalog = b.catalog
+		info.User = b.saved != nil
+		details = append(details, info)
+	}
+	s.status.BodyDetails = details
+	s.status.CommandTrackingBody = s.bodyIndex(s.tracking)
+	s.status.CommandTrackingBodyID = ""
+	s.status.Target = nil
+	if s.tracking != nil {
+		s.status.CommandTrackingBodyID = s.tracking.id
+		s.status.Target = s.tracking.trackTarget()
+	}
+}
+
+// bodyPositions computes the current position of each body.
+// It must be called with s.mu locked.
+func (s *Server) bodyPositions() map[string]BodyInfo {
+	now := novas.Now()
+	out := make(map[string]BodyInfo)
+	for _, b := range s.bodies {
+		var info BodyInfo
+		topo := bodyTopo(b, now, s.place, s.refraction)
+		if !math.IsNaN(topo.Az) && !math.IsNaN(topo.Alt) {
+			info.Az, info.El = topo.Az, topo.Alt
+			info.Visible = topo.Alt > 0
+		}
+		if nb, ok := b.Body.(*novas.Body); ok {
+			app := bodyApp(nb, now)
+			info.RA, info.Dec = &app.RA, &app.Dec
+		}
+		out[b.id] = info
+	}
+	return out
+}
+
+// updateBodyPositions refreshes the positions in Status.BodyDetails.
+func (s *Server) updateBodyPositions() {
+	s.mu.Lock()
+	positions := s.bodyPositions()
+	s.mu.Unlock()
+	s.statusMu.Lock()
+	defer s.statusMu.Unlock()
+	for i := range s.status.BodyDetails {
+		info := &s.status.BodyDetails[i]
+		if p, ok := positions[info.ID]; ok {
+			info.RA, info.Dec = p.RA, p.Dec
+			info.Az, info.El = p.Az, p.El
+			info.Visible = p.Visible
+		}
+	}
+	s.statusCond.Broadcast()
+}
+
+func (s *Server) bodyLoop(ctx context.Context) {
+	for {
+		s.updateBodyPositions()
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(bodyInfoInterval):
+		}
+	}
+}
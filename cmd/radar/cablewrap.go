@@ -0,0 +1,128 @@
+package main
+
+import (
+	"log"
+	"math"
+	"time"
+
+	"github.com/w1xm/rci_interface/rotator"
+)
+
+const (
+	// wrapPlanSpan is how far ahead a track is planned to avoid unwinding the cable wrap.
+	wrapPlanSpan = 12 * time.Hour
+	// wrapPlanStep is the spacing of positions used to plan a track.
+	wrapPlanStep = time.Minute
+)
+
+// WrapPlan describes the turn of the cable wrap chosen for the current track.
+type WrapPlan struct {
+	Name string
+	// StartAz and EndAz are the planned azimuths counting turns.
+	StartAz, EndAz float64
+	// End is the end of the plan, when the body sets or planning stopped.
+	End time.Time
+	// Unwind is set if the track will reach a limit of the cable wrap before End.
+	Unwind *time.Time `json:",omitempty"`
+}
+
+type wrapPlan struct {
+	body   Body
+	status WrapPlan
+	// az is the last commanded azimuth counting turns.
+	az float64
+}
+
+// newWrapPlan plans a track of body until it sets, choosing the turn of the
+// cable wrap that avoids unwinding. It must be called with s.mu locked.
+func (s *Server) newWrapPlan(body Body) *wrapPlan {
+	cur, ok := s.wrap.Position()
+	if !ok {
+		return nil
+	}
+	pass := s.samplePass(body, wrapPlanSpan, wrapPlanStep)
+	if len(pass.az) == 0 {
+		return nil
+	}
+	times := pass.times
+	azs := make([]float64, len(pass.az))
+	for i := range azs {
+		azs[i], _ = s.adjustTrack(body, times[i], clampAngle(pass.az[i]), pass.el[i])
+	}
+	config := s.wrap.Config()
+	path := rotator.UnwrapPath(azs)
+	shift, n := config.PlanWrap(path, cur)
+	if n == 0 {
+		return nil
+	}
+	p := &wrapPlan{
+		body: body,
+		az:   path[0] + shift,
+		status: WrapPlan{
+			Name:    body.Name(),
+			StartAz: path[0] + shift,
+			EndAz:   path[n-1] + shift,
+			End:     times[n-1],
+		},
+	}
+	if n < len(path) {
+		p.status.Unwind = &times[n]
+		log.Printf("tracking %s will reach the cable wrap limit at %v", body.Name(), times[n].Format(time.RFC3339))
+	}
+	return p
+}
+
+// planWrap makes sure the track of body is planned. It must be called with s.mu locked.
+func (s *Server) planWrap(body Body) {
+	if s.wrap == nil || s.wrapPlan != nil && s.wrapPlan.body == body {
+		return
+	}
+	s.wrapPlan = s.newWrapPlan(body)
+	s.statusMu.Lock()
+	s.status.WrapPlan = nil
+	if s.wrapPlan != nil {
+		status := s.wrapPlan.status
+		s.status.WrapPlan = &status
+	}
+	s.statusCond.Broadcast()
+	s.statusMu.Unlock()
+}
+
+// clearWrapPlan must be called with s.mu locked.
+func (s *Server) clearWrapPlan() {
+	if s.wrapPlan == nil {
+		return
+	}
+	s.wrapPlan = nil
+	s.statusMu.Lock()
+	s.status.WrapPlan = nil
+	s.statusCond.Broadcast()
+	s.statusMu.Unlock()
+}
+
+// commandAzimuth commands the azimuth axis, following the cable wrap plan
+// while tracking. It must be called with s.mu locked.
+func (s *Server) commandAzimuth(az float64) {
+	if p := s.wrapPlan; p != nil {
+		u := p.az + math.Remainder(az-p.az, 360)
+		err := s.wrap.SetUnwrappedAzimuthPosition(u)
+		if err == nil {
+			p.az = u
+			return
+		}
+		// Unwind by the shortest path, and plan again from there.
+		log.Printf("tracking %s: %v", p.body.Name(), err)
+		s.clearWrapPlan()
+	}
+	s.r.SetAzimuthPosition(az)
+}
+
+// wrapCut returns the azimuth through which the rotator can't move with position commands.
+func wrapCut(rotType string, azOffset float64) float64 {
+	if rotType == "rci" {
+		// The RCI moves between positions numerically, so it never crosses
+		// a register value of 0, which is reported as the azimuth offset.
+		return azOffset
+	}
+	return 0
+}
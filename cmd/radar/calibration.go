@@ -0,0 +1,496 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pebbe/novas"
+	"github.com/w1xm/rci_interface/rotator"
+)
+
+const (
+	// powerRetention is how long power samples are kept.
+	powerRetention = 5 * time.Minute
+	// fwhmPerSigma converts the standard deviation of a Gaussian to its full width at half maximum.
+	fwhmPerSigma = 2.354820045
+)
+
+// CalibrationParams describes a pointing calibration requested by a client.
+type CalibrationParams struct {
+	// Pattern is "fivepoint" or "crossscan".
+	Pattern string `json:"pattern"`
+	// Body is the ID or index of the source to calibrate on.
+	Body BodyRef `json:"body"`
+	// Offset is the distance of the outer points from the source for
+	// five-point calibrations, or the half-width of cross-scans (degrees on the sky).
+	Offset float64 `json:"offset"`
+	// Step is the spacing of points along cross-scans (degrees).
+	Step float64 `json:"step"`
+	// Settle is the time to wait after arriving at each point before integrating (seconds).
+	Settle float64 `json:"settle"`
+	// Dwell is the time to integrate power at each point (seconds).
+	Dwell float64 `json:"dwell"`
+	// Off is the cross-elevation offset of a reference point used to measure
+	// the baseline power (degrees). If 0, cross-scans estimate the baseline from
+	// their outermost points, and five-point calibrations assume samples are
+	// already baseline-subtracted.
+	Off float64 `json:"off"`
+	// Apply adds the fitted offsets to the rotator's azimuth and elevation offsets.
+	Apply bool `json:"apply"`
+}
+
+type CalibrationStatus struct {
+	Params CalibrationParams
+	// Point is the index of the current point.
+	Point  int
+	Points int
+}
+
+// CalibrationResult holds the fitted pointing error.
+type CalibrationResult struct {
+	Time time.Time
+	Body string
+	// Az and El are the position of the source at the end of the calibration.
+	Az, El float64
+	// XelOffset and ElOffset are the offsets from the predicted position at
+	// which the source was found (degrees on the sky). AzOffset is XelOffset in azimuth degrees.
+	XelOffset, ElOffset, AzOffset float64
+	// BeamwidthXel and BeamwidthEl are the fitted full width at half maximum (degrees).
+	BeamwidthXel, BeamwidthEl float64
+	// Peak is the fitted power at the center of the beam, above the baseline.
+	Peak     float64
+	Baseline float64
+	// Applied is true if the rotator's offsets were updated, to NewAzOffset and NewElOffset.
+	Applied                  bool
+	NewAzOffset, NewElOffset float64
+	Error                    string `json:",omitempty"`
+}
+
+type powerSample struct {
+	t     time.Time
+	power float64
+}
+
+// calPoint is a position relative to the source, in cross-elevation/elevation.
+type calPoint struct {
+	xel, el float64
+	// axis is 0 for points along cross-elevation, 1 along elevation, and -1 for the baseline reference.
+	axis int
+	// power is the measured power.
+	power float64
+}
+
+type calibration struct {
+	params CalibrationParams
+	body   *bodyEntry
+	points []calPoint
+	index  int
+	// arrived is the time the antenna reached the current point, or zero if it is still slewing.
+	arrived time.Time
+}
+
+func newCalibration(params CalibrationParams, body *bodyEntry) (*calibration, error) {
+	if body == nil {
+		return nil, errors.New("calibration requires a body")
+	}
+	if params.Offset <= 0 || params.Dwell <= 0 || params.Settle < 0 {
+		return nil, errors.New("offset and dwell must be positive")
+	}
+	c := &calibration{params: params, body: body}
+	if params.Off != 0 {
+		c.points = append(c.points, calPoint{xel: params.Off, axis: -1})
+	}
+	switch params.Pattern {
+	case "fivepoint":
+		d := params.Offset
+		c.points = append(c.points,
+			calPoint{xel: 0, axis: 0},
+			calPoint{xel: -d, axis: 0},
+			calPoint{xel: d, axis: 0},
+			calPoint{el: -d, axis: 1},
+			calPoint{el: d, axis: 1},
+		)
+	case "crossscan":
+		if params.Step <= 0 {
+			return nil, errors.New("step must be positive")
+		}
+		n := int(params.Offset / params.Step)
+		if n < 1 || 2*(2*n+1) > maxScanPoints {
+			return nil, fmt.Errorf("invalid cross-scan step %v", params.Step)
+		}
+		for axis := 0; axis < 2; axis++ {
+			for i := -n; i <= n; i++ {
+				p := calPoint{axis: axis}
+				if axis == 0 {
+					p.xel = float64(i) * params.Step
+				} else {
+					p.el = float64(i) * params.Step
+				}
+				c.points = append(c.points, p)
+			}
+		}
+	default:
+		return nil, fmt.Errorf("unknown calibration pattern %q", params.Pattern)
+	}
+	return c, nil
+}
+
+func (c *calibration) status() *CalibrationStatus {
+	return &CalibrationStatus{
+		Params: c.params,
+		Point:  c.index,
+		Points: len(c.points),
+	}
+}
+
+// fitGaussian fits p = peak*exp(-(x-center)^2/(2 sigma^2)) to the points by
+// weighted least squares on log(p). Points with p <= 0 are ignored.
+func fitGaussian(xs, ps []float64) (center, fwhm, peak float64, err error) {
+	// Fit log(p) = a + b x + c x^2, weighting each point by p^2 to account
+	// for the log transform.
+	var s [5]float64 // sum of w x^k
+	var t [3]float64 // sum of w x^k log(p)
+	n := 0
+	for i, x := range xs {
+		p := ps[i]
+		if p <= 0 {
+			continue
+		}
+		n++
+		w := p * p
+		lp := math.Log(p)
+		xk := 1.0
+		for k := 0; k < 5; k++ {
+			s[k] += w * xk
+			if k < 3 {
+				t[k] += w * xk * lp
+			}
+			xk *= x
+		}
+	}
+	if n < 3 {
+		return 0, 0, 0, errors.New("fewer than three points above the baseline")
+	}
+	m := [3][3]float64{
+		{s[0], s[1], s[2]},
+		{s[1], s[2], s[3]},
+		{s[2], s[3], s[4]},
+	}
+	det := func(m [3][3]float64) float64 {
+		return m[0][0]*(m[1][1]*m[2][2]-m[1][2]*m[2][1]) -
+			m[0][1]*(m[1][0]*m[2][2]-m[1][2]*m[2][0]) +
+			m[0][2]*(m[1][0]*m[2][1]-m[1][1]*m[2][0])
+	}
+	d := det(m)
+	if d == 0 {
+		return 0, 0, 0, errors.New("degenerate points")
+	}
+	// Cramer's rule
+	var coef [3]float64
+	for i := range coef {
+		mi := m
+		for r := 0; r < 3; r++ {
+			mi[r][i] = t[r]
+		}
+		coef[i] = det(mi) / d
+	}
+	a, b, c := coef[0], coef[1], coef[2]
+	if c >= 0 {
+		return 0, 0, 0, errors.New("no peak found")
+	}
+	center = -b / (2 * c)
+	sigma := math.Sqrt(-1 / (2 * c))
+	peak = math.Exp(a - b*b/(4*c))
+	return center, sigma * fwhmPerSigma, peak, nil
+}
+
+// fit computes the pointing error from the measured powers.
+func (c *calibration) fit() (*CalibrationResult, error) {
+	res := &CalibrationResult{Time: time.Now(), Body: c.body.Name()}
+	var xs, ps [2][]float64
+	baseline := math.NaN()
+	for _, p := range c.points {
+		switch p.axis {
+		case -1:
+			baseline = p.power
+		case 0:
+			xs[0] = append(xs[0], p.xel)
+			ps[0] = append(ps[0], p.power)
+		case 1:
+			xs[1] = append(xs[1], p.el)
+			ps[1] = append(ps[1], p.power)
+		}
+	}
+	if c.params.Pattern == "fivepoint" {
+		// The center point is shared by both axes.
+		xs[1] = append(xs[1], 0)
+		ps[1] = append(ps[1], ps[0][0])
+	}
+	if math.IsNaN(baseline) {
+		if c.params.Pattern == "crossscan" {
+			// Use the mean of the ends of the scans.
+			var sum float64
+			for axis := range ps {
+				sum += ps[axis][0] + ps[axis][len(ps[axis])-1]
+			}
+			baseline = sum / 4
+		} else {
+			baseline = 0
+		}
+	}
+	res.Baseline = baseline
+	var centers, widths, peaks [2]float64
+	for axis := range xs {
+		above := make([]float64, len(ps[axis]))
+		for i, p := range ps[axis] {
+			above[i] = p - baseline
+		}
+		var err error
+		centers[axis], widths[axis], peaks[axis], err = fitGaussian(xs[axis], above)
+		if err != nil {
+			return nil, fmt.Errorf("%s axis: %w", []string{"cross-elevation", "elevation"}[axis], err)
+		}
+		if math.Abs(centers[axis]) > 2*c.params.Offset {
+			return nil, fmt.Errorf("fitted offset %.3f is outside the pattern", centers[axis])
+		}
+	}
+	res.XelOffset, res.ElOffset = centers[0], centers[1]
+	res.BeamwidthXel, res.BeamwidthEl = widths[0], widths[1]
+	res.Peak = (peaks[0] + peaks[1]) / 2
+	return res, nil
+}
+
+// recordPower adds a power sample.
+func (s *Server) recordPower(t time.Time, power float64) {
+	s.powerMu.Lock()
+	defer s.powerMu.Unlock()
+	s.power = append(s.power, powerSample{t, power})
+	cutoff := time.Now().Add(-powerRetention)
+	i := 0
+	for i < len(s.power) && s.power[i].t.Before(cutoff) {
+		i++
+	}
+	s.power = s.power[i:]
+}
+
+// averagePower returns the mean of the power samples between start and end.
+func (s *Server) averagePower(start, end time.Time) (float64, error) {
+	s.powerMu.Lock()
+	defer s.powerMu.Unlock()
+	var sum float64
+	var n int
+	for _, p := range s.power {
+		if !p.t.Before(start) && !p.t.After(end) {
+			sum += p.power
+			n++
+		}
+	}
+	if n == 0 {
+		return 0, errors.New("no power samples received")
+	}
+	return sum / float64(n), nil
+}
+
+// parsePower parses "<power>" or "<unix time> <power>".
+func parsePower(line string) (time.Time, float64, error) {
+	fields := strings.Fields(line)
+	switch len(fields) {
+	case 1:
+		p, err := strconv.ParseFloat(fields[0], 64)
+		return time.Now(), p, err
+	case 2:
+		ts, err := strconv.ParseFloat(fields[0], 64)
+		if err != nil {
+			return time.Time{}, 0, err
+		}
+		p, err := strconv.ParseFloat(fields[1], 64)
+		sec, frac := math.Modf(ts)
+		return time.Unix(int64(sec), int64(frac*1e9)), p, err
+	}
+	return time.Time{}, 0, fmt.Errorf("invalid power sample %q", line)
+}
+
+func (s *Server) ingestPower(data string) error {
+	for _, line := range strings.Split(data, "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		t, p, err := parsePower(line)
+		if err != nil {
+			return err
+		}
+		if math.IsNaN(p) || math.IsInf(p, 0) {
+			return fmt.Errorf("invalid power %v", p)
+		}
+		s.recordPower(t, p)
+	}
+	return nil
+}
+
+// ListenPower receives power samples as UDP datagrams. Each line of a
+// datagram is either a power, or a Unix time and a power.
+func (s *Server) ListenPower(ctx context.Context, addr string) error {
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return err
+	}
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+	go func() {
+		buf := make([]byte, 65536)
+		for ctx.Err() == nil {
+			n, _, err := conn.ReadFrom(buf)
+			if err != nil {
+				log.Printf("reading power samples: %v", err)
+				continue
+			}
+			if err := s.ingestPower(string(buf[:n])); err != nil {
+				log.Printf("power sample: %v", err)
+			}
+		}
+	}()
+	return nil
+}
+
+// PowerHandler accepts power samples in the same format as ListenPower from local clients.
+func (s *Server) PowerHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !isLocal(r) {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	data, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, 1<<20))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := s.ingestPower(string(data)); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// startCalibration begins a pointing calibration. It must be called with s.mu locked.
+func (s *Server) startCalibration(params CalibrationParams) error {
+	body, err := s.lookupBody(params.Body)
+	if err != nil {
+		return err
+	}
+	c, err := newCalibration(params, body)
+	if err != nil {
+		return err
+	}
+	s.track(nil)
+	s.calib = c
+	s.statusMu.Lock()
+	s.status.Calibration = c.status()
+	s.statusCond.Broadcast()
+	s.statusMu.Unlock()
+	return nil
+}
+
+// stepCalibration commands the antenna to the current calibration point and
+// measures power there. It must be called with s.mu locked.
+func (s *Server) stepCalibration() {
+	c := s.calib
+	p := c.points[c.index]
+	topo := bodyTopo(c.body, novas.Now(), s.place, s.refraction)
+	if math.IsNaN(topo.Az) || math.IsNaN(topo.Alt) {
+		return
+	}
+	az, el := offsetXel(topo.Az, topo.Alt, p.xel, p.el)
+	if err := s.moveTo("calibration", az, el); err != nil {
+		s.finishCalibration(nil, err)
+		return
+	}
+	now := time.Now()
+	if c.arrived.IsZero() {
+		curAz, curEl, _, _ := s.currentPosition()
+		if math.Abs(math.Remainder(az-curAz, 360)) < scanTolerance && math.Abs(el-curEl) < scanTolerance {
+			c.arrived = now
+		}
+		return
+	}
+	start := c.arrived.Add(time.Duration(c.params.Settle * float64(time.Second)))
+	end := start.Add(time.Duration(c.params.Dwell * float64(time.Second)))
+	if now.Before(end) {
+		return
+	}
+	power, err := s.averagePower(start, end)
+	if err != nil {
+		s.finishCalibration(nil, err)
+		return
+	}
+	c.points[c.index].power = power
+	c.index++
+	c.arrived = time.Time{}
+	if c.index < len(c.points) {
+		s.statusMu.Lock()
+		s.status.Calibration = c.status()
+		s.statusCond.Broadcast()
+		s.statusMu.Unlock()
+		return
+	}
+	res, err := c.fit()
+	if err == nil {
+		res.Az, res.El = topo.Az, topo.Alt
+		if c := math.Cos(deg2rad(topo.Alt)); c > 1e-6 {
+			res.AzOffset = res.XelOffset / c
+		}
+	}
+	s.finishCalibration(res, err)
+}
+
+// finishCalibration ends the calibration, applying the result if requested.
+// It must be called with s.mu locked.
+func (s *Server) finishCalibration(res *CalibrationResult, err error) {
+	c := s.calib
+	s.calib = nil
+	if err != nil {
+		res = &CalibrationResult{Time: time.Now(), Body: c.body.Name(), Error: err.Error()}
+		log.Printf("calibration on %s failed: %v", c.body.Name(), err)
+	} else {
+		log.Printf("calibration on %s: xel %.4f el %.4f beamwidth %.3f x %.3f", res.Body, res.XelOffset, res.ElOffset, res.BeamwidthXel, res.BeamwidthEl)
+		if c.params.Apply {
+			if r, ok := s.r.(rotator.Offsetter); ok {
+				// The source was found at the commanded position plus the offset,
+				// so the reported position is too large by that amount.
+				res.NewAzOffset = s.azOffset - res.AzOffset
+				res.NewElOffset = s.elOffset - res.ElOffset
+				s.setOffsets(r, res.NewAzOffset, res.NewElOffset)
+				res.Applied = true
+			}
+		}
+	}
+	s.statusMu.Lock()
+	s.status.Calibration = nil
+	s.status.CalibrationResult = res
+	s.statusCond.Broadcast()
+	s.statusMu.Unlock()
+}
+
+// setOffsets sets the rotator's azimuth and elevation offsets. It must be called with s.mu locked.
+func (s *Server) setOffsets(r rotator.Offsetter, az, el float64) {
+	s.azOffset, s.elOffset = az, el
+	if s.wrap != nil {
+		// The cut moves with the reported azimuth.
+		s.wrap.SetCut(wrapCut(s.rotType, az))
+	}
+	r.SetAzimuthOffset(az)
+	r.SetElevationOffset(el)
+}
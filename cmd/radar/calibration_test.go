@@ -0,0 +1,129 @@
+package main
+
+import (
+	"math"
+	"strings"
+	"testing"
+
+	"github.com/pebbe/novas"
+)
+
+// gaussian returns the power of a beam of width fwhm centered on center.
+func gaussian(x, center, fwhm, peak float64) float64 {
+	sigma := fwhm / fwhmPerSigma
+	return peak * math.Exp(-(x-center)*(x-center)/(2*sigma*sigma))
+}
+
+func TestFitGaussian(t *testing.T) {
+	for _, test := range []struct {
+		name               string
+		center, fwhm, peak float64
+		xs                 []float64
+		wantErr            string
+	}{
+		{name: "centered", center: 0, fwhm: 2, peak: 1, xs: []float64{-2, -1, 0, 1, 2}},
+		{name: "offset", center: 0.3, fwhm: 1.5, peak: 40, xs: []float64{-1.5, -1, -0.5, 0, 0.5, 1, 1.5}},
+		{name: "three points", center: -0.2, fwhm: 0.8, peak: 3, xs: []float64{-0.5, 0, 0.5}},
+		{name: "peak outside the points", center: 1.2, fwhm: 2, peak: 1, xs: []float64{-1, 0, 1}},
+		{name: "two points", center: 0, fwhm: 2, peak: 1, xs: []float64{-1, 1}, wantErr: "fewer than three"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			ps := make([]float64, len(test.xs))
+			for i, x := range test.xs {
+				ps[i] = gaussian(x, test.center, test.fwhm, test.peak)
+			}
+			center, fwhm, peak, err := fitGaussian(test.xs, ps)
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Fatalf("got error %v, want %q", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if math.Abs(center-test.center) > 1e-6 || math.Abs(fwhm-test.fwhm) > 1e-6 || math.Abs(peak-test.peak) > 1e-6*test.peak {
+				t.Errorf("got center %v, fwhm %v, peak %v; want %v, %v, %v", center, fwhm, peak, test.center, test.fwhm, test.peak)
+			}
+		})
+	}
+
+	// A dip has no peak, and points at or below the baseline are ignored.
+	xs := []float64{-1, 0, 1, 2}
+	if _, _, _, err := fitGaussian(xs, []float64{2, 1, 2, 0}); err == nil || !strings.Contains(err.Error(), "no peak") {
+		t.Errorf("fitting a dip got %v, want no peak", err)
+	}
+	if _, _, _, err := fitGaussian(xs, []float64{1, 2, 0, -1}); err == nil || !strings.Contains(err.Error(), "fewer than three") {
+		t.Errorf("fitting two points above the baseline got %v", err)
+	}
+}
+
+type namedBody string
+
+func (b namedBody) Name() string { return string(b) }
+func (b namedBody) Topo(novas.Time, *novas.Place, novas.RefractType) novas.BodyTopoData {
+	return novas.BodyTopoData{}
+}
+
+func TestCalibrationFit(t *testing.T) {
+	for _, test := range []struct {
+		name          string
+		params        CalibrationParams
+		xel, el, fwhm float64
+		baseline      float64
+		wantErr       string
+	}{
+		{
+			name:   "five-point",
+			params: CalibrationParams{Pattern: "fivepoint", Offset: 0.5},
+			xel:    0.1, el: -0.15, fwhm: 1,
+		},
+		{
+			name:   "five-point with reference",
+			params: CalibrationParams{Pattern: "fivepoint", Offset: 0.5, Off: 10},
+			xel:    -0.05, el: 0.2, fwhm: 1, baseline: 7,
+		},
+		{
+			name:   "cross-scan",
+			params: CalibrationParams{Pattern: "crossscan", Offset: 2, Step: 0.25, Off: 10},
+			xel:    0.3, el: 0.1, fwhm: 1.2, baseline: 3,
+		},
+		{
+			name:   "source outside the pattern",
+			params: CalibrationParams{Pattern: "fivepoint", Offset: 0.25},
+			xel:    0.6, el: 0, fwhm: 1,
+			wantErr: "outside the pattern",
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			test.params.Dwell = 1
+			c, err := newCalibration(test.params, &bodyEntry{Body: namedBody("source")})
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i, p := range c.points {
+				c.points[i].power = test.baseline + gaussian(p.xel, test.xel, test.fwhm, 10)*gaussian(p.el, test.el, test.fwhm, 1)
+			}
+			res, err := c.fit()
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Fatalf("got error %v, want %q", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			const tolerance = 1e-4
+			if math.Abs(res.XelOffset-test.xel) > tolerance || math.Abs(res.ElOffset-test.el) > tolerance {
+				t.Errorf("offsets %v, %v; want %v, %v", res.XelOffset, res.ElOffset, test.xel, test.el)
+			}
+			if math.Abs(res.BeamwidthXel-test.fwhm) > tolerance || math.Abs(res.BeamwidthEl-test.fwhm) > tolerance {
+				t.Errorf("beamwidths %v, %v; want %v", res.BeamwidthXel, res.BeamwidthEl, test.fwhm)
+			}
+			if math.Abs(res.Baseline-test.baseline) > tolerance {
+				t.Errorf("baseline %v, want %v", res.Baseline, test.baseline)
+			}
+		})
+	}
+}
@@ -0,0 +1,355 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/pebbe/novas"
+)
+
+// These match SIZE_OF_OBJ_NAME and SIZE_OF_CAT_NAME in NOVAS, which panics on longer names.
+const (
+	maxStarName    = 50
+	maxCatalogName = 3
+)
+
+// validateStar returns an error if NOVAS can't make a body for star.
+func validateStar(star Star) error {
+	if star.StarName == "" {
+		return errors.New("star name is required")
+	}
+	if len(star.StarName) > maxStarName {
+		return fmt.Errorf("star name %q is longer than %d characters", star.StarName, maxStarName)
+	}
+	if len(star.Catalog) > maxCatalogName {
+		return fmt.Errorf("catalog designator %q is longer than %d characters", star.Catalog, maxCatalogName)
+	}
+	if star.RA < 0 || star.RA >= 24 || star.Dec < -90 || star.Dec > 90 {
+		return fmt.Errorf("coordinates %v, %v out of range", star.RA, star.Dec)
+	}
+	return nil
+}
+
+// newStar validates star and creates a NOVAS body for it.
+func newStar(star Star) (*novas.Body, error) {
+	if err := validateStar(star); err != nil {
+		return nil, err
+	}
+	novasMu.Lock()
+	defer novasMu.Unlock()
+	return novas.NewStar(
+		star.StarName,
+		star.Catalog,
+		star.StarNumber,
+		star.RA,
+		star.Dec,
+		star.ProMoRA,
+		star.ProMoDec,
+		star.Parallax,
+		star.RadialVelocity), nil
+}
+
+type CatalogEntry struct {
+	Star
+}
+
+// Designation returns the catalog designator and number, e.g. "3C 273".
+func (e *CatalogEntry) Designation() string {
+	return designation(e.Catalog, e.StarNumber)
+}
+
+// parseAngle parses decimal or sexagesimal ("12 29 06.7" or "12:29:06.7") angles.
+func parseAngle(s string) (float64, error) {
+	s = strings.TrimSpace(s)
+	fields := strings.FieldsFunc(s, func(r rune) bool { return r == ' ' || r == ':' })
+	if len(fields) == 0 || len(fields) > 3 {
+		return 0, fmt.Errorf("invalid angle %q", s)
+	}
+	neg := strings.HasPrefix(fields[0], "-")
+	var out float64
+	for i, f := range fields {
+		v, err := strconv.ParseFloat(strings.TrimLeft(f, "+-"), 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid angle %q: %w", s, err)
+		}
+		out += v / []float64{1, 60, 3600}[i]
+	}
+	if neg {
+		out = -out
+	}
+	return out, nil
+}
+
+// catalogColumns maps column names (lowercase) in catalog files to Star fields.
+var catalogColumns = map[string]string{
+	"name": "name", "starname": "name", "main_id": "name",
+	"catalog": "catalog", "cat": "catalog",
+	"number": "number", "starnumber": "number", "seq": "number", "hr": "number", "hip": "number", "hd": "number",
+	"ra": "ra", "raj2000": "ra", "_raj2000": "ra", "ra_icrs": "ra",
+	"dec": "dec", "dej2000": "dec", "_dej2000": "dec", "de_icrs": "dec",
+	"promora": "promora", "pmra": "promora",
+	"promodec": "promodec", "pmde": "promodec", "pmdec": "promodec",
+	"parallax": "parallax", "plx": "parallax",
+	"radialvelocity": "radialvelocity", "rv": "radialvelocity",
+}
+
+// parseCatalogRows converts rows of a catalog file into entries. Rows that
+// can't be parsed are logged and skipped, and it is only an error if no rows can be.
+// units optionally gives the unit of each column; RA in "deg" is converted to hours.
+func parseCatalogRows(header, units []string, rows [][]string, defaultCatalog string) ([]*CatalogEntry, error) {
+	cols := make(map[string]int)
+	raDegrees := false
+	for i, h := range header {
+		field, ok := catalogColumns[strings.ToLower(strings.TrimSpace(h))]
+		if !ok && defaultCatalog != "" && strings.EqualFold(strings.TrimSpace(h), defaultCatalog) {
+			// VizieR names the sequence number column after the catalog (e.g. "3C").
+			field, ok = "number", true
+		}
+		if !ok {
+			continue
+		}
+		if _, ok := cols[field]; ok {
+			// Use the first matching column.
+			continue
+		}
+		cols[field] = i
+		if field == "ra" && i < len(units) && strings.TrimSpace(units[i]) == "deg" {
+			raDegrees = true
+		}
+	}
+	if _, ok := cols["ra"]; !ok {
+		return nil, errors.New("no RA column")
+	}
+	if _, ok := cols["dec"]; !ok {
+		return nil, errors.New("no Dec column")
+	}
+	var out []*CatalogEntry
+	var firstErr error
+	for n, row := range rows {
+		e, err := parseCatalogRow(cols, raDegrees, row, defaultCatalog)
+		if err != nil {
+			err = fmt.Errorf("row %d: %w", n+1, err)
+			if firstErr == nil {
+				firstErr = err
+			}
+			log.Printf("skipping catalog %s", err)
+			continue
+		}
+		out = append(out, e)
+	}
+	if len(out) == 0 && firstErr != nil {
+		return nil, fmt.Errorf("no valid rows: %w", firstErr)
+	}
+	return out, nil
+}
+
+// parseCatalogRow converts one row of a catalog file, given the column of each field.
+func parseCatalogRow(cols map[string]int, raDegrees bool, row []string, defaultCatalog string) (*CatalogEntry, error) {
+	get := func(field string) string {
+		if i, ok := cols[field]; ok && i < len(row) {
+			return strings.TrimSpace(row[i])
+		}
+		return ""
+	}
+	float := func(field string) (float64, error) {
+		v := get(field)
+		if v == "" {
+			return 0, nil
+		}
+		return strconv.ParseFloat(v, 64)
+	}
+	var e CatalogEntry
+	var err error
+	if e.RA, err = parseAngle(get("ra")); err != nil {
+		return nil, err
+	}
+	if raDegrees {
+		e.RA /= 15
+	}
+	if e.Dec, err = parseAngle(get("dec")); err != nil {
+		return nil, err
+	}
+	for _, f := range []struct {
+		field string
+		dest  *float64
+	}{
+		{"promora", &e.ProMoRA},
+		{"promodec", &e.ProMoDec},
+		{"parallax", &e.Parallax},
+		{"radialvelocity", &e.RadialVelocity},
+	} {
+		if *f.dest, err = float(f.field); err != nil {
+			return nil, fmt.Errorf("%s: %w", f.field, err)
+		}
+	}
+	if v := get("number"); v != "" {
+		if e.StarNumber, err = strconv.ParseInt(v, 10, 64); err != nil {
+			return nil, fmt.Errorf("number: %w", err)
+		}
+	}
+	e.Catalog = get("catalog")
+	if e.Catalog == "" {
+		e.Catalog = defaultCatalog
+	}
+	e.StarName = get("name")
+	if e.StarName == "" {
+		e.StarName = e.Designation()
+	}
+	e.StarName = truncate(e.StarName, maxStarName)
+	if err := validateStar(e.Star); err != nil {
+		return nil, err
+	}
+	return &e, nil
+}
+
+// truncate shortens s to at most n bytes without splitting a UTF-8 sequence.
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
+
+// parseVizierTSV parses VizieR "tab-separated values" output: comment lines
+// starting with #, a header line, a units line, a line of dashes, and then data.
+func parseVizierTSV(r io.Reader, defaultCatalog string) ([]*CatalogEntry, error) {
+	var header, units []string
+	var rows [][]string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "#") || strings.TrimSpace(line) == "" {
+			continue
+		}
+		fields := strings.Split(line, "\t")
+		switch {
+		case header == nil:
+			header = fields
+		case units == nil:
+			units = fields
+		case strings.Trim(line, "-\t ") == "":
+			// Separator
+		default:
+			rows = append(rows, fields)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return parseCatalogRows(header, units, rows, defaultCatalog)
+}
+
+// parseCatalogCSV parses a CSV file with a header row. Comment lines start with #.
+func parseCatalogCSV(r io.Reader, defaultCatalog string) ([]*CatalogEntry, error) {
+	cr := csv.NewReader(r)
+	cr.Comment = '#'
+	cr.FieldsPerRecord = -1
+	records, err := cr.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(records) == 0 {
+		return nil, nil
+	}
+	return parseCatalogRows(records[0], nil, records[1:], defaultCatalog)
+}
+
+// loadCatalog reads a catalog file. Files ending in .tsv or .tab are parsed
+// as VizieR TSV, and all others as CSV. Entries without a catalog column
+// use the first three characters of the file name as their designator.
+func loadCatalog(path string) ([]*CatalogEntry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	base := filepath.Base(path)
+	ext := filepath.Ext(base)
+	defaultCatalog := strings.TrimSuffix(base, ext)
+	defaultCatalog = truncate(defaultCatalog, maxCatalogName)
+	var entries []*CatalogEntry
+	switch strings.ToLower(ext) {
+	case ".tsv", ".tab":
+		entries, err = parseVizierTSV(f, defaultCatalog)
+	default:
+		entries, err = parseCatalogCSV(f, defaultCatalog)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	log.Printf("loaded %d entries from %s", len(entries), path)
+	return entries, nil
+}
+
+// normalizeName lowercases s and removes spaces, so "3C 273" matches "3c273".
+func normalizeName(s string) string {
+	return strings.ToLower(strings.Join(strings.Fields(s), ""))
+}
+
+// searchCatalog returns entries whose name or designation contains q.
+// Exact matches are returned first.
+func (s *Server) searchCatalog(q string, limit int) []*CatalogEntry {
+	q = normalizeName(q)
+	if q == "" {
+		return nil
+	}
+	var exact, partial []*CatalogEntry
+	for _, e := range s.catalog {
+		name, des := normalizeName(e.StarName), normalizeName(e.Designation())
+		switch {
+		case name == q || des == q:
+			exact = append(exact, e)
+		case strings.Contains(name, q) || strings.Contains(des, q):
+			partial = append(partial, e)
+		}
+	}
+	out := append(exact, partial...)
+	if len(out) > limit {
+		out = out[:limit]
+	}
+	return out
+}
+
+// addCatalogEntry adds the catalog entry exactly matching name to the list of bodies.
+// It must be called with s.mu locked.
+func (s *Server) addCatalogEntry(name string) error {
+	matches := s.searchCatalog(name, 1)
+	if len(matches) == 0 || (normalizeName(matches[0].StarName) != normalizeName(name) && normalizeName(matches[0].Designation()) != normalizeName(name)) {
+		return fmt.Errorf("no catalog entry named %q", name)
+	}
+	star := matches[0].Star
+	return s.addUserBody(savedBody{Star: &star})
+}
+
+const maxCatalogResults = 50
+
+// CatalogSearchHandler looks up catalog entries by name or designation.
+// Entries are added to the list of bodies with the add_catalog websocket command.
+func (s *Server) CatalogSearchHandler(w http.ResponseWriter, r *http.Request) {
+	results := s.searchCatalog(r.FormValue("q"), maxCatalogResults)
+	stars := []Star{}
+	for _, e := range results {
+		stars = append(stars, e.Star)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	data, err := json.Marshal(stars)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	w.Write(data)
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseCatalogCSV(t *testing.T) {
+	for _, test := range []struct {
+		name, in string
+		want     []Star
+		wantErr  string
+	}{
+		{
+			name: "sexagesimal",
+			in:   "# bright sources\nname,ra,dec,number\nCas A,23 23 24,+58 48 54,461\n",
+			want: []Star{{StarName: "Cas A", Catalog: "3C", StarNumber: 461, RA: 23 + 23.0/60 + 24.0/3600, Dec: 58 + 48.0/60 + 54.0/3600}},
+		},
+		{
+			name: "catalog column and designation",
+			in:   "cat,hr,ra,dec\nHR,7001,18:36:56.3,38:47:01\n",
+			want: []Star{{StarName: "HR 7001", Catalog: "HR", StarNumber: 7001, RA: 18 + 36.0/60 + 56.3/3600, Dec: 38 + 47.0/60 + 1.0/3600}},
+		},
+		{
+			name: "bad rows skipped",
+			in:   "name,ra,dec\nA,1,2\nB,25,2\nC,x,2\nD,3,-4\n",
+			want: []Star{{StarName: "A", Catalog: "3C", RA: 1, Dec: 2}, {StarName: "D", Catalog: "3C", RA: 3, Dec: -4}},
+		},
+		{
+			name:    "no valid rows",
+			in:      "name,ra,dec\nB,25,2\n",
+			wantErr: "no valid rows",
+		},
+		{
+			name:    "no dec column",
+			in:      "name,ra\nA,1\n",
+			wantErr: "no Dec column",
+		},
+		{
+			name: "long name",
+			in:   "name,ra,dec\n" + strings.Repeat("é", 30) + ",1,2\n",
+			want: []Star{{StarName: strings.Repeat("é", 25), Catalog: "3C", RA: 1, Dec: 2}},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			entries, err := parseCatalogCSV(strings.NewReader(test.in), "3C")
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Fatalf("got error %v, want %q", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkEntries(t, entries, test.want)
+		})
+	}
+}
+
+func TestParseVizierTSV(t *testing.T) {
+	in := strings.Join([]string{
+		"#RESOURCE=yCat_8001",
+		"#Title: The 3C catalogue",
+		"_RAJ2000\t_DEJ2000\t3C\tName",
+		"deg\tdeg\t\t",
+		"-----------\t-----------\t---\t----",
+		"187.27792\t+02.05239\t273\t",
+		"bad\t+02.05239\t274\t",
+		"",
+		"350.85000\t+58.81500\t461\tCas A",
+	}, "\n")
+	entries, err := parseVizierTSV(strings.NewReader(in), "3C")
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkEntries(t, entries, []Star{
+		{StarName: "3C 273", Catalog: "3C", StarNumber: 273, RA: 187.27792 / 15, Dec: 2.05239},
+		{StarName: "Cas A", Catalog: "3C", StarNumber: 461, RA: 350.85 / 15, Dec: 58.815},
+	})
+}
+
+func checkEntries(t *testing.T, entries []*CatalogEntry, want []Star) {
+	t.Helper()
+	if len(entries) != len(want) {
+		t.Fatalf("got %d entries, want %d", len(entries), len(want))
+	}
+	for i, e := range entries {
+		got, w := e.Star, want[i]
+		if got.StarName != w.StarName || got.Catalog != w.Catalog || got.StarNumber != w.StarNumber {
+			t.Errorf("entry %d is %q (%s %d), want %q (%s %d)", i, got.StarName, got.Catalog, got.StarNumber, w.StarName, w.Catalog, w.StarNumber)
+		}
+		if d := got.RA - w.RA; d > 1e-9 || d < -1e-9 {
+			t.Errorf("entry %d RA = %v, want %v", i, got.RA, w.RA)
+		}
+		if d := got.Dec - w.Dec; d > 1e-9 || d < -1e-9 {
+			t.Errorf("entry %d Dec = %v, want %v", i, got.Dec, w.Dec)
+		}
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	for _, test := range []struct {
+		s    string
+		n    int
+		want string
+	}{
+		{"3C", 3, "3C"},
+		{"hipparcos", 3, "hip"},
+		{"aé", 2, "a"},
+		{"éé", 3, "é"},
+		{"é", 0, ""},
+	} {
+		if got := truncate(test.s, test.n); got != test.want {
+			t.Errorf("truncate(%q, %d) = %q, want %q", test.s, test.n, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// ControlLock is held by a client that has taken exclusive control of the
+// antenna. Other clients can't move it until the lock is released, times
+// out, or is stolen by an administrator.
+type ControlLock struct {
+	// Source is "websocket" or "rotctld".
+	Source     string
+	RemoteAddr string
+	Name       string
+	Since      time.Time
+	// Expires is when the lock is released unless the holder sends another command.
+	Expires time.Time
+}
+
+// uncontrolledCommands may be sent by any authorized client while another
+// client holds the control lock. Anyone who may move the antenna may stop it.
+var uncontrolledCommands = map[string]bool{
+	"stop":                 true,
+	"stop_hard":            true,
+	"emergency_stop":       true,
+	"reset_emergency_stop": true,
+	"renew_lease":          true,
+	"take_control":         true,
+	"release_control":      true,
+	"steal_control":        true,
+}
+
+// holdsControl returns whether a client holds the control lock.
+// It must be called with s.mu locked.
+func (s *Server) holdsControl(source, remoteAddr string) bool {
+	return s.control != nil && s.control.Source == source && s.control.RemoteAddr == remoteAddr
+}
+
+// checkControl returns an error if another client holds the control lock,
+// and otherwise renews the lock if the client holds it. Every API that
+// moves the antenna must call it. It must be called with s.mu locked.
+func (s *Server) checkControl(source, remoteAddr string) error {
+	s.expireControl()
+	if s.control == nil {
+		return nil
+	}
+	if !s.holdsControl(source, remoteAddr) {
+		return fmt.Errorf("%s client %q from %s has control", s.control.Source, s.control.Name, s.control.RemoteAddr)
+	}
+	c := *s.control
+	c.Expires = time.Now().Add(s.lockTimeout)
+	s.control = &c
+	s.updateControl()
+	return nil
+}
+
+// takeControl gives the control lock to a client. If steal is set, it is
+// taken even if another client holds it. It must be called with s.mu locked.
+func (s *Server) takeControl(source, remoteAddr, name string, steal bool) error {
+	s.expireControl()
+	if s.control != nil && !s.holdsControl(source, remoteAddr) {
+		if !steal {
+			return fmt.Errorf("%s client %q from %s has control", s.control.Source, s.control.Name, s.control.RemoteAddr)
+		}
+		log.Printf("%s client %q from %s stole control from %s client %q from %s", source, name, remoteAddr, s.control.Source, s.control.Name, s.control.RemoteAddr)
+	}
+	now := time.Now()
+	s.control = &ControlLock{
+		Source:     source,
+		RemoteAddr: remoteAddr,
+		Name:       name,
+		Since:      now,
+		Expires:    now.Add(s.lockTimeout),
+	}
+	s.updateControl()
+	return nil
+}
+
+// releaseControl releases the control lock if the client holds it.
+// It must be called with s.mu locked.
+func (s *Server) releaseControl(source, remoteAddr string) {
+	if !s.holdsControl(source, remoteAddr) {
+		return
+	}
+	log.Printf("%s client %q from %s released control", source, s.control.Name, remoteAddr)
+	s.control = nil
+	s.updateControl()
+}
+
+// expireControl releases the control lock if it has timed out.
+// It must be called with s.mu locked.
+func (s *Server) expireControl() {
+	if s.control == nil || time.Now().Before(s.control.Expires) {
+		return
+	}
+	log.Printf("control by %s client %q from %s timed out", s.control.Source, s.control.Name, s.control.RemoteAddr)
+	s.control = nil
+	s.updateControl()
+}
+
+// authorizeRequest checks whether an HTTP client may send a command, which
+// needs the same role as the websocket command of that name. It returns an
+// audit entry for the command, or writes an error response, records the
+// refusal, and returns nil. HTTP clients can't hold the control lock, so
+// they are refused while another client holds it.
+func (s *Server) authorizeRequest(w http.ResponseWriter, r *http.Request, command string) *AuditEntry {
+	user, role := s.requestAuth(r)
+	entry := &AuditEntry{
+		Surface:    "rest",
+		User:       user,
+		Role:       role,
+		RemoteAddr: r.RemoteAddr,
+		Command:    command,
+	}
+	refuse := func(code int, msg string) *AuditEntry {
+		entry.Outcome, entry.Error = "refused", msg
+		s.audit.Record(*entry)
+		http.Error(w, msg, code)
+		return nil
+	}
+	if need := requiredRole(commandRoles, command); role < need {
+		if role == RoleNone {
+			w.Header().Set("WWW-Authenticate", `Basic realm="radar"`)
+			return refuse(http.StatusUnauthorized, "unauthorized")
+		}
+		return refuse(http.StatusForbidden, fmt.Sprintf("role %v is needed", need))
+	}
+	if !uncontrolledCommands[command] {
+		s.mu.Lock()
+		err := s.checkControl("rest", r.RemoteAddr)
+		s.mu.Unlock()
+		if err != nil {
+			return refuse(http.StatusConflict, err.Error())
+		}
+	}
+	return entry
+}
+
+// updateControl must be called with s.mu locked.
+func (s *Server) updateControl() {
+	s.statusMu.Lock()
+	s.status.Control = s.control
+	s.statusCond.Broadcast()
+	s.statusMu.Unlock()
+}
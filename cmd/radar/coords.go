@@ -0,0 +1,106 @@
+package main
+
+import "math"
+
+func deg2rad(x float64) float64 {
+	return x * math.Pi / 180
+}
+
+func rad2deg(x float64) float64 {
+	return x * 180 / math.Pi
+}
+
+// hadecToAzel converts hour angle and declination to azimuth and elevation.
+// lat is the observer's latitude. All angles are in degrees, and azimuth is
+// measured east from north.
+func hadecToAzel(ha, dec, lat float64) (float64, float64) {
+	sinH, cosH := math.Sincos(deg2rad(ha))
+	sinD, cosD := math.Sincos(deg2rad(dec))
+	sinL, cosL := math.Sincos(deg2rad(lat))
+
+	el := math.Asin(sinD*sinL + cosD*cosL*cosH)
+	az := math.Atan2(-cosD*sinH, sinD*cosL-cosD*sinL*cosH)
+	return clampAngle(rad2deg(az)), rad2deg(el)
+}
+
+// azelToHadec converts azimuth and elevation to hour angle and declination.
+// lat is the observer's latitude. All angles are in degrees.
+func azelToHadec(az, el, lat float64) (float64, float64) {
+	// The transformation is its own inverse.
+	ha, dec := hadecToAzel(az, el, lat)
+	return math.Remainder(ha, 360), dec
+}
+
+// offsetXel applies a cross-elevation/elevation offset (degrees on the sky) to az/el.
+func offsetXel(az, el, xel, del float64) (float64, float64) {
+	if c := math.Cos(deg2rad(el)); c > 1e-6 {
+		az += xel / c
+	}
+	return clampAngle(az), el + del
+}
+
+// offsetRadec applies a right ascension/declination offset (degrees on the
+// sky) to az/el. lat is the observer's latitude.
+func offsetRadec(az, el, ra, dec, lat float64) (float64, float64) {
+	ha, d := azelToHadec(az, el, lat)
+	if c := math.Cos(deg2rad(d)); c > 1e-6 {
+		// Hour angle decreases as right ascension increases.
+		ha -= ra / c
+	}
+	return hadecToAzel(ha, d+dec, lat)
+}
+
+// precessToJ2000 precesses equatorial coordinates from the mean equator and
+// equinox of epoch (Julian years) to J2000, using the IAU 1976 precession
+// angles. ra is in hours and dec in degrees.
+func precessToJ2000(ra, dec, epoch float64) (float64, float64) {
+	// Angles from J2000 to epoch (arcseconds).
+	t := (epoch - 2000) / 100
+	zeta := deg2rad((2306.2181*t + 0.30188*t*t + 0.017998*t*t*t) / 3600)
+	z := deg2rad((2306.2181*t + 1.09468*t*t + 0.018203*t*t*t) / 3600)
+	theta := deg2rad((2004.3109*t - 0.42665*t*t - 0.041833*t*t*t) / 3600)
+
+	// Undo the rotations in reverse order.
+	sinA, cosA := math.Sincos(deg2rad(ra*15) - z)
+	sinD, cosD := math.Sincos(deg2rad(dec))
+	x, y, zc := cosD*cosA, cosD*sinA, sinD
+	sinT, cosT := math.Sincos(theta)
+	x, zc = cosT*x+sinT*zc, -sinT*x+cosT*zc
+	ra0 := rad2deg(math.Atan2(y, x)-zeta) / 15
+	dec0 := rad2deg(math.Asin(math.Max(-1, math.Min(1, zc))))
+	return math.Mod(math.Mod(ra0, 24)+24, 24), dec0
+}
+
+// galacticToICRS converts galactic longitude and latitude (degrees) to ICRS
+// right ascension (hours) and declination (degrees).
+func galacticToICRS(l, b float64) (float64, float64) {
+	// Rows of the ICRS to galactic rotation matrix from the Hipparcos catalogue.
+	m := [3][3]float64{
+		{-0.0548755604162154, -0.8734370902348850, -0.4838350155487132},
+		{+0.4941094278755837, -0.4448296299600112, +0.7469822444972189},
+		{-0.8676661490190047, -0.1980763734312015, +0.4559837761750669},
+	}
+	sinL, cosL := math.Sincos(deg2rad(l))
+	sinB, cosB := math.Sincos(deg2rad(b))
+	g := [3]float64{cosB * cosL, cosB * sinL, sinB}
+	var v [3]float64
+	for i := range v {
+		for j := range g {
+			v[i] += m[j][i] * g[j]
+		}
+	}
+	ra := clampAngle(rad2deg(math.Atan2(v[1], v[0]))) / 15
+	dec := rad2deg(math.Asin(math.Max(-1, math.Min(1, v[2]))))
+	return ra, dec
+}
+
+// angularSeparation returns the angle (degrees) between two az/el positions.
+func angularSeparation(az1, el1, az2, el2 float64) float64 {
+	sinE1, cosE1 := math.Sincos(deg2rad(el1))
+	sinE2, cosE2 := math.Sincos(deg2rad(el2))
+	dAz := deg2rad(az2 - az1)
+	// Vincenty's formula is well-conditioned at all separations.
+	x := sinE1*sinE2 + cosE1*cosE2*math.Cos(dAz)
+	y := math.Hypot(cosE2*math.Sin(dAz), cosE1*sinE2-sinE1*cosE2*math.Cos(dAz))
+	return rad2deg(math.Atan2(y, x))
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/pebbe/novas"
+)
+
+// maxDriftLead limits how far ahead of a body a drift scan can point.
+const maxDriftLead = 6 * time.Hour
+
+// siderealRate is the rate of sidereal time in sidereal hours per solar hour.
+const siderealRate = 1.00273790935
+
+// DriftParams describes a drift scan requested by a client.
+type DriftParams struct {
+	// Body is the ID or index of the body to drift across.
+	Body BodyRef `json:"body"`
+	// Lead is how far ahead of the body to point (seconds).
+	Lead float64 `json:"lead"`
+}
+
+// DriftPoint is the position of the beam at the start or end of a drift.
+type DriftPoint struct {
+	Time   time.Time
+	Az, El float64
+	// RA (hours) and Dec (degrees) are the apparent place of date of the
+	// beam. RA is omitted if the body has no fixed place on the sky.
+	RA  *float64 `json:",omitempty"`
+	Dec float64
+}
+
+// DriftSession records a drift scan.
+type DriftSession struct {
+	ID     string
+	Name   string
+	BodyID string
+	// Lead is how far ahead of the body the antenna pointed (seconds).
+	Lead float64
+	// Commanded is when the drift scan was requested.
+	Commanded time.Time
+	// Az and El are the commanded position.
+	Az, El float64
+	// Transit is when the body is predicted to cross Az/El, and TransitRA
+	// is its right ascension (hours) then, if known.
+	Transit   time.Time
+	TransitRA *float64 `json:",omitempty"`
+	// Start is set when the antenna reaches Az/El, and End when the drift ends.
+	Start *DriftPoint `json:",omitempty"`
+	End   *DriftPoint `json:",omitempty"`
+	// State is "slewing", "drifting", "done", "missed" (the antenna did not
+	// arrive before the body passed), or "interrupted".
+	State string
+	// Late is true if the antenna arrived after the transit.
+	Late bool
+}
+
+// active returns whether the drift scan has not ended yet.
+func (d *DriftSession) active() bool {
+	return d.State == "slewing" || d.State == "drifting"
+}
+
+// drifting returns whether a drift scan is in progress.
+// It must be called with s.mu locked.
+func (s *Server) drifting() bool {
+	return s.drift != nil && s.drift.active()
+}
+
+// startDrift points the antenna ahead of a body so that it drifts through
+// the beam. It must be called with s.mu locked.
+func (s *Server) startDrift(params DriftParams) error {
+	lead := time.Duration(params.Lead * float64(time.Second))
+	if lead <= 0 || lead > maxDriftLead {
+		return fmt.Errorf("lead time %v out of range", params.Lead)
+	}
+	body, err := s.lookupBody(params.Body)
+	if err != nil {
+		return err
+	}
+	if body == nil {
+		return errors.New("drift scan needs a body")
+	}
+	now := time.Now()
+	tm := novas.Now()
+	tm.Time = now.Add(lead)
+	topo := bodyTopo(body, tm, s.place, s.refraction)
+	if math.IsNaN(topo.Az) || math.IsNaN(topo.Alt) {
+		return fmt.Errorf("position of %s is unknown", body.Name())
+	}
+	if topo.Alt < s.minElevation {
+		return fmt.Errorf("%s will be below the horizon (%.2f) in %v", body.Name(), topo.Alt, lead)
+	}
+	prev, offsets := s.tracking, s.trackOffsets
+	s.track(nil)
+	if err := s.moveTo("drift", topo.Az, topo.Alt); err != nil {
+		if prev != nil {
+			// Carry on tracking rather than leave the antenna idle.
+			s.track(prev)
+			s.setTrackOffsets(offsets)
+		}
+		return err
+	}
+	// IDs are in seconds so they stay unique across restarts, but two
+	// scans can be started in the same second.
+	id := now.Unix()
+	if id <= s.lastDriftID {
+		id = s.lastDriftID + 1
+	}
+	s.lastDriftID = id
+	d := &DriftSession{
+		ID:        strconv.FormatInt(id, 10),
+		Name:      body.Name(),
+		BodyID:    body.id,
+		Lead:      params.Lead,
+		Commanded: now,
+		Az:        topo.Az,
+		El:        topo.Alt,
+		Transit:   tm.Time,
+		State:     "slewing",
+	}
+	if nb, ok := body.Body.(*novas.Body); ok {
+		ra := bodyApp(nb, tm).RA
+		d.TransitRA = &ra
+	}
+	log.Printf("drift scan of %s: pointing at %.2f, %.2f for transit at %s", d.Name, d.Az, d.El, d.Transit.Format(time.RFC3339))
+	s.drift = d
+	s.updateDrift()
+	return nil
+}
+
+// driftPoint returns the position of the beam during a drift scan.
+// It must be called with s.mu locked.
+func (s *Server) driftPoint(t time.Time) *DriftPoint {
+	d := s.drift
+	az, el, _, _ := s.currentPosition()
+	ha, dec := azelToHadec(az, el, s.latitude)
+	p := &DriftPoint{Time: t, Az: az, El: el, Dec: dec}
+	if d.TransitRA != nil {
+		// The commanded position was at TransitRA at the transit; sidereal
+		// time has advanced since, and the antenna may be slightly off.
+		commandHA, _ := azelToHadec(d.Az, d.El, s.latitude)
+		ra := *d.TransitRA + (t.Sub(d.Transit).Hours()*siderealRate*15-math.Remainder(ha-commandHA, 360))/15
+		ra = math.Mod(math.Mod(ra, 24)+24, 24)
+		p.RA = &ra
+	}
+	return p
+}
+
+// stepDrift follows the progress of the drift scan.
+// It must be called with s.mu locked.
+func (s *Server) stepDrift() {
+	if !s.drifting() {
+		return
+	}
+	d := s.drift
+	now := time.Now()
+	end := d.Transit.Add(d.Transit.Sub(d.Commanded))
+	switch d.State {
+	case "slewing":
+		az, el, _, _ := s.currentPosition()
+		if math.Abs(math.Remainder(az-d.Az, 360)) < scanTolerance && math.Abs(el-d.El) < scanTolerance {
+			d.Start = s.driftPoint(now)
+			d.State = "drifting"
+			if now.After(d.Transit) {
+				log.Printf("drift scan of %s: arrived %v after transit", d.Name, now.Sub(d.Transit))
+				d.Late = true
+			}
+			s.updateDrift()
+		} else if now.After(end) {
+			s.endDrift("missed")
+		}
+	case "drifting":
+		if !now.Before(end) {
+			s.endDrift("done")
+		}
+	}
+}
+
+// endDrift ends the active drift scan and records it in the session log.
+// It must be called with s.mu locked.
+func (s *Server) endDrift(state string) {
+	if !s.drifting() {
+		return
+	}
+	d := s.drift
+	d.State = state
+	d.End = s.driftPoint(time.Now())
+	log.Printf("drift scan of %s %s", d.Name, state)
+	s.updateDrift()
+	if err := s.logDrift(d); err != nil {
+		log.Printf("recording drift scan: %v", err)
+	}
+}
+
+// logDrift appends a session to the drift log.
+func (s *Server) logDrift(d *DriftSession) error {
+	if s.driftLog == "" {
+		return nil
+	}
+	data, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(s.driftLog, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// updateDrift must be called with s.mu locked.
+func (s *Server) updateDrift() {
+	var status *DriftSession
+	if s.drift != nil {
+		d := *s.drift
+		status = &d
+	}
+	s.statusMu.Lock()
+	s.status.Drift = status
+	s.statusCond.Broadcast()
+	s.statusMu.Unlock()
+}
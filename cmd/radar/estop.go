@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// EmergencyStop describes a latched emergency stop.
+type EmergencyStop struct {
+	Time time.Time
+	// Source is "websocket", "rest", or "signal".
+	Source     string
+	User       string `json:",omitempty"`
+	RemoteAddr string `json:",omitempty"`
+	Reason     string
+}
+
+var errEmergencyStop = errors.New("emergency stop is latched")
+
+// estopRefused are the websocket commands that are refused while an
+// emergency stop is latched. Any move is also refused by moveTo and setVelocity.
+var estopRefused = map[string]bool{
+	"track":                  true,
+	"track_radec":            true,
+	"track_galactic":         true,
+	"set_track_offsets":      true,
+	"scan":                   true,
+	"calibrate":              true,
+	"drift_scan":             true,
+	"write":                  true,
+	"set_azimuth_position":   true,
+	"set_elevation_position": true,
+	"set_azimuth_velocity":   true,
+	"set_elevation_velocity": true,
+	"park":                   true,
+	"exit_shutdown":          true,
+	"set_band_tx":            true,
+}
+
+// checkEmergencyStop returns an error if an emergency stop is latched.
+// It must be called with s.mu locked.
+func (s *Server) checkEmergencyStop() error {
+	if s.estop != nil {
+		return errEmergencyStop
+	}
+	return nil
+}
+
+// emergencyStop stops both axes, stops transmitting on every band, spins
+// down the amplidynes, and latches until resetEmergencyStop is called.
+// If a stop is already latched, everything is stopped again but the
+// original reason is kept. It must be called with s.mu locked.
+func (s *Server) emergencyStop(e EmergencyStop) {
+	if s.estop == nil {
+		e.Time = time.Now()
+		s.estop = &e
+		log.Printf("EMERGENCY STOP by %s %q from %s: %s", e.Source, e.User, e.RemoteAddr, e.Reason)
+	}
+	s.r.Stop()
+	s.setAmplidynesEnabled(false)
+	s.estopBands = 0
+	s.dropEmergencyTX()
+	if s.seq != nil && s.estopBands == 0 {
+		log.Printf("emergency stop: the sequencer hasn't reported its bands; TX will be stopped when it does")
+	}
+	s.track(nil)
+	s.updateEmergencyStop()
+}
+
+// dropEmergencyTX stops transmitting on the bands that the sequencer has
+// reported since the emergency stop was latched. It must be called with
+// s.mu locked.
+func (s *Server) dropEmergencyTX() {
+	if s.estop == nil || s.seq == nil {
+		return
+	}
+	n := s.seq.Bands()
+	for b := s.estopBands; b < n; b++ {
+		if err := s.seq.SetBandTX(b, false); err != nil {
+			log.Printf("emergency stop: band %d: %v", b, err)
+		}
+	}
+	if n > s.estopBands {
+		s.estopBands = n
+	}
+}
+
+// resetEmergencyStop releases a latched emergency stop. Nothing moves until
+// it is commanded again. It must be called with s.mu locked.
+func (s *Server) resetEmergencyStop(source, user, remoteAddr string) error {
+	if s.estop == nil {
+		return errors.New("no emergency stop is latched")
+	}
+	log.Printf("emergency stop reset by %s %q from %s", source, user, remoteAddr)
+	s.estop = nil
+	s.updateEmergencyStop()
+	return nil
+}
+
+// updateEmergencyStop must be called with s.mu locked.
+func (s *Server) updateEmergencyStop() {
+	s.statusMu.Lock()
+	s.status.EmergencyStop = s.estop
+	s.statusCond.Broadcast()
+	s.statusMu.Unlock()
+}
+
+// ListenEmergencySignal latches an emergency stop when the process receives
+// SIGUSR1, so that a local switch or script can stop the antenna.
+func (s *Server) ListenEmergencySignal(ctx context.Context) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGUSR1)
+	go func() {
+		defer signal.Stop(c)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case sig := <-c:
+				s.mu.Lock()
+				s.emergencyStop(EmergencyStop{Source: "signal", Reason: sig.String()})
+				s.mu.Unlock()
+				s.audit.Record(AuditEntry{
+					Surface: "signal",
+					Command: "emergency_stop",
+					Args:    auditArgs(map[string]string{"signal": sig.String()}),
+					Outcome: "ok",
+				})
+			}
+		}
+	}()
+}
+
+// EmergencyStopHandler returns the latched emergency stop (GET), latches an
+// emergency stop (POST), or resets it (DELETE). A POST may have a JSON body
+// with a reason.
+func (s *Server) EmergencyStopHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		s.mu.Lock()
+		var out *EmergencyStop
+		if s.estop != nil {
+			e := *s.estop
+			out = &e
+		}
+		s.mu.Unlock()
+		writeJSON(w, http.StatusOK, out)
+	case http.MethodPost:
+		entry := s.authorizeRequest(w, r, "emergency_stop")
+		if entry == nil {
+			return
+		}
+		var req struct {
+			Reason string `json:"reason"`
+		}
+		if r.ContentLength != 0 {
+			// Stop even if the body is malformed.
+			json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&req)
+		}
+		s.mu.Lock()
+		s.emergencyStop(EmergencyStop{Source: "rest", User: entry.User, RemoteAddr: r.RemoteAddr, Reason: req.Reason})
+		out := *s.estop
+		s.mu.Unlock()
+		s.auditRequest(entry, req, nil)
+		writeJSON(w, http.StatusOK, out)
+	case http.MethodDelete:
+		entry := s.authorizeRequest(w, r, "reset_emergency_stop")
+		if entry == nil {
+			return
+		}
+		s.mu.Lock()
+		err := s.resetEmergencyStop("rest", entry.User, r.RemoteAddr)
+		s.mu.Unlock()
+		s.auditRequest(entry, nil, err)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
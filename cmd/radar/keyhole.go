@@ -0,0 +1,297 @@
+package main
+
+import (
+	"log"
+	"math"
+	"time"
+)
+
+const (
+	// keyholeStep is the spacing of positions used to plan a track near the zenith.
+	keyholeStep = 2 * time.Second
+	// keyholeSpan is how far ahead a track is planned for the zenith keyhole.
+	keyholeSpan = time.Hour
+	// keyholeTolerance is the pointing error (degrees on the sky) beyond which track is considered lost.
+	keyholeTolerance = 0.5
+)
+
+// TrackPlan describes how the current track handles the rate limits of each axis.
+type TrackPlan struct {
+	Name string
+	// Strategy is one of:
+	//   "normal": the track is within the rate limits.
+	//   "flip": azimuth starts turning ahead of the zenith so that the turn is within the rate limit.
+	//   "plunge": part of the track is followed past an elevation of 90 degrees.
+	//   "gap": the antenna is expected to fall behind and catch up.
+	Strategy string
+	// Culmination and PeakElevation are the time and elevation of the highest point of the track.
+	Culmination   time.Time
+	PeakElevation float64
+	// MaxAzRate and MaxElRate are the highest rates of the track (degrees/second), before any flip or plunge.
+	MaxAzRate, MaxElRate float64
+	// End is the end of the plan, when the body sets or planning stopped.
+	End time.Time
+	// MaxError is the largest expected pointing error (degrees on the sky).
+	MaxError float64
+	// LossStart and LossEnd bound the time during which the pointing error is expected to exceed the tolerance.
+	LossStart *time.Time `json:",omitempty"`
+	LossEnd   *time.Time `json:",omitempty"`
+}
+
+type trackPlan struct {
+	body   Body
+	status TrackPlan
+	start  time.Time
+	// Positions are reflected through the zenith between plungeStart and plungeEnd.
+	plungeStart, plungeEnd time.Time
+	// azDelta is added to the azimuth of the body for a flip, sampled every keyholeStep from start.
+	azDelta []float64
+}
+
+// passSample is a track of a body, sampled at regular intervals.
+type passSample struct {
+	times []time.Time
+	// az is unwrapped so that it is continuous.
+	az, el []float64
+}
+
+// samplePass samples the position of body from now until it sets, or for span.
+// It must be called with s.mu locked.
+func (s *Server) samplePass(body Body, span, step time.Duration) passSample {
+	calc := visibilityCalc{
+		body:         body,
+		place:        s.place,
+		refr:         s.refraction,
+		minElevation: s.minElevation,
+		maxElevation: s.maxElevation,
+	}
+	if s.avoid != nil {
+		calc.mask = s.avoid.mask
+	}
+	var p passSample
+	now := time.Now()
+	risen := false
+	for t := now; t.Before(now.Add(span)); t = t.Add(step) {
+		az, el := calc.position(t)
+		if math.IsNaN(az) || math.IsNaN(el) {
+			break
+		}
+		visible := calc.visibleAt(az, el)
+		if risen && !visible {
+			break
+		}
+		risen = risen || visible
+		if n := len(p.az); n > 0 {
+			az = p.az[n-1] + math.Remainder(az-p.az[n-1], 360)
+		}
+		p.times = append(p.times, t)
+		p.az = append(p.az, az)
+		p.el = append(p.el, el)
+	}
+	return p
+}
+
+// maxRate returns the largest rate of change of xs, sampled every step.
+func maxRate(xs []float64, step time.Duration) float64 {
+	var max float64
+	for i := 1; i < len(xs); i++ {
+		max = math.Max(max, math.Abs(xs[i]-xs[i-1])/step.Seconds())
+	}
+	return max
+}
+
+// chase returns the path of an axis that follows target from its first
+// point, moving at most rate*step between samples.
+func chase(target []float64, rate float64, step time.Duration) []float64 {
+	out := make([]float64, len(target))
+	limit := rate * step.Seconds()
+	for i, x := range target {
+		if i == 0 {
+			out[i] = x
+			continue
+		}
+		out[i] = out[i-1] + math.Max(-limit, math.Min(limit, x-out[i-1]))
+	}
+	return out
+}
+
+// reverse returns xs in reverse order.
+func reverse(xs []float64) []float64 {
+	out := make([]float64, len(xs))
+	for i, x := range xs {
+		out[len(xs)-1-i] = x
+	}
+	return out
+}
+
+// pointingLoss returns the largest error between the commanded azimuths
+// and the pass, and the span of time in which it exceeds keyholeTolerance.
+func pointingLoss(p passSample, az []float64) (maxErr float64, start, end *time.Time) {
+	for i := range az {
+		d := angularSeparation(az[i], p.el[i], p.az[i], p.el[i])
+		maxErr = math.Max(maxErr, d)
+		if d > keyholeTolerance {
+			if start == nil {
+				start = &p.times[i]
+			}
+			end = &p.times[i]
+		}
+	}
+	return maxErr, start, end
+}
+
+// newTrackPlan checks the track of body against the rate limits and
+// chooses how to follow it. It must be called with s.mu locked.
+func (s *Server) newTrackPlan(body Body) *trackPlan {
+	return s.planPass(body, s.samplePass(body, keyholeSpan, keyholeStep))
+}
+
+// planPass chooses how to follow p, the pass of body sampled every keyholeStep.
+func (s *Server) planPass(body Body, p passSample) *trackPlan {
+	if len(p.az) < 2 {
+		return nil
+	}
+	plan := &trackPlan{
+		body:  body,
+		start: p.times[0],
+		status: TrackPlan{
+			Name:      body.Name(),
+			Strategy:  "normal",
+			MaxAzRate: maxRate(p.az, keyholeStep),
+			MaxElRate: maxRate(p.el, keyholeStep),
+			End:       p.times[len(p.times)-1],
+		},
+	}
+	c := 0
+	for i, el := range p.el {
+		if el > p.el[c] {
+			c = i
+		}
+	}
+	plan.status.Culmination, plan.status.PeakElevation = p.times[c], p.el[c]
+	if plan.status.MaxAzRate <= s.maxAzRate && plan.status.MaxElRate <= s.maxElRate {
+		return plan
+	}
+	if plan.status.MaxElRate <= s.maxElRate {
+		if s.maxElevation > 90 && s.planPlunge(plan, p, c) {
+			return plan
+		}
+		// Turn azimuth through the keyhole at the maximum rate, centered on
+		// the zenith, by averaging paths that chase the body forward and backward in time.
+		forward := chase(p.az, s.maxAzRate, keyholeStep)
+		backward := reverse(chase(reverse(p.az), s.maxAzRate, keyholeStep))
+		az := make([]float64, len(p.az))
+		plan.azDelta = make([]float64, len(p.az))
+		for i := range az {
+			az[i] = (forward[i] + backward[i]) / 2
+			plan.azDelta[i] = az[i] - p.az[i]
+		}
+		if math.Abs(plan.azDelta[0])*math.Cos(deg2rad(p.el[0])) <= keyholeTolerance {
+			plan.status.Strategy = "flip"
+			plan.status.MaxError, plan.status.LossStart, plan.status.LossEnd = pointingLoss(p, az)
+			return plan
+		}
+		// The flip should already have started.
+		plan.azDelta = nil
+	}
+	plan.status.Strategy = "gap"
+	plan.status.MaxError, plan.status.LossStart, plan.status.LossEnd = pointingLoss(p, chase(p.az, s.maxAzRate, keyholeStep))
+	return plan
+}
+
+// planPlunge tries to follow the track past the zenith, reflecting the
+// part before or after culmination (index c) through the zenith.
+func (s *Server) planPlunge(plan *trackPlan, p passSample, c int) bool {
+	type variant struct{ from, to int }
+	best, bestEl := variant{}, math.Inf(1)
+	for _, v := range []variant{{0, c}, {c, len(p.az) - 1}} {
+		az := make([]float64, len(p.az))
+		el := make([]float64, len(p.el))
+		var peak float64
+		for i := range az {
+			az[i], el[i] = p.az[i], p.el[i]
+			if i >= v.from && i <= v.to {
+				az[i], el[i] = p.az[i]+180, 180-p.el[i]
+			}
+			if i > 0 {
+				az[i] = az[i-1] + math.Remainder(az[i]-az[i-1], 360)
+			}
+			peak = math.Max(peak, el[i])
+		}
+		if peak <= s.maxElevation && maxRate(az, keyholeStep) <= s.maxAzRate && maxRate(el, keyholeStep) <= s.maxElRate && peak < bestEl {
+			best, bestEl = v, peak
+		}
+	}
+	if math.IsInf(bestEl, 1) {
+		return false
+	}
+	plan.status.Strategy = "plunge"
+	plan.plungeStart, plan.plungeEnd = p.times[best.from], p.times[best.to]
+	return true
+}
+
+// adjust returns the position to command at t to follow the plan, given the position of the body.
+func (p *trackPlan) adjust(t time.Time, az, el float64) (float64, float64) {
+	switch p.status.Strategy {
+	case "plunge":
+		if !t.Before(p.plungeStart) && !t.After(p.plungeEnd) {
+			return clampAngle(az + 180), 180 - el
+		}
+	case "flip":
+		offset := t.Sub(p.start)
+		i := int(offset / keyholeStep)
+		if offset < 0 || i+1 >= len(p.azDelta) {
+			return az, el
+		}
+		frac := float64(offset-time.Duration(i)*keyholeStep) / float64(keyholeStep)
+		return clampAngle(az + p.azDelta[i] + frac*(p.azDelta[i+1]-p.azDelta[i])), el
+	}
+	return az, el
+}
+
+// planTrack makes sure the track of body is planned for the rate limits.
+// It must be called with s.mu locked.
+func (s *Server) planTrack(body Body) {
+	if s.trackPlan != nil && s.trackPlan.body == body && time.Now().Before(s.trackPlan.status.End) {
+		return
+	}
+	s.trackPlan = s.newTrackPlan(body)
+	s.traj = nil
+	if s.wrapPlan != nil && s.wrapPlan.body == body {
+		// Plan the cable wrap again with the new track.
+		s.wrapPlan = nil
+	}
+	var status *TrackPlan
+	if s.trackPlan != nil {
+		st := s.trackPlan.status
+		status = &st
+		if st.Strategy != "normal" {
+			log.Printf("tracking %s through the zenith keyhole by %s (maximum error %.2f degrees)", st.Name, st.Strategy, st.MaxError)
+		}
+	}
+	s.statusMu.Lock()
+	s.status.TrackPlan = status
+	s.statusCond.Broadcast()
+	s.statusMu.Unlock()
+}
+
+// clearTrackPlan must be called with s.mu locked.
+func (s *Server) clearTrackPlan() {
+	if s.trackPlan == nil {
+		return
+	}
+	s.trackPlan = nil
+	s.statusMu.Lock()
+	s.status.TrackPlan = nil
+	s.statusCond.Broadcast()
+	s.statusMu.Unlock()
+}
+
+// adjustTrack applies the track plan to the position of the tracked body at t.
+// It must be called with s.mu locked.
+func (s *Server) adjustTrack(body Body, t time.Time, az, el float64) (float64, float64) {
+	if s.trackPlan == nil || s.trackPlan.body != body {
+		return az, el
+	}
+	return s.trackPlan.adjust(t, az, el)
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestChase(t *testing.T) {
+	for _, test := range []struct {
+		name         string
+		target, want []float64
+	}{
+		{"within the rate", []float64{0, 1, 3, 2}, []float64{0, 1, 3, 2}},
+		{"falls behind", []float64{0, 10, 10, 10, 10, 10}, []float64{0, 2, 4, 6, 8, 10}},
+		{"turns back", []float64{0, 5, 5, -5}, []float64{0, 2, 4, 2}},
+	} {
+		got := chase(test.target, 1, 2*time.Second)
+		for i := range got {
+			if math.Abs(got[i]-test.want[i]) > 1e-9 {
+				t.Errorf("%s: chase(%v) = %v, want %v", test.name, test.target, got, test.want)
+				break
+			}
+		}
+	}
+}
+
+// zenithPass returns a pass along a great circle that culminates at
+// elevation 90-d, due north, at the time mid. It moves at rate
+// degrees/second and is sampled every keyholeStep between start and end.
+func zenithPass(mid, start, end time.Time, d, rate float64) passSample {
+	sinD, cosD := math.Sincos(deg2rad(d))
+	var p passSample
+	for t := start; !t.After(end); t = t.Add(keyholeStep) {
+		sin, cos := math.Sincos(deg2rad(rate * t.Sub(mid).Seconds()))
+		// East, north, and up components of the position.
+		e, n, u := sin, cos*sinD, cos*cosD
+		az, el := rad2deg(math.Atan2(e, n)), rad2deg(math.Asin(u))
+		if i := len(p.az); i > 0 {
+			az = p.az[i-1] + math.Remainder(az-p.az[i-1], 360)
+		}
+		p.times = append(p.times, t)
+		p.az = append(p.az, az)
+		p.el = append(p.el, el)
+	}
+	return p
+}
+
+func TestPlanPass(t *testing.T) {
+	mid := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	// rate is the speed of the body along its path (degrees/second).
+	const rate = 0.25
+	for _, test := range []struct {
+		name string
+		// start and end are the sampled part of the pass, relative to culmination.
+		start, end time.Duration
+		// d is the distance of the culmination from the zenith.
+		d            float64
+		maxElevation float64
+		strategy     string
+		// loss is whether track is expected to be lost around culmination.
+		loss bool
+	}{
+		{name: "low pass", start: -2 * time.Minute, end: 2 * time.Minute, d: 30, maxElevation: 90, strategy: "normal"},
+		{name: "flip", start: -2 * time.Minute, end: 2 * time.Minute, d: 0.5, maxElevation: 90, strategy: "flip", loss: true},
+		// An antenna that can tip over the zenith follows a pass that
+		// crosses it between two samples with a plunge.
+		{name: "plunge", start: -2*time.Minute - time.Second, end: 2 * time.Minute, d: 0.01, maxElevation: 180, strategy: "plunge"},
+		{name: "too late to flip", start: -4 * time.Second, end: 2 * time.Minute, d: 0.5, maxElevation: 90, strategy: "gap", loss: true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			s := newTestServer()
+			s.maxAzRate, s.maxElRate, s.maxElevation = 3, 2, test.maxElevation
+			p := zenithPass(mid, mid.Add(test.start), mid.Add(test.end), test.d, rate)
+			plan := s.planPass(namedBody("pass"), p)
+			if plan == nil {
+				t.Fatal("no plan")
+			}
+			st := plan.status
+			if st.Strategy != test.strategy {
+				t.Fatalf("strategy %q, want %q", st.Strategy, test.strategy)
+			}
+			// The highest sample is within half a step of the culmination.
+			if d := st.Culmination.Sub(mid); d < -keyholeStep/2 || d > keyholeStep/2 || math.Abs(st.PeakElevation-(90-test.d)) > rate*keyholeStep.Seconds()/2 {
+				t.Errorf("culmination %.2f at %v, want %.2f at %v", st.PeakElevation, st.Culmination, 90-test.d, mid)
+			}
+			if (st.LossStart != nil) != test.loss {
+				t.Fatalf("loss of track from %v to %v, want loss %v (maximum error %.2f)", st.LossStart, st.LossEnd, test.loss, st.MaxError)
+			}
+			if test.loss {
+				if st.MaxError <= keyholeTolerance || st.LossStart.After(mid.Add(keyholeStep)) || !st.LossEnd.After(mid) {
+					t.Errorf("lost track from %v to %v (maximum error %.2f), want it lost through culmination at %v", st.LossStart, st.LossEnd, st.MaxError, mid)
+				}
+			} else if st.MaxError > keyholeTolerance {
+				t.Errorf("maximum error %.2f without loss of track", st.MaxError)
+			}
+
+			switch st.Strategy {
+			case "flip":
+				// The commanded azimuth follows the body at the start, and turns
+				// through the keyhole within the rate limit.
+				az := make([]float64, len(p.az))
+				for i := range az {
+					az[i] = p.az[i] + plan.azDelta[i]
+				}
+				if plan.azDelta[0] != 0 || plan.azDelta[len(az)-1] != 0 {
+					t.Errorf("flip starts at %v and ends at %v from the body, want 0", plan.azDelta[0], plan.azDelta[len(az)-1])
+				}
+				if r := maxRate(az, keyholeStep); r > s.maxAzRate+1e-9 {
+					t.Errorf("flip turns azimuth at %.2f degrees/second, faster than %v", r, s.maxAzRate)
+				}
+			case "plunge":
+				if !plan.plungeStart.Equal(p.times[0]) || !plan.plungeEnd.Equal(st.Culmination) {
+					t.Errorf("plunge from %v to %v, want from %v to %v", plan.plungeStart, plan.plungeEnd, p.times[0], st.Culmination)
+				}
+				az, el := plan.adjust(p.times[1], clampAngle(p.az[1]), p.el[1])
+				if math.Abs(math.Remainder(az-p.az[1]-180, 360)) > 1e-9 || math.Abs(el-(180-p.el[1])) > 1e-9 {
+					t.Errorf("during the plunge, %.2f, %.2f is commanded at %.2f, %.2f", p.az[1], p.el[1], az, el)
+				}
+			}
+		})
+	}
+}
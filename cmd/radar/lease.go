@@ -0,0 +1,89 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+// VelocityLease is held by the client that last commanded a velocity. The
+// antenna is stopped if the lease expires or the client disconnects.
+type VelocityLease struct {
+	// Source is "websocket" or "rotctld".
+	Source     string
+	RemoteAddr string
+	Name       string
+	// Expires is when the antenna will be stopped unless the lease is
+	// renewed, or zero if leases don't expire.
+	Expires time.Time
+}
+
+// takeLease gives the velocity lease to a client after it commanded a velocity.
+// It must be called with s.mu locked.
+func (s *Server) takeLease(source, remoteAddr, name string) {
+	s.lease = &VelocityLease{
+		Source:     source,
+		RemoteAddr: remoteAddr,
+		Name:       name,
+	}
+	s.renewLease(source, remoteAddr)
+}
+
+// holdsLease returns whether a client holds the velocity lease.
+// It must be called with s.mu locked.
+func (s *Server) holdsLease(source, remoteAddr string) bool {
+	return s.lease != nil && s.lease.Source == source && s.lease.RemoteAddr == remoteAddr
+}
+
+// renewLease extends the velocity lease if it is held by the client.
+// It must be called with s.mu locked.
+func (s *Server) renewLease(source, remoteAddr string) {
+	if !s.holdsLease(source, remoteAddr) {
+		return
+	}
+	l := *s.lease
+	if s.leaseDuration > 0 {
+		l.Expires = time.Now().Add(s.leaseDuration)
+	}
+	s.lease = &l
+	s.updateLease()
+}
+
+// releaseLease stops the antenna if a client that is going away holds the lease.
+// It must be called with s.mu locked.
+func (s *Server) releaseLease(source, remoteAddr string) {
+	if !s.holdsLease(source, remoteAddr) {
+		return
+	}
+	log.Printf("%s client %q from %s disconnected during a velocity move; stopping", source, s.lease.Name, remoteAddr)
+	s.track(nil)
+	s.r.Stop()
+}
+
+// checkLease stops the antenna if the velocity lease has expired.
+// It must be called with s.mu locked.
+func (s *Server) checkLease() {
+	if s.lease == nil || s.lease.Expires.IsZero() || time.Now().Before(s.lease.Expires) {
+		return
+	}
+	log.Printf("velocity lease of %s client %q from %s expired; stopping", s.lease.Source, s.lease.Name, s.lease.RemoteAddr)
+	s.track(nil)
+	s.r.Stop()
+}
+
+// clearLease forgets the velocity lease, because the antenna was commanded otherwise.
+// It must be called with s.mu locked.
+func (s *Server) clearLease() {
+	if s.lease == nil {
+		return
+	}
+	s.lease = nil
+	s.updateLease()
+}
+
+// updateLease must be called with s.mu locked.
+func (s *Server) updateLease() {
+	s.statusMu.Lock()
+	s.status.VelocityLease = s.lease
+	s.statusCond.Broadcast()
+	s.statusMu.Unlock()
+}
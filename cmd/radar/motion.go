@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/w1xm/rci_interface/rotator"
+)
+
+// defaultMotionLimits are the motion limits for each rotator type. They
+// apply to the axes of the rotator, which are hour angle and declination
+// for equatorial mounts.
+var defaultMotionLimits = map[string]rotator.MotionLimits{
+	"rci": {
+		MaxAzVelocity: 10, MaxElVelocity: 10,
+		MaxAzAccel: 5, MaxElAccel: 5,
+		Interval: 100 * time.Millisecond,
+	},
+	"simulator": {
+		MaxAzVelocity: 30, MaxElVelocity: 30,
+		MaxAzAccel: 30, MaxElAccel: 30,
+		Interval: 50 * time.Millisecond,
+	},
+	"simulatorequ": {
+		MaxAzVelocity: 30, MaxElVelocity: 30,
+		MaxAzAccel: 30, MaxElAccel: 30,
+		Interval: 50 * time.Millisecond,
+	},
+	"jlab": {
+		MaxAzVelocity: 5, MaxElVelocity: 5,
+		MaxAzAccel: 2, MaxElAccel: 2,
+		PositionProfiles: true,
+		Interval:         250 * time.Millisecond,
+	},
+}
+
+// motionLimits returns the motion limits for a rotator type, with any
+// nonzero values of override in place of the defaults.
+func motionLimits(rotType string, override rotator.MotionLimits, profiles *bool) rotator.MotionLimits {
+	m := defaultMotionLimits[rotType]
+	for _, f := range []struct{ dst, src *float64 }{
+		{&m.MaxAzVelocity, &override.MaxAzVelocity},
+		{&m.MaxElVelocity, &override.MaxElVelocity},
+		{&m.MaxAzAccel, &override.MaxAzAccel},
+		{&m.MaxElAccel, &override.MaxElAccel},
+	} {
+		if *f.src != 0 {
+			*f.dst = *f.src
+		}
+	}
+	if override.Interval != 0 {
+		m.Interval = override.Interval
+	}
+	if profiles != nil {
+		m.PositionProfiles = *profiles
+	}
+	return m
+}
+
+// shaped wraps the rotator created by connect with motion limits.
+func shaped(ctx context.Context, limits rotator.MotionLimits, connect func(cb rotator.StatusCallback) (rotator.Rotator, error)) func(cb rotator.StatusCallback) (rotator.Rotator, error) {
+	return func(cb rotator.StatusCallback) (rotator.Rotator, error) {
+		s, err := rotator.NewShaper(ctx, limits, connect, cb)
+		if err != nil {
+			return nil, err
+		}
+		return rotator.Expose(s, rotator.InterfacesOf(s.Rotator)), nil
+	}
+}
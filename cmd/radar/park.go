@@ -0,0 +1,238 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// parkTolerance is how close (degrees) the antenna must be to a park position to be parked.
+	parkTolerance = 0.5
+	// parkTimeout is how long to wait for the antenna to reach a park position.
+	parkTimeout = 5 * time.Minute
+)
+
+// ParkPosition is a named position to park or stow the antenna at.
+type ParkPosition struct {
+	Name   string
+	Az, El float64
+}
+
+// ParseParkPositions parses a comma-separated list of name:az:el positions.
+func ParseParkPositions(s string) ([]ParkPosition, error) {
+	var out []ParkPosition
+	for _, v := range splitList(s) {
+		parts := strings.Split(v, ":")
+		if len(parts) != 3 || parts[0] == "" {
+			return nil, fmt.Errorf("park position %q is not name:az:el", v)
+		}
+		az, err := strconv.ParseFloat(parts[1], 64)
+		if err != nil {
+			return nil, fmt.Errorf("park position %q: %w", v, err)
+		}
+		el, err := strconv.ParseFloat(parts[2], 64)
+		if err != nil {
+			return nil, fmt.Errorf("park position %q: %w", v, err)
+		}
+		out = append(out, ParkPosition{Name: parts[0], Az: clampAngle(az), El: el})
+	}
+	return out, nil
+}
+
+// ParkStatus describes a park that was commanded.
+type ParkStatus struct {
+	ParkPosition
+	// Source is what commanded the park, e.g. "websocket" or "idle".
+	Source string
+	Start  time.Time
+	// Parked is true once the antenna has reached the position.
+	Parked bool
+	// TimedOut is true if the antenna did not reach the position within parkTimeout.
+	TimedOut bool
+	// Error is set if the park could not be commanded.
+	Error string `json:",omitempty"`
+}
+
+// parkPosition returns the park position with the given name, or the
+// first one if name is empty.
+func (s *Server) parkPosition(name string) (ParkPosition, error) {
+	if len(s.parkPositions) == 0 {
+		return ParkPosition{}, fmt.Errorf("no park positions are configured")
+	}
+	if name == "" {
+		return s.parkPositions[0], nil
+	}
+	for _, p := range s.parkPositions {
+		if strings.EqualFold(p.Name, name) {
+			return p, nil
+		}
+	}
+	return ParkPosition{}, fmt.Errorf("unknown park position %q", name)
+}
+
+// park moves the antenna to the named park position, or the default one
+// if name is empty. It must be called with s.mu locked.
+func (s *Server) park(source, name string) error {
+	p, err := s.parkPosition(name)
+	if err != nil {
+		return err
+	}
+	s.track(nil)
+	if err := s.moveTo(source, p.Az, p.El); err != nil {
+		return err
+	}
+	log.Printf("%s: parking at %s (%.2f, %.2f)", source, p.Name, p.Az, p.El)
+	s.parking = &ParkStatus{
+		ParkPosition: p,
+		Source:       source,
+		Start:        time.Now(),
+	}
+	s.updatePark()
+	return nil
+}
+
+// parkIdle parks an idle antenna. A failure is recorded as the park, so
+// that it isn't tried again until the antenna is next commanded.
+// It must be called with s.mu locked.
+func (s *Server) parkIdle() {
+	err := s.park("idle", "")
+	if err == nil {
+		return
+	}
+	log.Printf("parking idle antenna: %v", err)
+	p, _ := s.parkPosition("")
+	s.parking = &ParkStatus{
+		ParkPosition: p,
+		Source:       "idle",
+		Start:        time.Now(),
+		Error:        err.Error(),
+	}
+	s.updatePark()
+}
+
+// clearPark forgets the park, because the antenna was commanded elsewhere.
+// It must be called with s.mu locked.
+func (s *Server) clearPark() {
+	if s.parking == nil {
+		return
+	}
+	s.parking = nil
+	s.updatePark()
+}
+
+// parkPending returns whether the antenna is still moving to a park position.
+// It must be called with s.mu locked.
+func (s *Server) parkPending() bool {
+	return s.parking != nil && !s.parking.Parked && !s.parking.TimedOut && s.parking.Error == ""
+}
+
+// stepPark checks whether the antenna has reached its park position.
+// It must be called with s.mu locked.
+func (s *Server) stepPark() {
+	if !s.parkPending() {
+		return
+	}
+	az, el, _, _ := s.currentPosition()
+	switch {
+	case math.Abs(math.Remainder(az-s.parking.Az, 360)) < parkTolerance && math.Abs(el-s.parking.El) < parkTolerance:
+		log.Printf("parked at %s", s.parking.Name)
+		s.parking.Parked = true
+	case time.Since(s.parking.Start) > parkTimeout:
+		log.Printf("timed out parking at %s (at %.2f, %.2f)", s.parking.Name, az, el)
+		s.parking.TimedOut = true
+	default:
+		return
+	}
+	s.updatePark()
+}
+
+// idleParkDue returns whether the antenna has been idle long enough to be
+// parked. With amplidynes, it is parked no later than they spin down.
+// It must be called with s.mu locked and s.statusMu read locked.
+func (s *Server) idleParkDue() bool {
+	if s.idlePark <= 0 || s.estop != nil || s.parking != nil || s.lease != nil || s.tracking != nil || s.scan != nil || s.calib != nil || s.job != nil || s.drifting() {
+		return false
+	}
+	delay := s.idlePark
+	if s.cps20 != nil {
+		if !s.status.Amplidynes.CommandAzEnabled && !s.status.Amplidynes.CommandElEnabled {
+			// The antenna can't move.
+			return false
+		}
+		if delay > spindownDelay {
+			delay = spindownDelay
+		}
+	}
+	return time.Since(s.status.LastMoveTime) > delay
+}
+
+// updatePark must be called with s.mu locked.
+func (s *Server) updatePark() {
+	var status *ParkStatus
+	if s.parking != nil {
+		p := *s.parking
+		status = &p
+	}
+	s.statusMu.Lock()
+	s.status.Park = status
+	s.statusCond.Broadcast()
+	s.statusMu.Unlock()
+}
+
+// ParkHandler returns the park positions and state (GET) or parks the
+// antenna (POST, with an optional name parameter).
+func (s *Server) ParkHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		s.mu.Lock()
+		out := struct {
+			Positions []ParkPosition
+			Park      *ParkStatus
+		}{Positions: s.parkPositions}
+		if s.parking != nil {
+			p := *s.parking
+			out.Park = &p
+		}
+		s.mu.Unlock()
+		writeJSON(w, http.StatusOK, out)
+	case http.MethodPost:
+		entry := s.authorizeRequest(w, r, "park")
+		if entry == nil {
+			return
+		}
+		var req struct {
+			Name string `json:"name"`
+		}
+		if r.ContentLength != 0 {
+			if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&req); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		if name := r.URL.Query().Get("name"); name != "" {
+			req.Name = name
+		}
+		s.mu.Lock()
+		s.setAmplidynesEnabled(true)
+		err := s.park("rest", req.Name)
+		var out ParkStatus
+		if s.parking != nil {
+			out = *s.parking
+		}
+		s.mu.Unlock()
+		s.auditRequest(entry, req, err)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, http.StatusOK, out)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -4,20 +4,30 @@ import (
 	"bufio"
 	"context"
 	"flag"
+	"fmt"
 	"log"
 	"net/http"
 	_ "net/http/pprof"
 	"os"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gorilla/mux"
-	"github.com/pebbe/novas"
+	"github.com/w1xm/rci_interface/pointing"
+	"github.com/w1xm/rci_interface/rotator"
+	"github.com/w1xm/rci_interface/weather"
 )
 
 var (
 	addr          = flag.String("addr", "127.0.0.1:8502", "address to listen on")
 	rotctldAddr   = flag.String("rotctld_addr", "127.0.0.1:4533", "address to listen for rotctld commands on")
-	passwordFile  = flag.String("password_file", "", "file containing passwords (one per line) to require on remote connections")
+	passwordFile  = flag.String("password_file", "", "file containing shared passwords (one per line) that give remote connections the admin role")
+	usersFile     = flag.String("users_file", "", "file of users (name:bcrypt hash:role per line) who may log in")
+	rotctldRole   = flag.String("rotctld_role", "operator", "role of rotctld clients (viewer, observer, operator, or admin)")
+	auditLog      = flag.String("audit_log", "", "file to record the commands sent by clients in (JSONL)")
+	auditLogSize  = flag.Int64("audit_log_size", 10, "size at which the audit log is rotated (megabytes)")
+	auditLogKeep  = flag.Int("audit_log_keep", 5, "number of rotated audit logs to keep")
 	staticDir     = flag.String("static_dir", "static", "directory containing static files")
 	rotType       = flag.String("rotator_type", "simulator", "type of rotator")
 	serialPort    = flag.String("serial", "", "RCI serial port name")
@@ -26,12 +36,53 @@ var (
 	height        = flag.Float64("height", 100, "height of antenna (meters)")
 	temperature   = flag.Float64("temperature", 15, "temperature (celsius)")
 	pressure      = flag.Float64("pressure", 1010, "pressure (millibars)")
+	refraction    = flag.Bool("refraction", true, "correct positions for atmospheric refraction")
+	weatherPush   = flag.Bool("weather_push", false, "accept weather conditions POSTed to /api/weather by local clients")
+	weatherFile   = flag.String("weather_file", "", "file to poll for weather conditions")
+	weatherSerial = flag.String("weather_serial", "", "weather sensor Modbus serial port name")
+	weatherURL    = flag.String("weather_url", "", "remote weather sensor Modbus URL")
+	weatherBaud   = flag.Int("weather_baud", 19200, "weather sensor baud rate")
+	weatherSlave  = flag.Int("weather_slave", 1, "weather sensor Modbus slave ID")
+	weatherMaxAge = flag.Duration("weather_max_age", 15*time.Minute, "age after which weather conditions are reported as stale")
 	azOffset      = flag.Float64("az_offset", 5.5, "azimuth offset (degrees)")
 	elOffset      = flag.Float64("el_offset", -5.5, "elevation offset (degrees)")
+	pointingModel = flag.String("pointing_model", "", "pointing model file (overrides -az_offset and -el_offset)")
 	seqSerialPort = flag.String("sequencer_serial", "", "sequencer serial port name")
 	seqURL        = flag.String("sequencer_url", "", "remote sequencer URL")
 	seqBaud       = flag.Int("sequencer_baud", 19200, "sequencer baud rate")
 	cpsSerialPort = flag.String("cps20_serial", "", "CPS20 serial port name")
+	trackMode     = flag.String("track_mode", "position", "tracking mode (position or velocity)")
+	tleFile       = flag.String("tle_file", "", "file of satellite two-line element sets to load at startup")
+	catalogFiles  = flag.String("catalog", "", "comma-separated list of star catalog files (CSV, or VizieR TSV ending in .tsv)")
+	stateFile     = flag.String("state_file", "", "file to save bodies added by clients in")
+	horizonMask   = flag.String("horizon_mask", "", "file of azimuth and minimum elevation pairs (degrees) to keep the antenna above")
+	sunRadius     = flag.Float64("sun_avoid_radius", 0, "minimum distance (degrees) to point from the Sun, or 0 to disable")
+	moonRadius    = flag.Float64("moon_avoid_radius", 0, "minimum distance (degrees) to point from the Moon, or 0 to disable")
+	minElevation  = flag.Float64("min_elevation", 0, "lowest elevation (degrees) the antenna can observe at")
+	maxElevation  = flag.Float64("max_elevation", 90, "highest elevation (degrees) the antenna can observe at")
+	powerAddr     = flag.String("power_udp", "", "address to receive power samples for pointing calibration on (UDP)")
+	wrapMin       = flag.Float64("cable_wrap_min", 0, "lowest azimuth (degrees, counting turns) the cable wrap allows, e.g. -90")
+	wrapMax       = flag.Float64("cable_wrap_max", 0, "highest azimuth (degrees, counting turns) the cable wrap allows, e.g. 450 (0 for both to disable)")
+	wrapVelocity  = flag.Float64("cable_wrap_velocity", 2, "speed (degrees/second) of moves across north with a cable wrap")
+	maxAzRate     = flag.Float64("max_az_rate", 10, "fastest azimuth rate (degrees/second) to track at")
+	maxElRate     = flag.Float64("max_el_rate", 10, "fastest elevation rate (degrees/second) to track at")
+	scheduleFile  = flag.String("schedule_file", "", "file to save scheduled jobs in")
+	parkAz        = flag.Float64("park_az", 0, "default park azimuth (degrees)")
+	parkEl        = flag.Float64("park_el", 90, "default park elevation (degrees)")
+	parkPositions = flag.String("park_positions", "", "comma-separated list of additional name:az:el park positions, e.g. service:180:5")
+	idlePark      = flag.Duration("idle_park", 0, "time without commands after which to park the antenna (0 to disable)")
+	driftLog      = flag.String("drift_log", "", "file to record drift scans in (one JSON object per line)")
+	azLimits      = flag.String("az_limits", "", "soft azimuth limits as min,max (degrees; min greater than max includes north)")
+	elLimits      = flag.String("el_limits", "", "soft elevation limits as min,max (degrees)")
+	limitMargin   = flag.Float64("limit_margin", 2, "distance from a soft limit at which velocity moves are stopped (seconds of travel)")
+	maxAzVelocity = flag.Float64("max_az_velocity", 0, "fastest azimuth (or hour angle) velocity to command (degrees/second; 0 for the rotator type's default)")
+	maxElVelocity = flag.Float64("max_el_velocity", 0, "fastest elevation (or declination) velocity to command (degrees/second; 0 for the rotator type's default)")
+	maxAzAccel    = flag.Float64("max_az_accel", 0, "fastest azimuth (or hour angle) acceleration to command (degrees/second/second; 0 for the rotator type's default)")
+	maxElAccel    = flag.Float64("max_el_accel", 0, "fastest elevation (or declination) acceleration to command (degrees/second/second; 0 for the rotator type's default)")
+	posProfiles   = flag.String("position_profiles", "", "make position moves with velocity profiles (true or false; empty for the rotator type's default)")
+	velocityLease = flag.Duration("velocity_lease", 5*time.Second, "time after which a velocity move is stopped unless the client renews it (0 to only stop when the client disconnects)")
+	lockTimeout   = flag.Duration("control_timeout", 10*time.Minute, "time after its holder's last command at which the control lock is released")
+	trackInterval = flag.Duration("track_interval", 0, "tracking loop period (default depends on rotator type)")
 )
 
 func MaxAge(h http.Handler) http.Handler {
@@ -61,24 +112,186 @@ func readLines(path string) []string {
 	return out
 }
 
+// parseRange parses a min,max flag value. An empty value is no range.
+func parseRange(s string) (*rotator.Range, error) {
+	if s == "" {
+		return nil, nil
+	}
+	parts := splitList(s)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("range %q is not min,max", s)
+	}
+	min, err := strconv.ParseFloat(parts[0], 64)
+	if err != nil {
+		return nil, err
+	}
+	max, err := strconv.ParseFloat(parts[1], 64)
+	if err != nil {
+		return nil, err
+	}
+	return &rotator.Range{Min: min, Max: max}, nil
+}
+
+// splitList splits a comma-separated flag value, ignoring empty elements.
+func splitList(s string) []string {
+	var out []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
 func main() {
 	flag.Parse()
 	ctx := context.Background()
-	place := novas.NewPlace(*latitude, *longitude, *height, *temperature, *pressure)
+	var weatherSource weather.Source
+	var weatherSources int
+	if *weatherPush {
+		weatherSource = &weather.Push{}
+		weatherSources++
+	}
+	if *weatherFile != "" {
+		weatherSource = &weather.File{Path: *weatherFile}
+		weatherSources++
+	}
+	if *weatherSerial != "" || *weatherURL != "" {
+		weatherSource = &weather.Modbus{
+			Port:     *weatherSerial,
+			BaudRate: *weatherBaud,
+			SlaveId:  byte(*weatherSlave),
+			URL:      *weatherURL,
+		}
+		weatherSources++
+	}
+	if weatherSources > 1 {
+		log.Fatal("only one weather source may be specified")
+	}
 	var passwords []string
 	if *passwordFile != "" {
 		passwords = readLines(*passwordFile)
 	}
-	server, err := NewServer(ctx, *rotType, *serialPort, passwords, *latitude, *longitude, place, *azOffset, *elOffset, *seqURL, *seqSerialPort, *seqBaud, *cpsSerialPort)
+	var users map[string]User
+	if *usersFile != "" {
+		var err error
+		if users, err = LoadUsers(*usersFile); err != nil {
+			log.Fatal(err)
+		}
+	}
+	var audit *AuditLog
+	if *auditLog != "" {
+		audit = &AuditLog{Path: *auditLog, MaxSize: *auditLogSize << 20, Keep: *auditLogKeep}
+	}
+	rotRole, err := ParseRole(*rotctldRole)
+	if err != nil || rotRole == RoleNone {
+		log.Fatalf("-rotctld_role: unknown role %q", *rotctldRole)
+	}
+	var model pointing.Model
+	if *pointingModel != "" {
+		var err error
+		if model, err = pointing.Load(*pointingModel); err != nil {
+			log.Fatal(err)
+		}
+	}
+	parks := []ParkPosition{{Name: "stow", Az: *parkAz, El: *parkEl}}
+	if extra, err := ParseParkPositions(*parkPositions); err != nil {
+		log.Fatal(err)
+	} else {
+		parks = append(parks, extra...)
+	}
+	limits := rotator.Limits{Margin: *limitMargin}
+	if limits.Az, err = parseRange(*azLimits); err != nil {
+		log.Fatalf("-az_limits: %v", err)
+	}
+	if limits.El, err = parseRange(*elLimits); err != nil {
+		log.Fatalf("-el_limits: %v", err)
+	}
+	var profiles *bool
+	if *posProfiles != "" {
+		p, err := strconv.ParseBool(*posProfiles)
+		if err != nil {
+			log.Fatalf("-position_profiles: %v", err)
+		}
+		profiles = &p
+	}
+	server, err := NewServer(ctx, Config{
+		RotatorType:       *rotType,
+		Port:              *serialPort,
+		Passwords:         passwords,
+		Users:             users,
+		RotctldRole:       rotRole,
+		AuditLog:          audit,
+		Latitude:          *latitude,
+		Longitude:         *longitude,
+		Height:            *height,
+		Temperature:       *temperature,
+		Pressure:          *pressure,
+		WeatherSource:     weatherSource,
+		WeatherMaxAge:     *weatherMaxAge,
+		NoRefraction:      !*refraction,
+		AzOffset:          *azOffset,
+		ElOffset:          *elOffset,
+		PointingModel:     model,
+		SequencerURL:      *seqURL,
+		SequencerPort:     *seqSerialPort,
+		SequencerBaud:     *seqBaud,
+		CPS20Port:         *cpsSerialPort,
+		TrackMode:         *trackMode,
+		TrackInterval:     *trackInterval,
+		TLEFile:           *tleFile,
+		CatalogFiles:      splitList(*catalogFiles),
+		StateFile:         *stateFile,
+		HorizonMaskFile:   *horizonMask,
+		SunRadius:         *sunRadius,
+		MoonRadius:        *moonRadius,
+		MinElevation:      *minElevation,
+		MaxElevation:      *maxElevation,
+		CableWrapMin:      *wrapMin,
+		CableWrapMax:      *wrapMax,
+		CableWrapVelocity: *wrapVelocity,
+		MaxAzRate:         *maxAzRate,
+		MaxElRate:         *maxElRate,
+		ScheduleFile:      *scheduleFile,
+		ParkPositions:     parks,
+		IdlePark:          *idlePark,
+		DriftLog:          *driftLog,
+		SoftLimits:        limits,
+		MotionLimits: rotator.MotionLimits{
+			MaxAzVelocity: *maxAzVelocity,
+			MaxElVelocity: *maxElVelocity,
+			MaxAzAccel:    *maxAzAccel,
+			MaxElAccel:    *maxElAccel,
+		},
+		PositionProfiles: profiles,
+		VelocityLease:    *velocityLease,
+		ControlTimeout:   *lockTimeout,
+	})
 	if err != nil {
 		log.Fatal(err)
 	}
 	if err := server.ListenRotctld(ctx, *rotctldAddr); err != nil {
 		log.Fatal(err)
 	}
+	server.ListenEmergencySignal(ctx)
+	if *powerAddr != "" {
+		if err := server.ListenPower(ctx, *powerAddr); err != nil {
+			log.Fatal(err)
+		}
+	}
 	r := mux.NewRouter()
 	r.HandleFunc("/api/status", server.StatusHandler)
 	r.HandleFunc("/api/ws", server.StatusSocketHandler)
+	r.HandleFunc("/api/satellites/passes", server.PassesHandler)
+	r.HandleFunc("/api/catalog/search", server.CatalogSearchHandler)
+	r.HandleFunc("/api/bodies/{id}/visibility", server.VisibilityHandler)
+	r.HandleFunc("/api/power", server.PowerHandler)
+	r.HandleFunc("/api/weather", server.WeatherHandler)
+	r.HandleFunc("/api/schedule", server.ScheduleHandler)
+	r.HandleFunc("/api/schedule/{id}", server.JobHandler)
+	r.HandleFunc("/api/park", server.ParkHandler)
+	r.HandleFunc("/api/audit", server.AuditHandler)
+	r.HandleFunc("/api/estop", server.EmergencyStopHandler)
 	r.PathPrefix("/debug").Handler(http.DefaultServeMux)
 	r.PathPrefix("/").Handler(MaxAge(http.FileServer(http.Dir(*staticDir))))
 	srv := &http.Server{
@@ -10,6 +10,17 @@ import (
 	"strings"
 )
 
+// rprtRejected is the Hamlib RIG_ERJCTED error, returned for moves refused by avoidance.
+const rprtRejected = -9
+
+// rotctldControlled are the commands that are refused while another client
+// holds the control lock.
+var rotctldControlled = map[string]bool{
+	"K": true, "park": true,
+	"P": true, "set_pos": true,
+	"M": true, "move": true,
+}
+
 func (s *Server) ListenRotctld(ctx context.Context, addr string) error {
 	ln, err := net.Listen("tcp", addr)
 	if err != nil {
@@ -35,6 +46,13 @@ func (s *Server) ListenRotctld(ctx context.Context, addr string) error {
 
 func (s *Server) handleRotctld(conn net.Conn) {
 	defer conn.Close()
+	addr := conn.RemoteAddr().String()
+	defer func() {
+		s.mu.Lock()
+		s.releaseLease("rotctld", addr)
+		s.releaseControl("rotctld", addr)
+		s.mu.Unlock()
+	}()
 	log.Printf("accepted connection from %v", conn.RemoteAddr())
 	scanner := bufio.NewScanner(conn)
 	for scanner.Scan() {
@@ -60,7 +78,42 @@ func (s *Server) handleRotctld(conn net.Conn) {
 			cmd = string(cmd[0])
 		}
 		log.Printf("%v command: %q args: %#v", conn.RemoteAddr(), cmd, args)
+		// Commands that may move the antenna are audited.
+		audited := rotctldRoles[cmd] >= RoleObserver
+		entry := AuditEntry{
+			Surface:    "rotctld",
+			Role:       s.rotctldRole,
+			RemoteAddr: addr,
+			Command:    cmd,
+			Args:       auditArgs(args),
+		}
+		if need := requiredRole(rotctldRoles, cmd); s.rotctldRole < need {
+			log.Printf("%v command %q needs role %v", conn.RemoteAddr(), cmd, need)
+			fmt.Fprintf(conn, "RPRT %d\n", rprtRejected)
+			if audited {
+				entry.Outcome, entry.Error = "refused", fmt.Sprintf("role %v is needed", need)
+				s.audit.Record(entry)
+			}
+			continue
+		}
+		// Any command renews the velocity lease; clients poll the position while moving.
+		s.mu.Lock()
+		s.renewLease("rotctld", addr)
+		var controlErr error
+		if rotctldControlled[cmd] {
+			controlErr = s.checkControl("rotctld", addr)
+		}
+		s.mu.Unlock()
+		if controlErr != nil {
+			log.Printf("%v command %q: %v", conn.RemoteAddr(), cmd, controlErr)
+			fmt.Fprintf(conn, "RPRT %d\n", rprtRejected)
+			entry.Outcome, entry.Error = "refused", controlErr.Error()
+			s.audit.Record(entry)
+			continue
+		}
 		rprt := -1
+		// cmdErr explains why a command failed, if it is known.
+		var cmdErr error
 		switch cmd {
 		case "1", "dump_caps":
 			fmt.Fprintf(conn, `Model name: RCI
@@ -73,7 +126,7 @@ Max Elevation: 90.00
 Can set Position: Y
 Can get Position: Y
 Can Stop: Y
-Can Park: N
+Can Park: Y
 Can Reset: N
 Can Move: Y
 Can get Info: N
@@ -82,10 +135,25 @@ Can get Info: N
 		case "S", "stop":
 			extended = true // always print RPRT
 			s.mu.Lock()
-			s.track(0)
+			s.track(nil)
 			s.r.Stop()
 			s.mu.Unlock()
 			rprt = 0
+		case "K", "park":
+			extended = true // always print RPRT
+			var name string
+			if len(args) > 0 {
+				name = args[0]
+			}
+			s.mu.Lock()
+			s.setAmplidynesEnabled(true)
+			err := s.park("rotctld", name)
+			s.mu.Unlock()
+			rprt = 0
+			if err != nil {
+				log.Printf("park: %v", err)
+				rprt, cmdErr = rprtRejected, err
+			}
 		case "P", "set_pos":
 			extended = true // always print RPRT
 			if len(args) != 2 {
@@ -103,11 +171,14 @@ Can get Info: N
 				break
 			}
 			s.mu.Lock()
-			s.track(0)
-			s.r.SetAzimuthPosition(az)
-			s.r.SetElevationPosition(el)
+			s.setAmplidynesEnabled(true)
+			s.track(nil)
+			err = s.moveTo("rotctld", az, el)
 			s.mu.Unlock()
 			rprt = 0
+			if err != nil {
+				rprt, cmdErr = rprtRejected, err
+			}
 		case "M", "move":
 			extended = true // always print RPRT
 			if len(args) != 2 {
@@ -131,22 +202,50 @@ Can get Info: N
 				fallthrough
 			case 4: // Down
 				s.mu.Lock()
-				s.track(0)
-				s.r.SetElevationVelocity(float64(speed) / 10)
+				s.setAmplidynesEnabled(true)
+				s.track(nil)
+				err = s.setVelocity("rotctld", 0, float64(speed)/10, false, true)
+				if err == nil {
+					s.takeLease("rotctld", addr, "rotctld")
+				}
 				s.mu.Unlock()
 				rprt = 0
+				if err != nil {
+					rprt, cmdErr = rprtRejected, err
+				}
 			case 8: // Left
 				speed *= -1
 				fallthrough
 			case 16: // Right
 				s.mu.Lock()
-				s.track(0)
-				s.r.SetAzimuthVelocity(float64(speed) / 10)
+				s.setAmplidynesEnabled(true)
+				s.track(nil)
+				err = s.setVelocity("rotctld", float64(speed)/10, 0, true, false)
+				if err == nil {
+					s.takeLease("rotctld", addr, "rotctld")
+				}
 				s.mu.Unlock()
 				rprt = 0
+				if err != nil {
+					rprt, cmdErr = rprtRejected, err
+				}
 			default:
 				rprt = -22
 			}
+		case "take_control":
+			s.mu.Lock()
+			err := s.takeControl("rotctld", addr, "rotctld", false)
+			s.mu.Unlock()
+			rprt = 0
+			if err != nil {
+				log.Printf("take_control: %v", err)
+				rprt, cmdErr = rprtRejected, err
+			}
+		case "release_control":
+			s.mu.Lock()
+			s.releaseControl("rotctld", addr)
+			s.mu.Unlock()
+			rprt = 0
 		case "p", "get_pos":
 			s.statusMu.RLock()
 			status := s.status
@@ -165,6 +264,13 @@ Can get Info: N
 		if extended || rprt != 0 {
 			fmt.Fprintf(conn, "RPRT %d\n", rprt)
 		}
+		if audited {
+			entry.Outcome, entry.Error = auditOutcome(cmdErr)
+			if rprt != 0 && cmdErr == nil {
+				entry.Outcome, entry.Error = "failed", fmt.Sprintf("RPRT %d", rprt)
+			}
+			s.audit.Record(entry)
+		}
 	}
 	if err := scanner.Err(); err != nil {
 		log.Printf("reading from %v: %v", conn.RemoteAddr(), err)
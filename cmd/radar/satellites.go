@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/pebbe/novas"
+	"github.com/w1xm/rci_interface/satellite"
+)
+
+// auKm is the length of an astronomical unit in kilometers.
+const auKm = 149597870.7
+
+// satelliteBody is a Body backed by an SGP4 propagator.
+type satelliteBody struct {
+	sat      *satellite.Satellite
+	observer satellite.Observer
+}
+
+func (b *satelliteBody) Name() string {
+	return b.sat.Name
+}
+
+// Topo returns the position of the satellite as seen from the server's
+// observer. The place and refraction arguments are ignored. If the
+// satellite cannot be propagated, Az and Alt are NaN.
+func (b *satelliteBody) Topo(t novas.Time, place *novas.Place, refr novas.RefractType) novas.BodyTopoData {
+	az, el, rng, err := b.sat.LookAngles(t.Time, b.observer)
+	if err != nil {
+		return novas.BodyTopoData{Dis: math.NaN(), Az: math.NaN(), Alt: math.NaN()}
+	}
+	return novas.BodyTopoData{Dis: rng / auKm, Az: az, Alt: el}
+}
+
+type TLE struct {
+	Name  string `json:"name"`
+	Line1 string `json:"line1"`
+	Line2 string `json:"line2"`
+}
+
+type SatellitePass struct {
+	// Body is the index of the satellite in Status.Bodies.
+	Body   int
+	BodyID string
+	Name   string
+	satellite.Pass
+}
+
+const (
+	// passWindow is how far ahead passes are predicted.
+	passWindow = 24 * time.Hour
+	// passInterval is how often pass predictions are refreshed.
+	passInterval = 1 * time.Minute
+)
+
+func (s *Server) observer() satellite.Observer {
+	return satellite.Observer{Latitude: s.latitude, Longitude: s.longitude, Height: s.height}
+}
+
+// addTLE adds a user-supplied satellite to the list of bodies.
+// It must be called with s.mu locked.
+func (s *Server) addTLE(tle TLE) error {
+	return s.addUserBody(savedBody{TLE: &tle})
+}
+
+func loadTLEFile(path string) ([]*satellite.Satellite, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return satellite.ParseFile(f)
+}
+
+// satellitePasses returns the passes of each satellite between start and end.
+func (s *Server) satellitePasses(start, end time.Time) []SatellitePass {
+	type sat struct {
+		index int
+		id    string
+		body  *satelliteBody
+	}
+	var sats []sat
+	s.mu.Lock()
+	for i, b := range s.bodies {
+		if body, ok := b.Body.(*satelliteBody); ok {
+			sats = append(sats, sat{i + 1, b.id, body})
+		}
+	}
+	s.mu.Unlock()
+	var out []SatellitePass
+	for _, sat := range sats {
+		b := sat.body
+		for _, p := range b.sat.Passes(b.observer, start, end, 0) {
+			out = append(out, SatellitePass{Body: sat.index, BodyID: sat.id, Name: b.Name(), Pass: p})
+		}
+	}
+	return out
+}
+
+// updatePasses refreshes the next pass of each satellite in the status.
+func (s *Server) updatePasses() {
+	now := time.Now()
+	var next []SatellitePass
+	seen := make(map[int]bool)
+	for _, p := range s.satellitePasses(now, now.Add(passWindow)) {
+		if !seen[p.Body] {
+			seen[p.Body] = true
+			next = append(next, p)
+		}
+	}
+	s.statusMu.Lock()
+	defer s.statusMu.Unlock()
+	s.status.SatellitePasses = next
+	s.statusCond.Broadcast()
+}
+
+func (s *Server) passLoop(ctx context.Context) {
+	for {
+		s.updatePasses()
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(passInterval):
+		}
+	}
+}
+
+// PassesHandler returns the predicted passes of each satellite.
+// The optional hours parameter sets how far ahead to look (default 24).
+func (s *Server) PassesHandler(w http.ResponseWriter, r *http.Request) {
+	window := passWindow
+	if h := r.FormValue("hours"); h != "" {
+		hours, err := strconv.ParseFloat(h, 64)
+		if err != nil || hours <= 0 || hours > 24*7 {
+			http.Error(w, "invalid hours", http.StatusBadRequest)
+			return
+		}
+		window = time.Duration(hours * float64(time.Hour))
+	}
+	now := time.Now()
+	passes := s.satellitePasses(now, now.Add(window))
+	w.Header().Set("Content-Type", "application/json")
+	data, err := json.Marshal(passes)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	w.Write(data)
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/pebbe/novas"
+)
+
+// ScanParams describes a scan pattern requested by a client.
+type ScanParams struct {
+	// Pattern is one of "raster" (az/el), "grid" (RA/Dec), or "spiral" (cross-el/el).
+	Pattern string `json:"pattern"`
+	// Body is the ID or index of the body to center the scan on. If unset, the scan is centered on Az/El.
+	Body BodyRef `json:"body"`
+	// Az and El are the center of the scan (degrees) when Body is 0.
+	Az float64 `json:"az"`
+	El float64 `json:"el"`
+	// Width and Height are the extent of the scan (degrees). Spiral scans use Width as the diameter.
+	Width  float64 `json:"width"`
+	Height float64 `json:"height"`
+	// Step is the spacing between points (degrees).
+	Step float64 `json:"step"`
+	// Dwell is the time to remain at each point (seconds).
+	Dwell float64 `json:"dwell"`
+}
+
+type ScanStatus struct {
+	Params ScanParams
+	// Point is the index of the current point.
+	Point  int
+	Points int
+	ETA    time.Time
+}
+
+// scanTolerance is how close (degrees) the antenna must be to a point before dwelling starts.
+const scanTolerance = 0.1
+
+// maxScanPoints limits the size of a scan, to catch typos in the step size.
+const maxScanPoints = 10000
+
+type scanPoint struct {
+	x, y float64
+}
+
+type scan struct {
+	params ScanParams
+	body   Body
+	points []scanPoint
+	index  int
+	// arrived is the time the antenna reached the current point, or zero if it is still slewing.
+	arrived time.Time
+}
+
+func newScan(params ScanParams, body Body) (*scan, error) {
+	if params.Step <= 0 {
+		return nil, errors.New("step must be positive")
+	}
+	if params.Width < 0 || params.Height < 0 || params.Dwell < 0 {
+		return nil, errors.New("extent and dwell must not be negative")
+	}
+	sc := &scan{params: params, body: body}
+	switch params.Pattern {
+	case "raster":
+		sc.points = gridPoints(params.Width, params.Height, params.Step)
+	case "grid":
+		if sc.body == nil {
+			return nil, errors.New("grid scans must be centered on a body")
+		}
+		sc.points = gridPoints(params.Width, params.Height, params.Step)
+	case "spiral":
+		sc.points = spiralPoints(params.Width/2, params.Step)
+	default:
+		return nil, fmt.Errorf("unknown scan pattern %q", params.Pattern)
+	}
+	if len(sc.points) > maxScanPoints {
+		return nil, fmt.Errorf("scan has %d points, more than the limit of %d", len(sc.points), maxScanPoints)
+	}
+	return sc, nil
+}
+
+// gridPoints returns a boustrophedon pattern of points covering width x height, centered on 0.
+func gridPoints(width, height, step float64) []scanPoint {
+	nx := int(width/step) + 1
+	ny := int(height/step) + 1
+	var out []scanPoint
+	for j := 0; j < ny; j++ {
+		y := (float64(j) - float64(ny-1)/2) * step
+		for i := 0; i < nx; i++ {
+			if j%2 == 1 {
+				i2 := nx - 1 - i
+				out = append(out, scanPoint{(float64(i2) - float64(nx-1)/2) * step, y})
+				continue
+			}
+			out = append(out, scanPoint{(float64(i) - float64(nx-1)/2) * step, y})
+		}
+	}
+	return out
+}
+
+// spiralPoints returns points along an Archimedean spiral out to radius,
+// spaced approximately step apart along the arc and between turns.
+func spiralPoints(radius, step float64) []scanPoint {
+	out := []scanPoint{{0, 0}}
+	theta := 2 * math.Pi
+	for {
+		r := step * theta / (2 * math.Pi)
+		if r > radius {
+			return out
+		}
+		out = append(out, scanPoint{r * math.Cos(theta), r * math.Sin(theta)})
+		theta += step / r
+	}
+}
+
+// position returns the az/el of the current point.
+func (sc *scan) position(place *novas.Place, refr novas.RefractType, latitude float64) (float64, float64) {
+	az, el := sc.params.Az, sc.params.El
+	if sc.body != nil {
+		topo := bodyTopo(sc.body, novas.Now(), place, refr)
+		az, el = topo.Az, topo.Alt
+	}
+	p := sc.points[sc.index]
+	switch sc.params.Pattern {
+	case "raster":
+		return clampAngle(az + p.x), el + p.y
+	case "grid":
+		return offsetRadec(az, el, p.x, p.y, latitude)
+	default:
+		return offsetXel(az, el, p.x, p.y)
+	}
+}
+
+// step advances the scan given the current antenna position.
+// It returns false when the scan is complete.
+func (sc *scan) step(now time.Time, az, el, curAz, curEl float64) bool {
+	if sc.arrived.IsZero() {
+		if math.Abs(math.Remainder(az-curAz, 360)) < scanTolerance && math.Abs(el-curEl) < scanTolerance {
+			sc.arrived = now
+		}
+		return true
+	}
+	if now.Sub(sc.arrived).Seconds() >= sc.params.Dwell {
+		sc.index++
+		sc.arrived = time.Time{}
+	}
+	return sc.index < len(sc.points)
+}
+
+func (sc *scan) status(now time.Time) *ScanStatus {
+	remaining := time.Duration(float64(len(sc.points)-sc.index) * sc.params.Dwell * float64(time.Second))
+	if !sc.arrived.IsZero() {
+		remaining -= now.Sub(sc.arrived)
+	}
+	return &ScanStatus{
+		Params: sc.params,
+		Point:  sc.index,
+		Points: len(sc.points),
+		ETA:    now.Add(remaining),
+	}
+}
+
+// startScan begins a scan. It must be called with s.mu locked.
+func (s *Server) startScan(params ScanParams) error {
+	body, err := s.lookupBody(params.Body)
+	if err != nil {
+		return err
+	}
+	var b Body
+	if body != nil {
+		b = body
+	}
+	sc, err := newScan(params, b)
+	if err != nil {
+		return err
+	}
+	s.track(nil)
+	s.scan = sc
+	s.statusMu.Lock()
+	s.status.Scan = sc.status(time.Now())
+	s.statusMu.Unlock()
+	return nil
+}
+
+// stepScan commands the antenna to the current point of the active scan.
+// It must be called with s.mu locked.
+func (s *Server) stepScan() {
+	sc := s.scan
+	az, el := sc.position(s.place, s.refraction, s.latitude)
+	s.statusMu.RLock()
+	var curAz, curEl float64
+	if s.status.Status != nil {
+		curAz, curEl = s.status.AzimuthPosition(), s.status.ElevationPosition()
+	}
+	s.statusMu.RUnlock()
+	now := time.Now()
+	if !sc.step(now, az, el, curAz, curEl) {
+		s.scan = nil
+		s.statusMu.Lock()
+		s.status.Scan = nil
+		s.statusCond.Broadcast()
+		s.statusMu.Unlock()
+		return
+	}
+	if sc.arrived.IsZero() {
+		// Pick up the next point if we just moved on.
+		az, el = sc.position(s.place, s.refraction, s.latitude)
+	}
+	if math.IsNaN(az) || math.IsNaN(el) {
+		return
+	}
+	if err := s.moveTo("scan", az, el); err != nil {
+		// Skip points that can't be reached.
+		sc.index++
+		sc.arrived = time.Time{}
+		if sc.index >= len(sc.points) {
+			s.scan = nil
+			s.statusMu.Lock()
+			s.status.Scan = nil
+			s.statusCond.Broadcast()
+			s.statusMu.Unlock()
+			return
+		}
+	}
+	s.statusMu.Lock()
+	s.status.Scan = sc.status(now)
+	s.statusCond.Broadcast()
+	s.statusMu.Unlock()
+}
@@ -0,0 +1,545 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	// scheduleInterval is how often the scheduler checks for jobs to start or stop.
+	scheduleInterval = 1 * time.Second
+	// jobHistory is how long finished jobs are kept.
+	jobHistory = 7 * 24 * time.Hour
+	// maxJobDuration limits the length of a job.
+	maxJobDuration = 7 * 24 * time.Hour
+)
+
+// Job states
+const (
+	jobPending   = "pending"
+	jobRunning   = "running"
+	jobDone      = "done"
+	jobCanceled  = "canceled"
+	jobFailed    = "failed"
+	jobMissed    = "missed"
+	jobPreempted = "preempted"
+	// jobInterrupted means that a client moved the antenna while the job was running.
+	jobInterrupted = "interrupted"
+)
+
+// errJobConflict is returned when a job overlaps a job with the same or higher priority.
+var errJobConflict = errors.New("conflicting job")
+
+// BandSetting sets a band of the sequencer at the start of a job.
+type BandSetting struct {
+	Band int  `json:"band"`
+	RX   bool `json:"rx"`
+	TX   bool `json:"tx"`
+}
+
+// Job is an observation that runs at a scheduled time.
+type Job struct {
+	ID   string `json:"id"`
+	Name string `json:"name,omitempty"`
+	// Start is when the job begins, and Duration is how long it runs (seconds).
+	Start    time.Time `json:"start"`
+	Duration float64   `json:"duration"`
+	// Priority decides which of two overlapping jobs runs. A job can only
+	// be added over jobs with lower priority, which are preempted.
+	Priority int `json:"priority"`
+	// Body is tracked for the duration of the job, unless Scan is set.
+	Body BodyRef     `json:"body"`
+	Scan *ScanParams `json:"scan,omitempty"`
+	// Bands are set on the sequencer when the job starts. Any band with TX
+	// enabled is returned to RX when the job ends.
+	Bands []BandSetting `json:"bands,omitempty"`
+	// Park moves the antenna to its park position when the job ends.
+	Park bool `json:"park"`
+
+	State string `json:"state"`
+	Error string `json:"error,omitempty"`
+}
+
+// End returns the time at which the job ends.
+func (j *Job) End() time.Time {
+	return j.Start.Add(time.Duration(j.Duration * float64(time.Second)))
+}
+
+func (j *Job) overlaps(o *Job) bool {
+	return j.Start.Before(o.End()) && o.Start.Before(j.End())
+}
+
+func (j *Job) active() bool {
+	return j.State == jobPending || j.State == jobRunning
+}
+
+// sortJobs sorts jobs by start time.
+// It must be called with s.mu locked.
+func (s *Server) sortJobs() {
+	sort.SliceStable(s.jobs, func(i, k int) bool {
+		return s.jobs[i].Start.Before(s.jobs[k].Start)
+	})
+}
+
+// findJob returns the job with the given ID.
+// It must be called with s.mu locked.
+func (s *Server) findJob(id string) *Job {
+	for _, j := range s.jobs {
+		if j.ID == id {
+			return j
+		}
+	}
+	return nil
+}
+
+// addJob validates and schedules a job. Overlapping jobs with lower
+// priority are preempted; overlapping jobs with the same or higher
+// priority cause an error. It must be called with s.mu locked.
+func (s *Server) addJob(job Job) (*Job, error) {
+	if job.Duration <= 0 || time.Duration(job.Duration*float64(time.Second)) > maxJobDuration {
+		return nil, fmt.Errorf("invalid duration %v", job.Duration)
+	}
+	if job.Start.IsZero() {
+		return nil, errors.New("start time is required")
+	}
+	if !job.End().After(time.Now()) {
+		return nil, errors.New("job ends in the past")
+	}
+	if job.Scan != nil {
+		// Check the parameters now rather than when the job starts.
+		body, err := s.lookupBody(job.Scan.Body)
+		if err != nil {
+			return nil, err
+		}
+		var b Body
+		if body != nil {
+			b = body
+			job.Scan.Body = BodyRef{ID: body.id}
+		}
+		if _, err := newScan(*job.Scan, b); err != nil {
+			return nil, err
+		}
+		job.Body = BodyRef{}
+	} else {
+		body, err := s.lookupBody(job.Body)
+		if err != nil {
+			return nil, err
+		}
+		if body == nil {
+			return nil, errors.New("job needs a body or a scan")
+		}
+		// Refer to the body by ID, since indices change as bodies are added and removed.
+		job.Body = BodyRef{ID: body.id}
+	}
+	for _, b := range job.Bands {
+		if b.Band < 0 {
+			return nil, fmt.Errorf("invalid band %d", b.Band)
+		}
+	}
+	var preempt []*Job
+	for _, o := range s.jobs {
+		if !o.active() || !o.overlaps(&job) {
+			continue
+		}
+		if o.Priority >= job.Priority {
+			return nil, fmt.Errorf("%w %s (%s to %s, priority %d)", errJobConflict, o.ID, o.Start.Format(time.RFC3339), o.End().Format(time.RFC3339), o.Priority)
+		}
+		preempt = append(preempt, o)
+	}
+	for _, o := range preempt {
+		if o.State == jobPending {
+			o.State = jobPreempted
+			o.Error = "preempted by a higher priority job"
+		}
+		// Running jobs are preempted when the new job starts.
+	}
+	s.nextJobID++
+	job.ID = strconv.Itoa(s.nextJobID)
+	job.State = jobPending
+	job.Error = ""
+	j := &job
+	s.jobs = append(s.jobs, j)
+	s.sortJobs()
+	s.updateSchedule()
+	return j, s.saveSchedule()
+}
+
+// cancelJob cancels a pending or running job.
+// It must be called with s.mu locked.
+func (s *Server) cancelJob(id string) error {
+	j := s.findJob(id)
+	if j == nil {
+		return fmt.Errorf("no job %q", id)
+	}
+	if !j.active() {
+		return fmt.Errorf("job %s is already %s", id, j.State)
+	}
+	if j == s.job {
+		s.endJob(jobCanceled, "")
+	} else {
+		j.State = jobCanceled
+	}
+	s.updateSchedule()
+	return s.saveSchedule()
+}
+
+// startJob starts a job. It must be called with s.mu locked.
+func (s *Server) startJob(j *Job) {
+	// The amplidynes may have spun down while the antenna was idle.
+	s.setAmplidynesEnabled(true)
+	var err error
+	if j.Scan != nil {
+		err = s.startScan(*j.Scan)
+	} else {
+		var body *bodyEntry
+		if body, err = s.lookupBody(j.Body); err == nil {
+			s.track(body)
+		}
+	}
+	if err == nil {
+		err = s.setJobBands(j, false)
+	}
+	if err != nil {
+		log.Printf("starting job %s: %v", j.ID, err)
+		j.State = jobFailed
+		j.Error = err.Error()
+		s.track(nil)
+		return
+	}
+	log.Printf("starting job %s (%s)", j.ID, j.Name)
+	j.State = jobRunning
+	s.job = j
+	s.jobTracking, s.jobScan = s.tracking, s.scan
+}
+
+// setJobBands applies the band settings of a job, or at the end of the job
+// returns any transmitting bands to receive, and queues an entry for the
+// audit log.
+func (s *Server) setJobBands(j *Job, end bool) error {
+	if len(j.Bands) == 0 {
+		return nil
+	}
+	err := s.applyJobBands(j, end)
+	outcome, msg := auditOutcome(err)
+	s.queueAudit(AuditEntry{
+		Surface: "scheduler",
+		Client:  "job " + j.ID,
+		Command: "set_job_bands",
+		Args: auditArgs(map[string]interface{}{
+			"bands": j.Bands,
+			"end":   end,
+		}),
+		Outcome: outcome,
+		Error:   msg,
+	})
+	return err
+}
+
+func (s *Server) applyJobBands(j *Job, end bool) error {
+	if s.seq == nil {
+		return errors.New("no sequencer is connected")
+	}
+	for _, b := range j.Bands {
+		var err error
+		switch {
+		case end && b.TX:
+			if err = s.seq.SetBandTX(b.Band, false); err == nil {
+				err = s.seq.SetBandRX(b.Band, true)
+			}
+		case end:
+		case b.TX:
+			err = s.seq.SetBandTX(b.Band, true)
+		default:
+			// As with set_band_rx, cancel TX first.
+			if err = s.seq.SetBandTX(b.Band, false); err == nil {
+				err = s.seq.SetBandRX(b.Band, b.RX)
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("band %d: %w", b.Band, err)
+		}
+	}
+	return nil
+}
+
+// endJob stops the running job and records its final state.
+// It must be called with s.mu locked.
+func (s *Server) endJob(state, reason string) {
+	j := s.job
+	s.job = nil
+	j.State = state
+	j.Error = reason
+	log.Printf("job %s %s", j.ID, state)
+	if err := s.setJobBands(j, true); err != nil {
+		log.Printf("ending job %s: %v", j.ID, err)
+	}
+	if state == jobInterrupted {
+		// Leave the antenna to whoever took over.
+		return
+	}
+	s.track(nil)
+	if j.Park && state != jobPreempted {
+		s.setAmplidynesEnabled(true)
+		if err := s.park("schedule", ""); err != nil {
+			log.Printf("parking after job %s: %v", j.ID, err)
+		}
+	}
+}
+
+// stepSchedule starts and stops jobs. It must be called with s.mu locked.
+func (s *Server) stepSchedule(now time.Time) {
+	changed := false
+	if j := s.job; j != nil {
+		switch {
+		case s.jobScan != nil && s.scan == nil && s.tracking == nil:
+			// The scan finished early.
+			s.endJob(jobDone, "")
+			changed = true
+		case s.tracking != s.jobTracking || s.scan != s.jobScan:
+			s.endJob(jobInterrupted, "a client moved the antenna")
+			changed = true
+		case !now.Before(j.End()):
+			s.endJob(jobDone, "")
+			changed = true
+		}
+	}
+	var next *Job
+	for _, j := range s.jobs {
+		if j.State != jobPending {
+			continue
+		}
+		if !now.Before(j.End()) {
+			j.State = jobMissed
+			changed = true
+			continue
+		}
+		if !now.Before(j.Start) && (next == nil || j.Priority > next.Priority) {
+			next = j
+		}
+	}
+	// Jobs wait while a client holds the control lock or an emergency stop is latched.
+	if next != nil && s.control == nil && s.estop == nil && (s.job == nil || next.Priority > s.job.Priority) {
+		if s.job != nil {
+			s.endJob(jobPreempted, fmt.Sprintf("preempted by job %s", next.ID))
+		}
+		s.startJob(next)
+		changed = true
+	}
+	// Forget old jobs.
+	jobs := s.jobs[:0]
+	for _, j := range s.jobs {
+		if j.active() || now.Sub(j.End()) < jobHistory {
+			jobs = append(jobs, j)
+		} else {
+			changed = true
+		}
+	}
+	s.jobs = jobs
+	if changed {
+		s.updateSchedule()
+		if err := s.saveSchedule(); err != nil {
+			log.Printf("saving schedule: %v", err)
+		}
+	}
+}
+
+// updateSchedule puts the pending and running jobs in the status.
+// It must be called with s.mu locked.
+func (s *Server) updateSchedule() {
+	var jobs []Job
+	for _, j := range s.jobs {
+		if j.active() {
+			jobs = append(jobs, *j)
+		}
+	}
+	s.statusMu.Lock()
+	s.status.Schedule = jobs
+	s.statusCond.Broadcast()
+	s.statusMu.Unlock()
+}
+
+// loadSchedule reads the schedule file. A missing file is not an error.
+func (s *Server) loadSchedule() error {
+	if s.scheduleFile == "" {
+		return nil
+	}
+	data, err := ioutil.ReadFile(s.scheduleFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var jobs []*Job
+	if err := json.Unmarshal(data, &jobs); err != nil {
+		return fmt.Errorf("%s: %w", s.scheduleFile, err)
+	}
+	for _, j := range jobs {
+		if j.State == jobRunning {
+			// Restart jobs that were running when the server stopped.
+			j.State = jobPending
+		}
+		if n, err := strconv.Atoi(j.ID); err == nil && n > s.nextJobID {
+			s.nextJobID = n
+		}
+	}
+	s.jobs = jobs
+	s.sortJobs()
+	return nil
+}
+
+// saveSchedule writes the jobs to the schedule file.
+// It must be called with s.mu locked.
+func (s *Server) saveSchedule() error {
+	if s.scheduleFile == "" {
+		return nil
+	}
+	jobs := s.jobs
+	if jobs == nil {
+		jobs = []*Job{}
+	}
+	data, err := json.MarshalIndent(jobs, "", "  ")
+	if err != nil {
+		return err
+	}
+	// Write to a temporary file first so a crash can't leave a truncated schedule.
+	f, err := ioutil.TempFile(filepath.Dir(s.scheduleFile), filepath.Base(s.scheduleFile)+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), s.scheduleFile)
+}
+
+// ScheduleHandler lists jobs (GET) or adds a job (POST).
+func (s *Server) ScheduleHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		s.mu.Lock()
+		jobs := []Job{}
+		for _, j := range s.jobs {
+			jobs = append(jobs, *j)
+		}
+		s.mu.Unlock()
+		writeJSON(w, http.StatusOK, jobs)
+	case http.MethodPost:
+		entry := s.authorizeRequest(w, r, "schedule_add")
+		if entry == nil {
+			return
+		}
+		var job Job
+		dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20))
+		if err := dec.Decode(&job); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		s.mu.Lock()
+		j, err := s.addJob(job)
+		var out Job
+		if j != nil {
+			out = *j
+		}
+		s.mu.Unlock()
+		if j == nil {
+			s.auditRequest(entry, job, err)
+			code := http.StatusBadRequest
+			if errors.Is(err, errJobConflict) {
+				code = http.StatusConflict
+			}
+			http.Error(w, err.Error(), code)
+			return
+		}
+		s.auditRequest(entry, out, nil)
+		if err != nil {
+			log.Printf("saving schedule: %v", err)
+		}
+		writeJSON(w, http.StatusCreated, out)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// JobHandler returns (GET) or cancels (DELETE) a job.
+func (s *Server) JobHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	switch r.Method {
+	case http.MethodGet:
+		s.mu.Lock()
+		j := s.findJob(id)
+		var out Job
+		if j != nil {
+			out = *j
+		}
+		s.mu.Unlock()
+		if j == nil {
+			http.Error(w, "no such job", http.StatusNotFound)
+			return
+		}
+		writeJSON(w, http.StatusOK, out)
+	case http.MethodDelete:
+		entry := s.authorizeRequest(w, r, "schedule_cancel")
+		if entry == nil {
+			return
+		}
+		s.mu.Lock()
+		err := s.cancelJob(id)
+		queued := s.takeAudit()
+		s.mu.Unlock()
+		s.auditRequest(entry, map[string]string{"id": id}, err)
+		s.audit.Record(queued...)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		log.Print(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(data)
+}
+
+func (s *Server) scheduleLoop(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-time.After(scheduleInterval):
+			s.mu.Lock()
+			s.stepSchedule(now)
+			queued := s.takeAudit()
+			s.mu.Unlock()
+			s.audit.Record(queued...)
+		}
+	}
+}
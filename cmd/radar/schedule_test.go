@@ -0,0 +1,48 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pebbe/novas"
+	"github.com/w1xm/rci_interface/cps20"
+)
+
+type fakeAmplidynes struct {
+	enabled bool
+}
+
+func (a *fakeAmplidynes) SetAmplidynesEnabled(enabled bool) error {
+	a.enabled = enabled
+	return nil
+}
+
+func TestJobSpinsUpAmplidynes(t *testing.T) {
+	s := newTestServer()
+	amps := &fakeAmplidynes{}
+	s.cps20 = amps
+	s.status.Amplidynes = &cps20.Status{}
+	s.parkPositions = []ParkPosition{{Name: "stow", Az: 180, El: 45}}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sun := s.addBody(novas.Sun(), "sun", kindSun, "", nil)
+	j := &Job{ID: "1", Start: time.Now(), Duration: 60, Body: BodyRef{ID: sun.id}, Park: true, State: jobPending}
+	s.jobs = []*Job{j}
+
+	s.startJob(j)
+	if j.State != jobRunning {
+		t.Fatalf("job is %s (%s), want running", j.State, j.Error)
+	}
+	if !amps.enabled {
+		t.Error("amplidynes were not enabled when the job started")
+	}
+
+	amps.enabled = false
+	s.endJob(jobDone, "")
+	if s.parking == nil {
+		t.Fatal("antenna was not parked after the job")
+	}
+	if !amps.enabled {
+		t.Error("amplidynes were not enabled to park after the job")
+	}
+}
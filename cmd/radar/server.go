@@ -3,6 +3,8 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
 	"math"
 	"net"
@@ -15,28 +17,81 @@ import (
 	"github.com/pebbe/novas"
 	"github.com/w1xm/rci_interface/cps20"
 	"github.com/w1xm/rci_interface/easycomm"
+	"github.com/w1xm/rci_interface/pointing"
 	"github.com/w1xm/rci_interface/rci"
 	"github.com/w1xm/rci_interface/rotator"
 	"github.com/w1xm/rci_interface/sequencer"
+	"github.com/w1xm/rci_interface/weather"
 )
 
 const spindownDelay = 10 * time.Minute
 
 type AuthorizedClient struct {
 	RemoteAddr string
-	Name       string
+	// Name is the authenticated user, or empty for a shared password or a
+	// local connection without credentials.
+	Name string
+	// Client is the name the client gave for itself.
+	Client string
+	Role   Role
 }
 
 type Status struct {
 	SequenceNumber int
 	rotator.Status
-	LastMoveTime        time.Time
-	Sequencer           sequencer.Status
-	Amplidynes          *cps20.Status
-	CommandTrackingBody int
-	Bodies              []string
+	LastMoveTime time.Time
+	Sequencer    sequencer.Status
+	Amplidynes   *cps20.Status
+	// CommandTrackingBody is the index in Bodies of the body being tracked, or 0.
+	CommandTrackingBody   int
+	CommandTrackingBodyID string
+	Bodies                []string
+	BodyDetails           []BodyInfo
+	// Target describes what is being tracked, including positions that are not in Bodies.
+	Target *TrackTarget
+	// TrackOffsets are applied on top of the position of the tracked body.
+	TrackOffsets TrackOffsets
+	// Avoidance is set if a horizon mask or Sun/Moon exclusion is configured.
+	Avoidance *AvoidanceStatus
+	// Weather describes the conditions used to compute refraction.
+	Weather *WeatherStatus
+	// WrapPlan is set while tracking with a cable wrap.
+	WrapPlan *WrapPlan
+	// TrackPlan describes how the current track handles the zenith keyhole.
+	TrackPlan *TrackPlan
+	// Schedule holds the pending and running jobs.
+	Schedule []Job
+	// ParkPositions are the positions the antenna can be parked at. The first is the default.
+	ParkPositions []ParkPosition
+	// Park is set while the antenna is parking or parked.
+	Park *ParkStatus
+	// Drift is the current or last drift scan.
+	Drift *DriftSession
+	Scan  *ScanStatus
+	// Calibration is set while a pointing calibration is running.
+	Calibration *CalibrationStatus
+	// CalibrationResult is the result of the last pointing calibration.
+	CalibrationResult *CalibrationResult
+	// SatellitePasses holds the next pass of each satellite.
+	SatellitePasses []SatellitePass
+	// TrackMode is "position" or "velocity".
+	TrackMode string
+	// TrackingErrorAz and TrackingErrorEl are the last measured tracking error in velocity mode (degrees).
+	TrackingErrorAz, TrackingErrorEl float64
+	// VelocityLease is held by the client that last commanded a velocity.
+	VelocityLease *VelocityLease
+	// VelocityLeaseHeld is true if the current connection holds the velocity lease.
+	VelocityLeaseHeld bool
+	// EmergencyStop is set while an emergency stop is latched.
+	EmergencyStop *EmergencyStop
+	// Control is held by the client that has taken exclusive control, if any.
+	Control *ControlLock
+	// ControlHeld is true if the current connection holds the control lock.
+	ControlHeld bool
 	// Authorized is true if the current connection is allowed to mutate state.
-	Authorized          bool
+	Authorized bool
+	// Role is the role of the current connection.
+	Role                Role
 	AuthorizedClients   []AuthorizedClient
 	Latitude, Longitude float64
 }
@@ -92,7 +147,10 @@ func (s Status) Clone() Status {
 		s.Status = s.Status.Clone()
 	}
 	s.Bodies = append([]string{}, s.Bodies...)
+	s.BodyDetails = append([]BodyInfo{}, s.BodyDetails...)
+	s.SatellitePasses = append([]SatellitePass{}, s.SatellitePasses...)
 	s.AuthorizedClients = append([]AuthorizedClient{}, s.AuthorizedClients...)
+	s.Schedule = append([]Job{}, s.Schedule...)
 	return s
 }
 
@@ -111,120 +169,446 @@ func (s *Status) RemoveAuthorizedClient(c AuthorizedClient) {
 
 type Server struct {
 	passwords []string
-	place     *novas.Place
-	mu        sync.Mutex
-	r         rotator.Rotator
-	bodies    []*novas.Body
-	seq       *sequencer.Sequencer
-	cps20     *cps20.CPS20
+	// users are the users that may log in, by name.
+	users map[string]User
+	// rotctldRole is the role of rotctld clients.
+	rotctldRole Role
+	// audit records commands, if it is not nil.
+	audit *AuditLog
+	// auditQueue holds entries to record once mu is unlocked. It is guarded by mu.
+	auditQueue []AuditEntry
+	// estop is the latched emergency stop, and estopBands is the number
+	// of bands it has stopped transmitting on. They are guarded by mu.
+	estop      *EmergencyStop
+	estopBands int
+	// place includes the current weather. It is guarded by mu.
+	place *novas.Place
+	// refraction is the refraction model used for topocentric positions. It is guarded by mu.
+	refraction novas.RefractType
+	latitude   float64
+	longitude  float64
+	height     float64
+	mu         sync.Mutex
+	r          rotator.Rotator
+	bodies     []*bodyEntry
+	// reservedIDs are the IDs of saved bodies that are added after the
+	// built-in bodies at startup. Other bodies can't take them.
+	reservedIDs map[string]bool
+	// tracking is the body being tracked, if any. It is guarded by mu.
+	tracking *bodyEntry
+	// trackOffsets are reset whenever the tracked body changes. They are guarded by mu.
+	trackOffsets TrackOffsets
+	stateFile    string
+	// avoid is nil if no forbidden regions are configured.
+	avoid *avoidance
+	// minElevation and maxElevation are the antenna's elevation limits, used for visibility predictions.
+	minElevation, maxElevation float64
+	weatherSource              weather.Source
+	weatherMaxAge              time.Duration
+	// catalog holds entries loaded from catalog files. It is not modified after startup.
+	catalog []*CatalogEntry
+	seq     *sequencer.Sequencer
+	cps20   amplidynes
+	// scan is the active scan, if any. It is guarded by mu.
+	scan *scan
+	// calib is the active pointing calibration, if any. It is guarded by mu.
+	calib *calibration
+	// azOffset and elOffset are the offsets last set on the rotator. They are guarded by mu.
+	azOffset, elOffset float64
+	// power holds recent power samples used for calibration.
+	powerMu sync.Mutex
+	power   []powerSample
+	// wrap is nil if no cable wrap is configured.
+	wrap *rotator.CableWrap
+	// rotType is the type of rotator, which determines the cut of the cable wrap.
+	rotType string
+	// wrapPlan is the cable wrap plan for the body being tracked. It is guarded by mu.
+	wrapPlan *wrapPlan
+	// trackPlan is the zenith keyhole plan for the body being tracked. It is guarded by mu.
+	trackPlan *trackPlan
+	// maxAzRate and maxElRate are the fastest rates (degrees/second) each axis can track at.
+	maxAzRate, maxElRate float64
+	// jobs are the scheduled jobs, sorted by start time, and job is the
+	// running job, if any. jobTracking and jobScan are what the job started,
+	// to notice if a client takes over. They are guarded by mu.
+	jobs         []*Job
+	job          *Job
+	jobTracking  *bodyEntry
+	jobScan      *scan
+	nextJobID    int
+	scheduleFile string
+	// parkPositions are the configured park positions.
+	parkPositions []ParkPosition
+	// parking is the park that was last commanded. It is guarded by mu.
+	parking *ParkStatus
+	// idlePark is the idle time after which the antenna is parked, or 0 to never.
+	idlePark time.Duration
+	// drift is the current or last drift scan. It is guarded by mu.
+	drift *DriftSession
+	// driftLog optionally names a file to record drift scans in.
+	driftLog string
+	// lastDriftID is the ID of the last drift scan. It is guarded by mu.
+	lastDriftID int64
+	// lease is the velocity lease. It is guarded by mu.
+	lease         *VelocityLease
+	leaseDuration time.Duration
+	// control is the control lock. It is guarded by mu.
+	control     *ControlLock
+	lockTimeout time.Duration
+	// traj is the trajectory being followed in velocity mode. It is guarded by mu.
+	traj          *trajectory
+	trackMode     string
+	trackInterval time.Duration
 
 	statusMu   sync.RWMutex
 	statusCond *sync.Cond
 	status     Status
 }
 
-func NewServer(ctx context.Context, rotType, port string, passwords []string, latitude, longitude float64, place *novas.Place, azOffset, elOffset float64, sequencerURL string, sequencerPort string, sequencerBaud int, cps20Port string) (*Server, error) {
+// Config holds the settings used to construct a Server.
+type Config struct {
+	RotatorType         string
+	Port                string
+	Passwords           []string
+	Latitude, Longitude float64
+	// Height is the height of the antenna (meters).
+	Height float64
+	// Temperature (degrees Celsius) and Pressure (millibars) are used for refraction until WeatherSource reports.
+	Temperature, Pressure float64
+	// WeatherSource optionally reports the weather at runtime.
+	WeatherSource weather.Source
+	// WeatherMaxAge is the age after which the weather is reported as stale, or 0 to never.
+	WeatherMaxAge time.Duration
+	// NoRefraction disables refraction corrections.
+	NoRefraction       bool
+	AzOffset, ElOffset float64
+	// PointingModel, if set, is applied to the rotator in place of AzOffset and ElOffset.
+	PointingModel pointing.Model
+	SequencerURL  string
+	SequencerPort string
+	SequencerBaud int
+	CPS20Port     string
+	// TrackMode is "position" to command the target position on every
+	// iteration of the tracking loop, or "velocity" to follow a precomputed
+	// trajectory with velocity commands.
+	TrackMode string
+	// TrackInterval is the period of the tracking loop. If zero, a default for the rotator type is used.
+	TrackInterval time.Duration
+	// TLEFile optionally names a file of satellite element sets to load at startup.
+	TLEFile string
+	// CatalogFiles are loaded at startup and can be searched by name.
+	CatalogFiles []string
+	// StateFile optionally names a file used to save bodies added by clients across restarts.
+	StateFile string
+	// HorizonMaskFile optionally names a file of azimuth and minimum elevation pairs.
+	HorizonMaskFile string
+	// SunRadius and MoonRadius are the minimum distances (degrees) to point from the Sun and Moon, or 0 to disable.
+	SunRadius, MoonRadius float64
+	// MinElevation and MaxElevation are the antenna's elevation limits (degrees).
+	MinElevation, MaxElevation float64
+	// CableWrapMin and CableWrapMax are the limits of azimuth travel counting
+	// turns (degrees), or both 0 if there is no cable wrap.
+	CableWrapMin, CableWrapMax float64
+	// CableWrapVelocity is the speed of moves across north (degrees/second).
+	CableWrapVelocity float64
+	// MaxAzRate and MaxElRate are the fastest rates (degrees/second) each
+	// axis can track at. Faster tracks near the zenith are planned around.
+	MaxAzRate, MaxElRate float64
+	// ScheduleFile optionally names a file used to save scheduled jobs.
+	ScheduleFile string
+	// ParkPositions are the positions the antenna can be parked at. The first is the default.
+	ParkPositions []ParkPosition
+	// IdlePark is the time without commands after which the antenna is
+	// parked at the default position, or 0 to never. With amplidynes, the
+	// antenna is parked before they spin down.
+	IdlePark time.Duration
+	// DriftLog optionally names a file to append a line of JSON to for each drift scan.
+	DriftLog string
+	// SoftLimits are enforced on the positions commanded to the rotator,
+	// after any pointing model is applied.
+	SoftLimits rotator.Limits
+	// MotionLimits override the nonzero motion limits for the rotator type,
+	// and PositionProfiles, if set, overrides whether position moves are
+	// made with velocity profiles.
+	MotionLimits     rotator.MotionLimits
+	PositionProfiles *bool
+	// VelocityLease is how long a velocity command lasts unless the client
+	// renews it, or 0 to only stop when the client disconnects.
+	VelocityLease time.Duration
+	// ControlTimeout is how long the control lock is held after the
+	// holder's last command.
+	ControlTimeout time.Duration
+	// Users are the users that may log in, in addition to the shared Passwords.
+	Users map[string]User
+	// RotctldRole is the role of rotctld clients, which don't authenticate.
+	RotctldRole Role
+	// AuditLog, if set, records the commands sent by clients.
+	AuditLog *AuditLog
+}
+
+func NewServer(ctx context.Context, config Config) (*Server, error) {
+	rotType, port, latitude := config.RotatorType, config.Port, config.Latitude
 	s := &Server{
 		status: Status{
-			Latitude:  latitude,
-			Longitude: longitude,
+			Latitude:      latitude,
+			Longitude:     config.Longitude,
+			TrackMode:     config.TrackMode,
+			ParkPositions: config.ParkPositions,
 		},
-		place:     place,
-		passwords: passwords,
+		place:         novas.NewPlace(latitude, config.Longitude, config.Height, config.Temperature, config.Pressure),
+		refraction:    novas.REFR_PLACE,
+		weatherSource: config.WeatherSource,
+		weatherMaxAge: config.WeatherMaxAge,
+		latitude:      latitude,
+		longitude:     config.Longitude,
+		height:        config.Height,
+		passwords:     config.Passwords,
+		users:         config.Users,
+		rotctldRole:   config.RotctldRole,
+		audit:         config.AuditLog,
+		trackMode:     config.TrackMode,
+		trackInterval: config.TrackInterval,
+		stateFile:     config.StateFile,
+		minElevation:  config.MinElevation,
+		maxElevation:  config.MaxElevation,
+		maxAzRate:     config.MaxAzRate,
+		scheduleFile:  config.ScheduleFile,
+		parkPositions: config.ParkPositions,
+		idlePark:      config.IdlePark,
+		driftLog:      config.DriftLog,
+		leaseDuration: config.VelocityLease,
+		lockTimeout:   config.ControlTimeout,
+		maxElRate:     config.MaxElRate,
+		azOffset:      config.AzOffset,
+		elOffset:      config.ElOffset,
+		rotType:       rotType,
+	}
+	if config.PointingModel != nil {
+		s.azOffset, s.elOffset = config.PointingModel["IA"], config.PointingModel["IE"]
+	}
+	s.status.Weather = &WeatherStatus{
+		Refraction: !config.NoRefraction,
+		Source:     "flags",
+		Conditions: weather.Conditions{
+			Temperature: config.Temperature,
+			Pressure:    config.Pressure,
+		},
+	}
+	if config.NoRefraction {
+		s.refraction = novas.REFR_NONE
+	}
+	switch s.trackMode {
+	case "position":
+	case "velocity":
+		if rotType == "simulatorequ" || rotType == "jlab" {
+			return nil, fmt.Errorf("velocity tracking is not supported by rotator type %q", rotType)
+		}
+	default:
+		return nil, fmt.Errorf("unknown tracking mode %q", s.trackMode)
+	}
+	if s.lockTimeout <= 0 {
+		return nil, fmt.Errorf("control timeout %v must be positive", s.lockTimeout)
+	}
+	if s.trackInterval == 0 {
+		s.trackInterval = defaultTrackIntervals[rotType]
+	}
+	if s.trackInterval <= 0 {
+		s.trackInterval = 250 * time.Millisecond
 	}
 	s.statusCond = sync.NewCond(s.statusMu.RLocker())
 	var r rotator.Rotator
 	var err error
+	if config.HorizonMaskFile != "" || config.SunRadius > 0 || config.MoonRadius > 0 {
+		s.avoid = &avoidance{
+			sunRadius:  config.SunRadius,
+			moonRadius: config.MoonRadius,
+			sun:        novas.Sun(),
+			moon:       novas.Moon(),
+		}
+		if config.HorizonMaskFile != "" {
+			if s.avoid.mask, err = loadHorizonMask(config.HorizonMaskFile); err != nil {
+				return nil, err
+			}
+		}
+		s.status.Avoidance = &AvoidanceStatus{
+			SunRadius:   config.SunRadius,
+			MoonRadius:  config.MoonRadius,
+			HorizonMask: s.avoid.mask,
+		}
+	}
+	// Motion limits apply to the axes of the rotator, inside any coordinate transformation.
+	motion := motionLimits(rotType, config.MotionLimits, config.PositionProfiles)
+	var connect func(cb rotator.StatusCallback) (rotator.Rotator, error)
 	switch rotType {
 	case "rci":
-		r, err = rci.ConnectOffset(ctx, port, s.statusCallback, azOffset, elOffset)
-		if err != nil {
-			return nil, err
-		}
+		connect = shaped(ctx, motion, func(cb rotator.StatusCallback) (rotator.Rotator, error) {
+			if config.PointingModel != nil {
+				// The pointing model's IA and IE terms replace the fixed offsets.
+				return rci.Connect(ctx, port, cb)
+			}
+			return rci.ConnectOffset(ctx, port, cb, config.AzOffset, config.ElOffset)
+		})
 	case "simulator":
-		r, err = easycomm.ConnectSimulator(ctx, s.statusCallback)
-		if err != nil {
-			return nil, err
-		}
+		connect = shaped(ctx, motion, func(cb rotator.StatusCallback) (rotator.Rotator, error) {
+			return easycomm.ConnectSimulator(ctx, cb)
+		})
 	case "simulatorequ":
-		r, err = rotator.NewTransformer(latitude, func(cb rotator.StatusCallback) (rotator.Rotator, error) {
-			r, err := easycomm.ConnectSimulator(ctx, cb)
-			return r, err
-		}, s.statusCallback)
-		if err != nil {
-			return nil, err
+		connect = func(cb rotator.StatusCallback) (rotator.Rotator, error) {
+			return rotator.NewTransformer(latitude, shaped(ctx, motion, func(cb rotator.StatusCallback) (rotator.Rotator, error) {
+				r, err := easycomm.ConnectSimulator(ctx, cb)
+				return r, err
+			}), cb)
 		}
 	case "jlab":
-		r, err = rotator.NewTransformer(latitude, func(cb rotator.StatusCallback) (rotator.Rotator, error) {
-			r, err := easycomm.ConnectTCP(ctx, port, cb)
-			return r, err
-		}, s.statusCallback)
-		if err != nil {
-			return nil, err
+		connect = func(cb rotator.StatusCallback) (rotator.Rotator, error) {
+			return rotator.NewTransformer(latitude, shaped(ctx, motion, func(cb rotator.StatusCallback) (rotator.Rotator, error) {
+				r, err := easycomm.ConnectTCP(ctx, port, cb)
+				return r, err
+			}), cb)
+		}
+	default:
+		return nil, fmt.Errorf("unknown rotator type %q", rotType)
+	}
+	if config.SoftLimits.Az != nil || config.SoftLimits.El != nil {
+		// Stop velocity moves early enough to allow for the shaped deceleration.
+		limits := config.SoftLimits
+		limits.AzDecel, limits.ElDecel = motion.MaxAzAccel, motion.MaxElAccel
+		if rotType == "simulatorequ" || rotType == "jlab" {
+			// The shaped axes are hour angle and declination.
+			limits.AzDecel = math.Min(motion.MaxAzAccel, motion.MaxElAccel)
+			limits.ElDecel = limits.AzDecel
+		}
+		inner := connect
+		connect = func(cb rotator.StatusCallback) (rotator.Rotator, error) {
+			l, err := rotator.NewSoftLimits(limits, inner, cb)
+			if err != nil {
+				return nil, err
+			}
+			return rotator.Expose(l, rotator.InterfacesOf(l.Rotator)), nil
+		}
+	}
+	if config.PointingModel != nil {
+		inner := connect
+		connect = func(cb rotator.StatusCallback) (rotator.Rotator, error) {
+			p, err := pointing.NewRotator(config.PointingModel, inner, cb)
+			if err != nil {
+				return nil, err
+			}
+			// The pointing model has its own index terms.
+			return rotator.Expose(p, rotator.InterfacesOf(p.Rotator)|rotator.OffsetterInterface), nil
 		}
 	}
+	if config.CableWrapMin != 0 || config.CableWrapMax != 0 {
+		if rotType == "simulatorequ" || rotType == "jlab" {
+			return nil, fmt.Errorf("cable wrap is not supported by rotator type %q", rotType)
+		}
+		wrapConfig := rotator.WrapConfig{
+			Min:          config.CableWrapMin,
+			Max:          config.CableWrapMax,
+			Cut:          wrapCut(rotType, s.azOffset),
+			SlewVelocity: config.CableWrapVelocity,
+		}
+		s.wrap, err = rotator.NewCableWrap(wrapConfig, connect, s.statusCallback)
+		if err == nil {
+			r = rotator.Expose(s.wrap, rotator.InterfacesOf(s.wrap.Rotator))
+		}
+	} else {
+		r, err = connect(s.statusCallback)
+	}
+	if err != nil {
+		return nil, err
+	}
 	if r, ok := r.(rotator.Shutdowner); ok {
 		// "Elevation overvelocity" is always okay (ugh).
 		r.SetAcceptableShutdowns(map[uint8]bool{11: true})
 	}
 	s.r = r
-	if sequencerURL != "" {
-		s.seq, err = sequencer.ConnectRemote(ctx, sequencerURL, s.sequencerStatusCallback)
+	if config.SequencerURL != "" {
+		s.seq, err = sequencer.ConnectRemote(ctx, config.SequencerURL, s.sequencerStatusCallback)
 	} else {
-		s.seq, err = sequencer.Connect(ctx, sequencerPort, sequencerBaud, s.sequencerStatusCallback)
+		s.seq, err = sequencer.Connect(ctx, config.SequencerPort, config.SequencerBaud, s.sequencerStatusCallback)
 	}
 	if err != nil {
 		return nil, err
 	}
-	if cps20Port != "" {
+	if config.CPS20Port != "" {
 		s.status.Amplidynes = &cps20.Status{}
-		s.cps20, err = cps20.Connect(ctx, cps20Port, 19200, s.cps20StatusCallback)
+		s.cps20, err = cps20.Connect(ctx, config.CPS20Port, 19200, s.cps20StatusCallback)
 		if err != nil {
 			return nil, err
 		}
 	}
-	s.bodies = []*novas.Body{
-		novas.Sun(),
-		novas.Moon(),
-		novas.Mercury(),
-		novas.Venus(),
-		novas.Mars(),
-		novas.Jupiter(),
-		novas.Saturn(),
-		novas.Uranus(),
-		novas.Neptune(),
-		novas.Pluto(),
-		novas.NewStar(
-			"Polaris", "HR", 424,
-			37.95456067/15, 89.26410897,
-			44.48, -11.85,
-			7.54, -16.42,
-		),
-		novas.NewStar(
-			"Vega", "HR", 7001,
-			279.23473479/15, 38.78368896,
-			200.94, 286.23,
-			130.23, -20.60,
-		),
-		novas.NewStar(
-			"Cygnus A", "W", 57,
-			299.86815263/15, 40.73391583,
-			0, 0,
-			0, 16360,
-		),
+	// Saved bodies keep their IDs, since jobs refer to bodies by ID.
+	saved, err := s.readState()
+	if err != nil {
+		return nil, err
+	}
+	for _, b := range []struct {
+		body *novas.Body
+		kind string
+	}{
+		{novas.Sun(), kindSun},
+		{novas.Moon(), kindMoon},
+		{novas.Mercury(), kindPlanet},
+		{novas.Venus(), kindPlanet},
+		{novas.Mars(), kindPlanet},
+		{novas.Jupiter(), kindPlanet},
+		{novas.Saturn(), kindPlanet},
+		{novas.Uranus(), kindPlanet},
+		{novas.Neptune(), kindPlanet},
+		{novas.Pluto(), kindPlanet},
+	} {
+		s.addBody(b.body, slug(b.body.Name()), b.kind, "", nil)
+	}
+	for _, star := range []Star{
+		{"Polaris", "HR", 424, 37.95456067 / 15, 89.26410897, 44.48, -11.85, 7.54, -16.42},
+		{"Vega", "HR", 7001, 279.23473479 / 15, 38.78368896, 200.94, 286.23, 130.23, -20.60},
+		{"Cygnus A", "W", 57, 299.86815263 / 15, 40.73391583, 0, 0, 0, 16360},
+	} {
+		body, err := newStar(star)
+		if err != nil {
+			return nil, err
+		}
+		s.addBody(body, slug(star.StarName), kindStar, designation(star.Catalog, star.StarNumber), nil)
+	}
+	if config.TLEFile != "" {
+		sats, err := loadTLEFile(config.TLEFile)
+		if err != nil {
+			return nil, err
+		}
+		for _, sat := range sats {
+			s.addBody(&satelliteBody{sat: sat, observer: s.observer()}, slug(sat.Name), kindSatellite, "", nil)
+		}
+	}
+	if err := s.loadState(saved); err != nil {
+		return nil, err
 	}
 	s.updateBodies()
+	if err := s.loadSchedule(); err != nil {
+		return nil, err
+	}
+	s.updateSchedule()
+	for _, path := range config.CatalogFiles {
+		entries, err := loadCatalog(path)
+		if err != nil {
+			return nil, err
+		}
+		s.catalog = append(s.catalog, entries...)
+	}
 	go s.trackLoop(ctx)
-	return s, nil
-}
-
-// updateBodies syncs s.status.Bodies with s.bodies.
-// It must be called with statusMu locked.
-func (s *Server) updateBodies() {
-	s.status.Bodies = []string{"NONE"}
-	for _, b := range s.bodies {
-		s.status.Bodies = append(s.status.Bodies, b.Name())
+	go s.passLoop(ctx)
+	go s.scheduleLoop(ctx)
+	go s.bodyLoop(ctx)
+	if s.weatherSource != nil {
+		name := weatherSourceName(s.weatherSource)
+		if err := s.weatherSource.Start(ctx, func(c weather.Conditions) {
+			s.setWeather(name, c)
+		}); err != nil {
+			return nil, fmt.Errorf("starting weather source: %w", err)
+		}
+		go s.weatherLoop(ctx)
 	}
+	return s, nil
 }
 
 var upgrader = websocket.Upgrader{
@@ -247,16 +631,30 @@ func (s *Server) StatusHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 type Command struct {
-	Command        string  `json:"command"`
-	SequenceNumber int     `json:"seq"`
-	Register       int     `json:"register"`
-	Value          uint16  `json:"value"`
-	Position       float64 `json:"position"`
-	Velocity       float64 `json:"velocity"`
-	Body           int     `json:"body"`
-	Star           *Star   `json:"star"`
-	Band           int     `json:"band"`
-	Enabled        bool    `json:"enabled"`
+	Command        string             `json:"command"`
+	SequenceNumber int                `json:"seq"`
+	Register       int                `json:"register"`
+	Value          uint16             `json:"value"`
+	Position       float64            `json:"position"`
+	Velocity       float64            `json:"velocity"`
+	Body           BodyRef            `json:"body"`
+	Star           *Star              `json:"star"`
+	Scan           *ScanParams        `json:"scan"`
+	Calibration    *CalibrationParams `json:"calibration"`
+	Job            *Job               `json:"job"`
+	Drift          *DriftParams       `json:"drift"`
+	ID             string             `json:"id"`
+	Offsets        *TrackOffsets      `json:"offsets"`
+	TLE            *TLE               `json:"tle"`
+	Name           string             `json:"name"`
+	RA             float64            `json:"ra"`
+	Dec            float64            `json:"dec"`
+	Epoch          float64            `json:"epoch"`
+	L              float64            `json:"l"`
+	B              float64            `json:"b"`
+	Band           int                `json:"band"`
+	Enabled        bool               `json:"enabled"`
+	Reason         string             `json:"reason"`
 }
 
 type Star struct {
@@ -276,36 +674,72 @@ func (s *Server) trackLoop(ctx context.Context) {
 		select {
 		case <-ctx.Done():
 			return
-		case <-time.After(250 * time.Millisecond):
+		case <-time.After(s.trackInterval):
 		}
 		var stopAmplidynes bool
 		s.mu.Lock()
+		s.checkLease()
+		s.expireControl()
+		s.dropEmergencyTX()
+		s.stepPark()
 		s.statusMu.RLock()
-		command := s.status.CommandTrackingBody
-		if s.cps20 != nil {
-			if command == 0 && time.Since(s.status.LastMoveTime) > spindownDelay && (s.status.Amplidynes.CommandAzEnabled || s.status.Amplidynes.CommandElEnabled) {
+		idlePark := s.idleParkDue()
+		if s.cps20 != nil && !idlePark && !s.parkPending() {
+			if s.tracking == nil && s.scan == nil && s.calib == nil && s.lease == nil && !s.drifting() && time.Since(s.status.LastMoveTime) > spindownDelay && (s.status.Amplidynes.CommandAzEnabled || s.status.Amplidynes.CommandElEnabled) {
 				stopAmplidynes = true
 				// N minutes after last movement command, stop the amplidynes.
 			}
 		}
 		s.statusMu.RUnlock()
+		if idlePark {
+			s.parkIdle()
+		}
 		if stopAmplidynes {
 			s.setAmplidynesEnabled(false)
 		}
-		if command > 0 && command <= len(s.bodies) {
-			body := s.bodies[command-1]
-			topo := body.Topo(novas.Now(), s.place, novas.REFR_PLACE)
-			s.r.SetAzimuthPosition(topo.Az)
-			s.r.SetElevationPosition(topo.Alt)
+		if s.tracking != nil {
+			s.trackBody(s.tracking)
+		} else if s.scan != nil {
+			s.stepScan()
+		} else if s.calib != nil {
+			s.stepCalibration()
+		} else {
+			s.stepDrift()
 		}
+		s.guardMotion()
 		s.mu.Unlock()
 	}
 }
 
-func (s *Server) track(body int) {
+// track sets the body to track, and cancels any active scan or calibration.
+// It must be called with s.mu locked.
+func (s *Server) track(body *bodyEntry) {
+	wasTracking := s.tracking != nil
+	s.scan = nil
+	s.calib = nil
+	s.clearWrapPlan()
+	s.clearTrackPlan()
+	s.traj = nil
+	if s.tracking != body {
+		s.trackOffsets = TrackOffsets{}
+	}
+	s.tracking = body
+	s.clearPark()
+	s.clearLease()
+	s.endDrift("interrupted")
 	s.statusMu.Lock()
-	defer s.statusMu.Unlock()
-	s.status.CommandTrackingBody = body
+	s.status.TrackOffsets = s.trackOffsets
+	s.updateBodies()
+	s.status.Scan = nil
+	s.status.Calibration = nil
+	if body != nil {
+		s.status.LastMoveTime = time.Now()
+	}
+	s.statusMu.Unlock()
+	if s.trackMode == "velocity" && wasTracking && body == nil {
+		// Don't leave the axes running at the tracking velocity.
+		s.r.Stop()
+	}
 }
 
 func isLocal(r *http.Request) bool {
@@ -320,28 +754,15 @@ func isLocal(r *http.Request) bool {
 	return false
 }
 
-func (s *Server) isAuth(r *http.Request) (string, bool) {
-	protocols := websocket.Subprotocols(r)
-	if len(protocols) < 1 {
-		return "", false
-	}
-	for _, p := range s.passwords {
-		if p == protocols[0] {
-			return p, true
-		}
-	}
-	return "", false
-}
-
 func (s *Server) StatusSocketHandler(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 
 	var headers http.Header
-	password, auth := s.isAuth(r)
-	if auth {
-		headers = http.Header{"Sec-WebSocket-Protocol": []string{password}}
+	user, role, protocol := s.authenticate(r)
+	if protocol != "" {
+		headers = http.Header{"Sec-WebSocket-Protocol": []string{protocol}}
 	}
 
 	clientName := r.FormValue("client")
@@ -354,13 +775,15 @@ func (s *Server) StatusSocketHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	auth = auth || isLocal(r)
-
-	log.Printf("New client %q from %q, highres: %v throttle: %v", clientName, r.RemoteAddr, highres, throttle)
+	// auth is true if the client may move the antenna.
+	auth := role >= RoleObserver
+	log.Printf("New client %q (user %q, role %v) from %q, highres: %v throttle: %v", clientName, user, role, r.RemoteAddr, highres, throttle)
 
 	authClient := AuthorizedClient{
 		RemoteAddr: r.RemoteAddr,
-		Name:       clientName,
+		Name:       user,
+		Client:     clientName,
+		Role:       role,
 	}
 
 	if auth {
@@ -375,13 +798,22 @@ func (s *Server) StatusSocketHandler(w http.ResponseWriter, r *http.Request) {
 	// Read and process incoming messages
 	go func() {
 		defer func() {
+			s.mu.Lock()
+			s.releaseLease("websocket", r.RemoteAddr)
+			s.releaseControl("websocket", r.RemoteAddr)
+			s.mu.Unlock()
 			s.statusMu.Lock()
 			defer s.statusMu.Unlock()
 			s.status.RemoveAuthorizedClient(authClient)
 		}()
 		for {
+			var raw json.RawMessage
 			var msg Command
-			if err := conn.ReadJSON(&msg); err != nil {
+			err := conn.ReadJSON(&raw)
+			if err == nil {
+				err = json.Unmarshal(raw, &msg)
+			}
+			if err != nil {
 				log.Printf("parsing json: %v", err)
 				cancel()
 				conn.Close()
@@ -391,74 +823,49 @@ func (s *Server) StatusSocketHandler(w http.ResponseWriter, r *http.Request) {
 				t.Ack(msg.SequenceNumber)
 				continue
 			}
-			if !auth {
-				log.Printf("Unauthenticated connection tried to %+v", msg)
+			entry := AuditEntry{
+				Surface:    "websocket",
+				User:       user,
+				Client:     clientName,
+				Role:       role,
+				RemoteAddr: r.RemoteAddr,
+				Command:    msg.Command,
+				Args:       raw,
+			}
+			if need := requiredRole(commandRoles, msg.Command); role < need {
+				log.Printf("Client %q (user %q, role %v) from %q needs role %v to %+v", clientName, user, role, r.RemoteAddr, need, msg)
+				entry.Outcome, entry.Error = "refused", fmt.Sprintf("role %v is needed", need)
+				s.audit.Record(entry)
 				continue
 			}
 			s.mu.Lock()
-			s.setAmplidynesEnabled(true)
-			switch msg.Command {
-			case "track":
-				s.track(msg.Body)
-			case "write":
-				if r, ok := s.r.(rotator.Writer); ok {
-					r.Write(msg.Register, msg.Value)
-				}
-			case "set_azimuth_position":
-				s.track(0)
-				s.r.SetAzimuthPosition(clampAngle(msg.Position))
-			case "set_elevation_position":
-				s.track(0)
-				s.r.SetElevationPosition(clampAngle(msg.Position))
-			case "set_azimuth_velocity":
-				s.track(0)
-				s.r.SetAzimuthVelocity(msg.Velocity)
-			case "set_elevation_velocity":
-				s.track(0)
-				s.r.SetElevationVelocity(msg.Velocity)
-			case "stop":
-				s.track(0)
-				s.r.Stop()
-			case "stop_hard":
-				s.track(0)
-				s.r.SetAzimuthVelocity(0)
-				s.r.SetElevationVelocity(0)
-			case "exit_shutdown":
-				if r, ok := s.r.(rotator.Shutdowner); ok {
-					r.ExitShutdown()
-				}
-			case "set_azimuth_offset":
-				if r, ok := s.r.(rotator.Offsetter); ok {
-					r.SetAzimuthOffset(msg.Position)
-				}
-			case "set_elevation_offset":
-				if r, ok := s.r.(rotator.Offsetter); ok {
-					r.SetElevationOffset(msg.Position)
-				}
-			case "add_star":
-				s.statusMu.Lock()
-				s.bodies = append(s.bodies, novas.NewStar(
-					msg.Star.StarName,
-					msg.Star.Catalog,
-					msg.Star.StarNumber,
-					msg.Star.RA,
-					msg.Star.Dec,
-					msg.Star.ProMoRA,
-					msg.Star.ProMoDec,
-					msg.Star.Parallax,
-					msg.Star.RadialVelocity))
-				s.updateBodies()
-				s.statusMu.Unlock()
-			case "set_band_tx":
-				s.seq.SetBandTX(msg.Band, msg.Enabled)
-			case "set_band_rx":
-				// Cancel TX
-				s.seq.SetBandTX(msg.Band, false)
-				s.seq.SetBandRX(msg.Band, msg.Enabled)
-			default:
-				log.Printf("Unknown command: %+v", msg)
+			if !uncontrolledCommands[msg.Command] {
+				err = s.checkControl("websocket", r.RemoteAddr)
 			}
+			if err == nil && estopRefused[msg.Command] {
+				err = s.checkEmergencyStop()
+			}
+			if err != nil {
+				s.mu.Unlock()
+				log.Printf("%s: %v", msg.Command, err)
+				entry.Outcome, entry.Error = "refused", err.Error()
+				s.audit.Record(entry)
+				continue
+			}
+			if movingCommands[msg.Command] {
+				s.setAmplidynesEnabled(true)
+			}
+			err = s.runCommand(msg, authClient)
+			queued := s.takeAudit()
 			s.mu.Unlock()
+			if err != nil {
+				log.Printf("%s: %v", msg.Command, err)
+			}
+			if !unauditedCommands[msg.Command] {
+				entry.Outcome, entry.Error = auditOutcome(err)
+				s.audit.Record(entry)
+			}
+			s.audit.Record(queued...)
 		}
 	}()
 
@@ -468,6 +875,9 @@ func (s *Server) StatusSocketHandler(w http.ResponseWriter, r *http.Request) {
 		status.SequenceNumber = seq
 		seq++
 		status.Authorized = auth
+		status.Role = role
+		status.VelocityLeaseHeld = status.VelocityLease != nil && status.VelocityLease.Source == "websocket" && status.VelocityLease.RemoteAddr == r.RemoteAddr
+		status.ControlHeld = status.Control != nil && status.Control.Source == "websocket" && status.Control.RemoteAddr == r.RemoteAddr
 		data, err := json.Marshal(status)
 		if err != nil {
 			log.Print(err)
@@ -521,6 +931,162 @@ func (s *Server) StatusSocketHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// runCommand runs a command from a websocket client.
+// It must be called with s.mu locked.
+func (s *Server) runCommand(msg Command, client AuthorizedClient) error {
+	remoteAddr := client.RemoteAddr
+	// name identifies the client to others.
+	name := client.Name
+	if name == "" {
+		name = client.Client
+	}
+	switch msg.Command {
+	case "track":
+		body, err := s.lookupBody(msg.Body)
+		if err != nil {
+			return err
+		}
+		s.track(body)
+	case "track_radec":
+		return s.trackRadec(msg.RA, msg.Dec, msg.Epoch)
+	case "track_galactic":
+		return s.trackGalactic(msg.L, msg.B)
+	case "set_track_offsets":
+		if msg.Offsets == nil {
+			return errors.New("missing offsets")
+		}
+		return s.setTrackOffsets(*msg.Offsets)
+	case "scan":
+		if msg.Scan == nil {
+			return errors.New("missing parameters")
+		}
+		return s.startScan(*msg.Scan)
+	case "calibrate":
+		if msg.Calibration == nil {
+			return errors.New("missing parameters")
+		}
+		return s.startCalibration(*msg.Calibration)
+	case "drift_scan":
+		if msg.Drift == nil {
+			return errors.New("missing parameters")
+		}
+		return s.startDrift(*msg.Drift)
+	case "write":
+		r, ok := s.r.(rotator.Writer)
+		if !ok {
+			return errors.New("rotator has no registers")
+		}
+		r.Write(msg.Register, msg.Value)
+	case "set_azimuth_position":
+		s.track(nil)
+		return s.moveAzimuth("websocket", clampAngle(msg.Position))
+	case "set_elevation_position":
+		s.track(nil)
+		return s.moveElevation("websocket", clampAngle(msg.Position))
+	case "set_azimuth_velocity":
+		s.track(nil)
+		if err := s.setVelocity("websocket", msg.Velocity, 0, true, false); err != nil {
+			return err
+		}
+		s.takeLease("websocket", remoteAddr, name)
+	case "set_elevation_velocity":
+		s.track(nil)
+		if err := s.setVelocity("websocket", 0, msg.Velocity, false, true); err != nil {
+			return err
+		}
+		s.takeLease("websocket", remoteAddr, name)
+	case "renew_lease":
+		s.renewLease("websocket", remoteAddr)
+	case "take_control":
+		return s.takeControl("websocket", remoteAddr, name, false)
+	case "steal_control":
+		return s.takeControl("websocket", remoteAddr, name, true)
+	case "release_control":
+		s.releaseControl("websocket", remoteAddr)
+	case "park":
+		return s.park("websocket", msg.Name)
+	case "stop":
+		s.track(nil)
+		s.r.Stop()
+	case "stop_hard":
+		s.track(nil)
+		s.r.SetAzimuthVelocity(0)
+		s.r.SetElevationVelocity(0)
+	case "emergency_stop":
+		s.emergencyStop(EmergencyStop{Source: "websocket", User: client.Name, RemoteAddr: remoteAddr, Reason: msg.Reason})
+	case "reset_emergency_stop":
+		return s.resetEmergencyStop("websocket", client.Name, remoteAddr)
+	case "exit_shutdown":
+		r, ok := s.r.(rotator.Shutdowner)
+		if !ok {
+			return errors.New("rotator has no shutdowns")
+		}
+		r.ExitShutdown()
+	case "set_cable_wrap":
+		if s.wrap == nil {
+			return errors.New("no cable wrap is configured")
+		}
+		err := s.wrap.SetWrap(msg.Position)
+		s.clearWrapPlan()
+		return err
+	case "set_refraction":
+		s.setRefraction(msg.Enabled)
+	case "set_azimuth_offset":
+		r, ok := s.r.(rotator.Offsetter)
+		if !ok {
+			return errors.New("rotator has no offsets")
+		}
+		s.setOffsets(r, msg.Position, s.elOffset)
+	case "set_elevation_offset":
+		r, ok := s.r.(rotator.Offsetter)
+		if !ok {
+			return errors.New("rotator has no offsets")
+		}
+		s.setOffsets(r, s.azOffset, msg.Position)
+	case "add_star":
+		if msg.Star == nil {
+			return errors.New("missing star")
+		}
+		return s.addUserBody(savedBody{Star: msg.Star})
+	case "add_catalog":
+		return s.addCatalogEntry(msg.Name)
+	case "add_tle":
+		if msg.TLE == nil {
+			return errors.New("missing element set")
+		}
+		return s.addTLE(*msg.TLE)
+	case "remove_body":
+		return s.removeBody(msg.Body)
+	case "rename_body":
+		return s.renameBody(msg.Body, msg.Name)
+	case "schedule_add":
+		if msg.Job == nil {
+			return errors.New("missing job")
+		}
+		_, err := s.addJob(*msg.Job)
+		return err
+	case "schedule_cancel":
+		return s.cancelJob(msg.ID)
+	case "set_band_tx":
+		if s.seq == nil {
+			return errors.New("no sequencer is connected")
+		}
+		return s.seq.SetBandTX(msg.Band, msg.Enabled)
+	case "set_band_rx":
+		if s.seq == nil {
+			return errors.New("no sequencer is connected")
+		}
+		// Cancel TX
+		if err := s.seq.SetBandTX(msg.Band, false); err != nil {
+			return err
+		}
+		return s.seq.SetBandRX(msg.Band, msg.Enabled)
+	default:
+		return errors.New("unknown command")
+	}
+	return nil
+}
+
 type ThrottledTimer struct {
 	period   time.Duration
 	throttle bool
@@ -583,14 +1149,47 @@ func (s *Server) cps20StatusCallback(status cps20.Status) {
 	s.statusCond.Broadcast()
 }
 
+// movingCommands are the websocket commands that move the antenna, which
+// spin up the amplidynes.
+var movingCommands = map[string]bool{
+	"track":                  true,
+	"track_radec":            true,
+	"track_galactic":         true,
+	"set_track_offsets":      true,
+	"scan":                   true,
+	"calibrate":              true,
+	"drift_scan":             true,
+	"write":                  true,
+	"set_azimuth_position":   true,
+	"set_elevation_position": true,
+	"set_azimuth_velocity":   true,
+	"set_elevation_velocity": true,
+	"park":                   true,
+}
+
+// noteMove records that the antenna was commanded to move, which delays
+// spinning down the amplidynes and parking an idle antenna.
+// It must be called with s.mu locked.
+func (s *Server) noteMove() {
+	s.statusMu.Lock()
+	s.status.LastMoveTime = time.Now()
+	s.statusMu.Unlock()
+}
+
+// amplidynes switches the amplidynes on and off. *cps20.CPS20 implements it.
+type amplidynes interface {
+	SetAmplidynesEnabled(enabled bool) error
+}
+
 func (s *Server) setAmplidynesEnabled(enabled bool) {
+	if enabled && s.estop != nil {
+		// Stay spun down until the emergency stop is reset.
+		return
+	}
 	if s.cps20 == nil {
 		return
 	}
 	if enabled {
-		s.statusMu.Lock()
-		s.status.LastMoveTime = time.Now()
-		s.statusMu.Unlock()
 		s.cps20.SetAmplidynesEnabled(true)
 		// Confirmation path will enable RCI
 	} else {
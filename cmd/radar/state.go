@@ -0,0 +1,222 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/w1xm/rci_interface/satellite"
+)
+
+// savedBody records how a user-added body was created, so it can be recreated after a restart.
+type savedBody struct {
+	ID   string `json:"id"`
+	Star *Star  `json:"star,omitempty"`
+	TLE  *TLE   `json:"tle,omitempty"`
+}
+
+// savedState is the contents of the state file.
+type savedState struct {
+	Bodies []savedBody `json:"bodies"`
+}
+
+// newBody creates the body described by sb, and returns it along with its kind and catalog designation.
+func (s *Server) newBody(sb savedBody) (Body, string, string, error) {
+	switch {
+	case sb.Star != nil:
+		body, err := newStar(*sb.Star)
+		if err != nil {
+			return nil, "", "", err
+		}
+		return body, kindStar, designation(sb.Star.Catalog, sb.Star.StarNumber), nil
+	case sb.TLE != nil:
+		sat, err := satellite.Parse(sb.TLE.Name, sb.TLE.Line1, sb.TLE.Line2)
+		if err != nil {
+			return nil, "", "", err
+		}
+		return &satelliteBody{sat: sat, observer: s.observer()}, kindSatellite, "", nil
+	}
+	return nil, "", "", errors.New("saved body has no star or TLE")
+}
+
+// addSavedBody creates a body from sb and adds it to the list of bodies.
+// If sb has no ID, one is derived from the body's name.
+// It must be called with statusMu locked, or before the server is started.
+func (s *Server) addSavedBody(sb savedBody) (*bodyEntry, error) {
+	body, kind, catalog, err := s.newBody(sb)
+	if err != nil {
+		return nil, err
+	}
+	if sb.ID == "" {
+		sb.ID = slug(body.Name())
+	}
+	b := s.addBody(body, sb.ID, kind, catalog, &sb)
+	sb.ID = b.id
+	return b, nil
+}
+
+// addUserBody adds a body on behalf of a client and saves the state file.
+// It must be called with s.mu locked.
+func (s *Server) addUserBody(sb savedBody) error {
+	sb.ID = ""
+	s.statusMu.Lock()
+	_, err := s.addSavedBody(sb)
+	if err == nil {
+		s.updateBodies()
+	}
+	s.statusMu.Unlock()
+	if err != nil {
+		return err
+	}
+	if sb.TLE != nil {
+		go s.updatePasses()
+	}
+	go s.updateBodyPositions()
+	return s.saveState()
+}
+
+// userBody returns the body referred to by ref, which must have been added by a user.
+// It must be called with s.mu locked.
+func (s *Server) userBody(ref BodyRef) (*bodyEntry, error) {
+	b, err := s.lookupBody(ref)
+	if err != nil {
+		return nil, err
+	}
+	if b == nil {
+		return nil, errors.New("no body specified")
+	}
+	if b.saved == nil {
+		return nil, fmt.Errorf("body %s (%s) was not added by a user", b.id, b.Name())
+	}
+	return b, nil
+}
+
+// removeBody removes a user-added body.
+// It must be called with s.mu locked.
+func (s *Server) removeBody(ref BodyRef) error {
+	b, err := s.userBody(ref)
+	if err != nil {
+		return err
+	}
+	if s.tracking == b {
+		s.track(nil)
+	}
+	index := s.bodyIndex(b)
+	s.statusMu.Lock()
+	s.bodies = append(s.bodies[:index-1:index-1], s.bodies[index:]...)
+	s.updateBodies()
+	s.statusMu.Unlock()
+	go s.updatePasses()
+	return s.saveState()
+}
+
+// renameBody changes the name of a user-added body. Its ID does not change.
+// It must be called with s.mu locked.
+func (s *Server) renameBody(ref BodyRef, name string) error {
+	b, err := s.userBody(ref)
+	if err != nil {
+		return err
+	}
+	if name == "" {
+		return errors.New("name is required")
+	}
+	sb := *b.saved
+	switch {
+	case sb.Star != nil:
+		star := *sb.Star
+		star.StarName = name
+		sb.Star = &star
+	case sb.TLE != nil:
+		tle := *sb.TLE
+		tle.Name = name
+		sb.TLE = &tle
+	}
+	body, _, _, err := s.newBody(sb)
+	if err != nil {
+		return err
+	}
+	s.statusMu.Lock()
+	// Replace the body in place so that anything tracking it follows the rename.
+	b.Body = body
+	b.saved = &sb
+	s.updateBodies()
+	s.statusMu.Unlock()
+	s.traj = nil
+	go s.updatePasses()
+	return s.saveState()
+}
+
+// readState returns the bodies saved in the state file, and reserves their
+// IDs so that bodies added before them don't take them. A missing file is
+// not an error.
+func (s *Server) readState() ([]savedBody, error) {
+	if s.stateFile == "" {
+		return nil, nil
+	}
+	data, err := ioutil.ReadFile(s.stateFile)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var state savedState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("%s: %w", s.stateFile, err)
+	}
+	s.reservedIDs = make(map[string]bool)
+	for _, sb := range state.Bodies {
+		if sb.ID != "" {
+			s.reservedIDs[sb.ID] = true
+		}
+	}
+	return state.Bodies, nil
+}
+
+// loadState adds the bodies returned by readState.
+func (s *Server) loadState(bodies []savedBody) error {
+	for i, sb := range bodies {
+		delete(s.reservedIDs, sb.ID)
+		if _, err := s.addSavedBody(sb); err != nil {
+			return fmt.Errorf("%s: body %d: %w", s.stateFile, i, err)
+		}
+	}
+	s.reservedIDs = nil
+	return nil
+}
+
+// saveState writes the user-added bodies to the state file.
+// It must be called with s.mu locked.
+func (s *Server) saveState() error {
+	if s.stateFile == "" {
+		return nil
+	}
+	state := savedState{Bodies: []savedBody{}}
+	for _, b := range s.bodies {
+		if b.saved != nil {
+			state.Bodies = append(state.Bodies, *b.saved)
+		}
+	}
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	// Write to a temporary file first so a crash can't leave a truncated state file.
+	f, err := ioutil.TempFile(filepath.Dir(s.stateFile), filepath.Base(s.stateFile)+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), s.stateFile)
+}
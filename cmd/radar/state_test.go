@@ -0,0 +1,50 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestSavedBodiesKeepIDs(t *testing.T) {
+	iss := TLE{
+		Name:  "ISS (ZARYA)",
+		Line1: "1 25544U 98067A   21275.52543210  .00001264  00000-0  31621-4 0  9993",
+		Line2: "2 25544  51.6442 194.5016 0004209  34.6573  76.3469 15.48866640305471",
+	}
+	data, err := json.Marshal(savedState{Bodies: []savedBody{{ID: "iss-zarya", TLE: &iss}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newTestServer()
+	s.stateFile = filepath.Join(t.TempDir(), "state.json")
+	if err := ioutil.WriteFile(s.stateFile, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	saved, err := s.readState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A TLE file loaded at startup has a satellite with the same name.
+	body, _, _, err := s.newBody(savedBody{TLE: &iss})
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded := s.addBody(body, slug(body.Name()), kindSatellite, "", nil)
+	if err := s.loadState(saved); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := s.lookupBody(BodyRef{ID: "iss-zarya"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.saved == nil {
+		t.Errorf("ID iss-zarya refers to the body from the TLE file, want the saved body")
+	}
+	if loaded.id == "iss-zarya" {
+		t.Errorf("body from the TLE file took the saved body's ID")
+	}
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/pebbe/novas"
+)
+
+const (
+	// trajectoryStep is the spacing between precomputed trajectory samples.
+	trajectoryStep = 1 * time.Second
+	// trajectorySpan is how far ahead the trajectory is computed.
+	trajectorySpan = 60 * time.Second
+	// trackGain is the proportional gain (1/s) used to correct tracking error in velocity mode.
+	trackGain = 0.5
+	// slewThreshold is the tracking error (degrees) above which velocity mode slews using position commands.
+	slewThreshold = 1.0
+	// maxTrackOffset limits the magnitude of tracking offsets (degrees).
+	maxTrackOffset = 30.0
+	// maxTrackVelocity limits velocity commands issued while tracking (degrees/second).
+	maxTrackVelocity = 10.0
+)
+
+// defaultTrackIntervals are the tracking loop periods for each rotator type.
+var defaultTrackIntervals = map[string]time.Duration{
+	"rci":          100 * time.Millisecond,
+	"simulator":    250 * time.Millisecond,
+	"simulatorequ": 250 * time.Millisecond,
+	"jlab":         1 * time.Second,
+}
+
+// TrackOffsets are offsets applied to the position of the tracked body.
+// All offsets are in degrees on the sky.
+type TrackOffsets struct {
+	Xel float64 `json:"xel"`
+	El  float64 `json:"el"`
+	RA  float64 `json:"ra"`
+	Dec float64 `json:"dec"`
+}
+
+// apply returns az/el with the offsets applied. RA/Dec offsets are applied first.
+func (o TrackOffsets) apply(az, el, latitude float64) (float64, float64) {
+	if o.RA != 0 || o.Dec != 0 {
+		az, el = offsetRadec(az, el, o.RA, o.Dec, latitude)
+	}
+	if o.Xel != 0 || o.El != 0 {
+		az, el = offsetXel(az, el, o.Xel, o.El)
+	}
+	return az, el
+}
+
+// trajectory is a precomputed topocentric track of a body.
+type trajectory struct {
+	body    Body
+	offsets TrackOffsets
+	start   time.Time
+	// az is unwrapped so that it can be interpolated across north.
+	az, el []float64
+}
+
+func newTrajectory(body Body, offsets TrackOffsets, plan *trackPlan, place *novas.Place, refr novas.RefractType, latitude float64, start time.Time) *trajectory {
+	t := &trajectory{body: body, offsets: offsets, start: start}
+	n := int(trajectorySpan/trajectoryStep) + 1
+	for i := 0; i < n; i++ {
+		tm := novas.Now()
+		tm.Time = start.Add(time.Duration(i) * trajectoryStep)
+		topo := bodyTopo(body, tm, place, refr)
+		az, el := offsets.apply(topo.Az, topo.Alt, latitude)
+		if plan != nil && plan.body == body {
+			az, el = plan.adjust(tm.Time, az, el)
+		}
+		if i > 0 {
+			prev := t.az[i-1]
+			az = prev + math.Remainder(az-prev, 360)
+		}
+		t.az = append(t.az, az)
+		t.el = append(t.el, el)
+	}
+	return t
+}
+
+// at returns the interpolated position (degrees) and velocity (degrees/second) at tm.
+// ok is false if tm is outside of the precomputed span.
+func (t *trajectory) at(tm time.Time) (az, el, azVel, elVel float64, ok bool) {
+	offset := tm.Sub(t.start)
+	i := int(offset / trajectoryStep)
+	if offset < 0 || i+1 >= len(t.az) {
+		return 0, 0, 0, 0, false
+	}
+	frac := float64(offset-time.Duration(i)*trajectoryStep) / float64(trajectoryStep)
+	azVel = (t.az[i+1] - t.az[i]) / trajectoryStep.Seconds()
+	elVel = (t.el[i+1] - t.el[i]) / trajectoryStep.Seconds()
+	az = clampAngle(t.az[i] + frac*(t.az[i+1]-t.az[i]))
+	el = t.el[i] + frac*(t.el[i+1]-t.el[i])
+	return az, el, azVel, elVel, true
+}
+
+func clampVelocity(v float64) float64 {
+	return math.Max(-maxTrackVelocity, math.Min(maxTrackVelocity, v))
+}
+
+// trackBody commands the rotator to follow body.
+// It must be called with s.mu locked.
+func (s *Server) trackBody(body Body) {
+	now := time.Now()
+	s.planTrack(body)
+	s.planWrap(body)
+	if s.trackMode != "velocity" {
+		topo := bodyTopo(body, novas.Now(), s.place, s.refraction)
+		if math.IsNaN(topo.Az) || math.IsNaN(topo.Alt) {
+			return
+		}
+		az, el := s.trackOffsets.apply(topo.Az, topo.Alt, s.latitude)
+		az, el = s.adjustTrack(body, now, az, el)
+		s.moveTo("tracking", az, el)
+		return
+	}
+	if s.traj == nil || s.traj.body != body || s.traj.offsets != s.trackOffsets || now.Add(s.trackInterval).Sub(s.traj.start) >= trajectorySpan {
+		s.traj = newTrajectory(body, s.trackOffsets, s.trackPlan, s.place, s.refraction, s.latitude, now)
+	}
+	az, el, azVel, elVel, ok := s.traj.at(now)
+	if !ok || math.IsNaN(az) || math.IsNaN(azVel) || math.IsNaN(el) || math.IsNaN(elVel) {
+		s.traj = nil
+		return
+	}
+	s.statusMu.RLock()
+	var curAz, curEl float64
+	if s.status.Status != nil {
+		curAz, curEl = s.status.AzimuthPosition(), s.status.ElevationPosition()
+	}
+	s.statusMu.RUnlock()
+
+	errAz := math.Remainder(az-curAz, 360)
+	errEl := el - curEl
+	s.statusMu.Lock()
+	s.status.TrackingErrorAz = errAz
+	s.status.TrackingErrorEl = errEl
+	s.statusMu.Unlock()
+
+	if math.Abs(errAz) > slewThreshold || math.Abs(errEl) > slewThreshold {
+		// Too far away to follow; slew to where the body will be.
+		s.moveTo("tracking", az, el)
+		return
+	}
+	if err := s.setVelocity("tracking", clampVelocity(azVel+trackGain*errAz), clampVelocity(elVel+trackGain*errEl), true, true); err != nil {
+		// Don't leave the axes running at the previous velocity.
+		s.r.Stop()
+	}
+}
+
+// TrackTarget describes what is being tracked.
+type TrackTarget struct {
+	// Frame is "body", "radec", or "galactic".
+	Frame string
+	Name  string
+	// BodyID is set when tracking a body.
+	BodyID string `json:",omitempty"`
+	// Coordinates is set when tracking a position on the sky.
+	Coordinates *TargetCoordinates `json:",omitempty"`
+}
+
+type TargetCoordinates struct {
+	// RA (hours), Dec (degrees), and Epoch (Julian years) are set for the "radec" frame.
+	RA, Dec, Epoch float64
+	// L and B are the galactic longitude and latitude (degrees) for the "galactic" frame.
+	L, B float64
+	// RAJ2000 and DecJ2000 are the coordinates being tracked.
+	RAJ2000, DecJ2000 float64
+}
+
+// newCoordinateTarget returns a body that is fixed at the given J2000 coordinates.
+// It is not added to the list of bodies.
+func newCoordinateTarget(frame, name string, coords TargetCoordinates) (*bodyEntry, error) {
+	body, err := newStar(Star{
+		StarName: name,
+		RA:       coords.RAJ2000,
+		Dec:      coords.DecJ2000,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &bodyEntry{
+		Body: body,
+		kind: frame,
+		target: &TrackTarget{
+			Frame:       frame,
+			Name:        name,
+			Coordinates: &coords,
+		},
+	}, nil
+}
+
+// trackRadec tracks a fixed position given in equatorial coordinates.
+// ra is in hours, dec in degrees, and epoch is the Julian year of the equinox (0 for J2000).
+// It must be called with s.mu locked.
+func (s *Server) trackRadec(ra, dec, epoch float64) error {
+	if epoch == 0 {
+		epoch = 2000
+	}
+	if ra < 0 || ra >= 24 || dec < -90 || dec > 90 {
+		return fmt.Errorf("coordinates %v, %v out of range", ra, dec)
+	}
+	coords := TargetCoordinates{RA: ra, Dec: dec, Epoch: epoch}
+	coords.RAJ2000, coords.DecJ2000 = precessToJ2000(ra, dec, epoch)
+	name := fmt.Sprintf("RA %.4fh Dec %+.3f (J%g)", ra, dec, epoch)
+	b, err := newCoordinateTarget("radec", name, coords)
+	if err != nil {
+		return err
+	}
+	s.track(b)
+	return nil
+}
+
+// trackGalactic tracks a fixed position given in galactic coordinates (degrees).
+// It must be called with s.mu locked.
+func (s *Server) trackGalactic(l, b float64) error {
+	if b < -90 || b > 90 {
+		return fmt.Errorf("galactic latitude %v out of range", b)
+	}
+	l = clampAngle(l)
+	coords := TargetCoordinates{L: l, B: b}
+	coords.RAJ2000, coords.DecJ2000 = galacticToICRS(l, b)
+	name := fmt.Sprintf("l %.3f b %+.3f", l, b)
+	target, err := newCoordinateTarget("galactic", name, coords)
+	if err != nil {
+		return err
+	}
+	s.track(target)
+	return nil
+}
+
+// setTrackOffsets sets the offsets applied to the tracked body.
+// It must be called with s.mu locked.
+func (s *Server) setTrackOffsets(o TrackOffsets) error {
+	for _, v := range []float64{o.Xel, o.El, o.RA, o.Dec} {
+		if math.IsNaN(v) || math.Abs(v) > maxTrackOffset {
+			return fmt.Errorf("offsets %+v out of range", o)
+		}
+	}
+	s.trackOffsets = o
+	s.statusMu.Lock()
+	s.status.TrackOffsets = o
+	s.statusCond.Broadcast()
+	s.statusMu.Unlock()
+	return nil
+}
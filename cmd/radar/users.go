@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/gorilla/websocket"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Role is a level of access. Each role may do everything the roles before it may.
+type Role int
+
+const (
+	// RoleNone is an unauthenticated client, which can only watch.
+	RoleNone Role = iota
+	// RoleViewer can only watch.
+	RoleViewer
+	// RoleObserver can move the antenna and manage bodies and the schedule.
+	RoleObserver
+	// RoleOperator can also change the pointing corrections, the cable wrap
+	// and the transmitter.
+	RoleOperator
+	// RoleAdmin can also write raw registers, clear shutdowns and steal control.
+	RoleAdmin
+)
+
+var roleNames = []string{"none", "viewer", "observer", "operator", "admin"}
+
+func (r Role) String() string {
+	if r < 0 || int(r) >= len(roleNames) {
+		return fmt.Sprintf("Role(%d)", int(r))
+	}
+	return roleNames[r]
+}
+
+func (r Role) MarshalText() ([]byte, error) {
+	return []byte(r.String()), nil
+}
+
+func (r *Role) UnmarshalText(text []byte) error {
+	role, err := ParseRole(string(text))
+	if err != nil {
+		return err
+	}
+	*r = role
+	return nil
+}
+
+// ParseRole returns the role with the given name.
+func ParseRole(name string) (Role, error) {
+	for i, n := range roleNames {
+		if n == name {
+			return Role(i), nil
+		}
+	}
+	return RoleNone, fmt.Errorf("unknown role %q", name)
+}
+
+// legacyRole is the role of clients that authenticate with a shared password.
+// They could do everything before there were roles.
+const legacyRole = RoleAdmin
+
+// commandRoles is the role needed for each websocket command. Commands that
+// aren't listed need RoleAdmin.
+var commandRoles = map[string]Role{
+	"track":                  RoleObserver,
+	"track_radec":            RoleObserver,
+	"track_galactic":         RoleObserver,
+	"set_track_offsets":      RoleObserver,
+	"scan":                   RoleObserver,
+	"drift_scan":             RoleObserver,
+	"set_azimuth_position":   RoleObserver,
+	"set_elevation_position": RoleObserver,
+	"set_azimuth_velocity":   RoleObserver,
+	"set_elevation_velocity": RoleObserver,
+	"renew_lease":            RoleObserver,
+	"park":                   RoleObserver,
+	"stop":                   RoleObserver,
+	"emergency_stop":         RoleObserver,
+	"take_control":           RoleObserver,
+	"release_control":        RoleObserver,
+	"add_star":               RoleObserver,
+	"add_catalog":            RoleObserver,
+	"add_tle":                RoleObserver,
+	"remove_body":            RoleObserver,
+	"rename_body":            RoleObserver,
+	"schedule_add":           RoleObserver,
+	"schedule_cancel":        RoleObserver,
+	"calibrate":              RoleOperator,
+	"stop_hard":              RoleOperator,
+	"reset_emergency_stop":   RoleOperator,
+	"set_cable_wrap":         RoleOperator,
+	"set_refraction":         RoleOperator,
+	"set_azimuth_offset":     RoleOperator,
+	"set_elevation_offset":   RoleOperator,
+	"set_band_tx":            RoleOperator,
+	"set_band_rx":            RoleOperator,
+}
+
+// rotctldRoles is the role needed for each rotctld command. Commands that
+// aren't listed need RoleAdmin.
+var rotctldRoles = map[string]Role{
+	"1": RoleViewer, "dump_caps": RoleViewer,
+	"p": RoleViewer, "get_pos": RoleViewer,
+	"S": RoleObserver, "stop": RoleObserver,
+	"K": RoleObserver, "park": RoleObserver,
+	"P": RoleObserver, "set_pos": RoleObserver,
+	"M": RoleObserver, "move": RoleObserver,
+	"take_control":    RoleObserver,
+	"release_control": RoleObserver,
+}
+
+// requiredRole returns the role needed for a command.
+func requiredRole(roles map[string]Role, command string) Role {
+	if r, ok := roles[command]; ok {
+		return r
+	}
+	return RoleAdmin
+}
+
+// User is an entry in the users file.
+type User struct {
+	Name string
+	// Hash is the bcrypt hash of the user's password.
+	Hash []byte
+	Role Role
+}
+
+// LoadUsers reads a users file. Each line has the form "name:hash:role",
+// where hash is a bcrypt hash, as made by "htpasswd -nB name", and role is
+// viewer, observer, operator, or admin. Blank lines and lines starting with
+// # are ignored.
+func LoadUsers(path string) (map[string]User, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	users := make(map[string]User)
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.Split(line, ":")
+		if len(parts) != 3 || parts[0] == "" {
+			return nil, fmt.Errorf("%s:%d: want name:hash:role", path, n)
+		}
+		if _, err := bcrypt.Cost([]byte(parts[1])); err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, n, err)
+		}
+		role, err := ParseRole(parts[2])
+		if err != nil || role == RoleNone {
+			return nil, fmt.Errorf("%s:%d: unknown role %q", path, n, parts[2])
+		}
+		if _, ok := users[parts[0]]; ok {
+			return nil, fmt.Errorf("%s:%d: duplicate user %q", path, n, parts[0])
+		}
+		users[parts[0]] = User{Name: parts[0], Hash: []byte(parts[1]), Role: role}
+	}
+	return users, scanner.Err()
+}
+
+// checkPassword returns the role of a user with the given password, or of
+// the shared passwords if user is empty.
+func (s *Server) checkPassword(user, password string) Role {
+	if user == "" {
+		for _, p := range s.passwords {
+			if p == password {
+				return legacyRole
+			}
+		}
+		return RoleNone
+	}
+	u, ok := s.users[user]
+	if !ok || bcrypt.CompareHashAndPassword(u.Hash, []byte(password)) != nil {
+		return RoleNone
+	}
+	return u.Role
+}
+
+// authenticate returns the user and role of a websocket client, and the
+// subprotocol to accept. The subprotocol is either a shared password or the
+// unpadded base64url encoding of "user:password". Clients on the local host
+// are admins.
+func (s *Server) authenticate(r *http.Request) (user string, role Role, protocol string) {
+	if protocols := websocket.Subprotocols(r); len(protocols) > 0 {
+		protocol = protocols[0]
+		if role = s.checkPassword("", protocol); role == RoleNone {
+			if data, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(protocol, "=")); err == nil {
+				if parts := strings.SplitN(string(data), ":", 2); len(parts) == 2 {
+					user = parts[0]
+					role = s.checkPassword(user, parts[1])
+				}
+			}
+		}
+		if role == RoleNone {
+			user, protocol = "", ""
+		}
+	}
+	if isLocal(r) {
+		role = RoleAdmin
+	}
+	return user, role, protocol
+}
+
+// requestAuth returns the user and role of an HTTP client, which
+// authenticates with basic authentication. The user name is ignored for a
+// shared password. Clients on the local host are admins.
+func (s *Server) requestAuth(r *http.Request) (string, Role) {
+	var user string
+	role := RoleNone
+	if u, pass, ok := r.BasicAuth(); ok {
+		if role = s.checkPassword("", pass); role == RoleNone {
+			if role = s.checkPassword(u, pass); role != RoleNone {
+				user = u
+			}
+		}
+	}
+	if isLocal(r) {
+		role = RoleAdmin
+	}
+	return user, role
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func writeUsers(t *testing.T, lines ...string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "users")
+	if err := ioutil.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func hashPassword(t *testing.T, password string) string {
+	t.Helper()
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(hash)
+}
+
+func TestLoadUsers(t *testing.T) {
+	hash := hashPassword(t, "secret")
+	users, err := LoadUsers(writeUsers(t,
+		"# comment",
+		"",
+		"alice:"+hash+":admin",
+		"  bob:"+hash+":viewer  ",
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 2 || users["alice"].Role != RoleAdmin || users["bob"].Role != RoleViewer {
+		t.Errorf("LoadUsers got %+v", users)
+	}
+
+	for _, test := range []struct {
+		name, line, want string
+	}{
+		{"missing role", "alice:" + hash, "want name:hash:role"},
+		{"missing name", ":" + hash + ":admin", "want name:hash:role"},
+		{"plain password", "alice:secret:admin", "hash"},
+		{"unknown role", "alice:" + hash + ":root", "unknown role"},
+		{"no role", "alice:" + hash + ":none", "unknown role"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := LoadUsers(writeUsers(t, test.line))
+			if err == nil || !strings.Contains(err.Error(), test.want) {
+				t.Errorf("LoadUsers(%q) got %v, want error containing %q", test.line, err, test.want)
+			}
+		})
+	}
+
+	if _, err := LoadUsers(writeUsers(t, "alice:"+hash+":admin", "alice:"+hash+":viewer")); err == nil || !strings.Contains(err.Error(), "duplicate") {
+		t.Errorf("LoadUsers with duplicate user got %v", err)
+	}
+}
+
+func TestCheckPassword(t *testing.T) {
+	s := &Server{
+		passwords: []string{"shared"},
+		users: map[string]User{
+			"alice": {Name: "alice", Hash: []byte(hashPassword(t, "secret")), Role: RoleObserver},
+		},
+	}
+	for _, test := range []struct {
+		user, password string
+		want           Role
+	}{
+		{"", "shared", legacyRole},
+		{"", "secret", RoleNone},
+		{"alice", "secret", RoleObserver},
+		{"alice", "shared", RoleNone},
+		{"alice", "", RoleNone},
+		{"bob", "secret", RoleNone},
+	} {
+		if got := s.checkPassword(test.user, test.password); got != test.want {
+			t.Errorf("checkPassword(%q, %q) = %v, want %v", test.user, test.password, got, test.want)
+		}
+	}
+}
+
+func TestRequiredRole(t *testing.T) {
+	for _, test := range []struct {
+		roles   map[string]Role
+		command string
+		want    Role
+	}{
+		{commandRoles, "track", RoleObserver},
+		{commandRoles, "set_band_tx", RoleOperator},
+		{commandRoles, "write", RoleAdmin},
+		{commandRoles, "exit_shutdown", RoleAdmin},
+		{commandRoles, "no_such_command", RoleAdmin},
+		{rotctldRoles, "p", RoleViewer},
+		{rotctldRoles, "P", RoleObserver},
+		{rotctldRoles, "set_conf", RoleAdmin},
+	} {
+		if got := requiredRole(test.roles, test.command); got != test.want {
+			t.Errorf("requiredRole(%q) = %v, want %v", test.command, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/pebbe/novas"
+)
+
+const (
+	// visibilityWindow is the default span of a visibility prediction.
+	visibilityWindow = 24 * time.Hour
+	// maxVisibilityWindow limits the span of a visibility prediction.
+	maxVisibilityWindow = 7 * 24 * time.Hour
+	// visibilitySearchStep is the spacing of samples used to find rise and set times.
+	visibilitySearchStep = time.Minute
+	// visibilityPrecision is the precision of rise, set, and transit times.
+	visibilityPrecision = time.Second
+	// defaultTrackStep is the default spacing of the sampled track.
+	defaultTrackStep = 10 * time.Minute
+	// maxTrackPoints limits the size of the sampled track.
+	maxTrackPoints = 2000
+)
+
+// VisibilityWindow is a period during which a body can be observed.
+type VisibilityWindow struct {
+	// Rise and Set are the start and end of the window. They are clipped to the requested span.
+	Rise, Set time.Time
+	// Transit is the time of maximum elevation within the window.
+	Transit      time.Time
+	MaxElevation float64
+}
+
+type VisibilityPoint struct {
+	Time    time.Time
+	Az, El  float64
+	Visible bool
+}
+
+type Visibility struct {
+	ID       string
+	Name     string
+	From, To time.Time
+	// MinElevation and MaxElevation are the antenna's elevation limits. The
+	// horizon mask, if any, is applied in addition to MinElevation.
+	MinElevation, MaxElevation float64
+	Windows                    []VisibilityWindow
+	Track                      []VisibilityPoint
+}
+
+// visibilityCalc evaluates whether a body is observable.
+type visibilityCalc struct {
+	body         Body
+	place        *novas.Place
+	refr         novas.RefractType
+	mask         HorizonMask
+	minElevation float64
+	maxElevation float64
+}
+
+func (c *visibilityCalc) position(t time.Time) (az, el float64) {
+	tm := novas.Now()
+	tm.Time = t
+	topo := bodyTopo(c.body, tm, c.place, c.refr)
+	return topo.Az, topo.Alt
+}
+
+func (c *visibilityCalc) visibleAt(az, el float64) bool {
+	if math.IsNaN(az) || math.IsNaN(el) {
+		return false
+	}
+	return el >= c.minElevation && el >= c.mask.MinElevation(az) && el <= c.maxElevation
+}
+
+func (c *visibilityCalc) visible(t time.Time) bool {
+	return c.visibleAt(c.position(t))
+}
+
+// crossing returns the time between t1 and t2 at which visibility changes.
+func (c *visibilityCalc) crossing(t1, t2 time.Time) time.Time {
+	v1 := c.visible(t1)
+	for t2.Sub(t1) > visibilityPrecision {
+		mid := t1.Add(t2.Sub(t1) / 2)
+		if c.visible(mid) == v1 {
+			t1 = mid
+		} else {
+			t2 = mid
+		}
+	}
+	return t2
+}
+
+// transit returns the time and elevation of the highest point between start and end.
+func (c *visibilityCalc) transit(start, end time.Time) (time.Time, float64) {
+	best, bestEl := start, math.Inf(-1)
+	for t := start; !t.After(end); t = t.Add(visibilitySearchStep) {
+		if _, el := c.position(t); el > bestEl {
+			best, bestEl = t, el
+		}
+	}
+	// Refine by golden-section search around the coarse maximum.
+	lo, hi := best.Add(-visibilitySearchStep), best.Add(visibilitySearchStep)
+	if lo.Before(start) {
+		lo = start
+	}
+	if hi.After(end) {
+		hi = end
+	}
+	for hi.Sub(lo) > visibilityPrecision {
+		m1 := lo.Add(hi.Sub(lo) * 382 / 1000)
+		m2 := lo.Add(hi.Sub(lo) * 618 / 1000)
+		_, el1 := c.position(m1)
+		_, el2 := c.position(m2)
+		if el1 < el2 {
+			lo = m1
+		} else {
+			hi = m2
+		}
+	}
+	mid := lo.Add(hi.Sub(lo) / 2)
+	if _, el := c.position(mid); el > bestEl {
+		best, bestEl = mid, el
+	}
+	if math.IsInf(bestEl, -1) {
+		// The position could not be computed.
+		return start, 0
+	}
+	return best, bestEl
+}
+
+// windows returns the periods between from and to during which the body is observable.
+func (c *visibilityCalc) windows(from, to time.Time) []VisibilityWindow {
+	var out []VisibilityWindow
+	var rise time.Time
+	up := c.visible(from)
+	if up {
+		rise = from
+	}
+	prev := from
+	for t := from.Add(visibilitySearchStep); ; t = t.Add(visibilitySearchStep) {
+		if t.After(to) {
+			t = to
+		}
+		if v := c.visible(t); v != up {
+			cross := c.crossing(prev, t)
+			if v {
+				rise = cross
+			} else {
+				out = append(out, VisibilityWindow{Rise: rise, Set: cross})
+			}
+			up = v
+		}
+		if !t.Before(to) {
+			break
+		}
+		prev = t
+	}
+	if up {
+		out = append(out, VisibilityWindow{Rise: rise, Set: to})
+	}
+	for i := range out {
+		w := &out[i]
+		w.Transit, w.MaxElevation = c.transit(w.Rise, w.Set)
+	}
+	return out
+}
+
+func (c *visibilityCalc) track(from, to time.Time, step time.Duration) []VisibilityPoint {
+	var out []VisibilityPoint
+	for t := from; !t.After(to); t = t.Add(step) {
+		az, el := c.position(t)
+		if math.IsNaN(az) || math.IsNaN(el) {
+			continue
+		}
+		out = append(out, VisibilityPoint{Time: t, Az: az, El: el, Visible: c.visibleAt(az, el)})
+	}
+	return out
+}
+
+// parseTime parses an RFC 3339 time, or returns def if s is empty.
+func parseTime(s string, def time.Time) (time.Time, error) {
+	if s == "" {
+		return def, nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+// VisibilityHandler predicts when a body can be observed.
+// The optional from and to parameters are RFC 3339 times (default now and 24 hours later),
+// and step sets the spacing of the sampled track (default 10m).
+func (s *Server) VisibilityHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	from, err := parseTime(r.FormValue("from"), time.Now())
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid from: %v", err), http.StatusBadRequest)
+		return
+	}
+	to, err := parseTime(r.FormValue("to"), from.Add(visibilityWindow))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid to: %v", err), http.StatusBadRequest)
+		return
+	}
+	if !to.After(from) || to.Sub(from) > maxVisibilityWindow {
+		http.Error(w, "invalid time range", http.StatusBadRequest)
+		return
+	}
+	step := defaultTrackStep
+	if v := r.FormValue("step"); v != "" {
+		if step, err = time.ParseDuration(v); err != nil || step <= 0 {
+			http.Error(w, "invalid step", http.StatusBadRequest)
+			return
+		}
+	}
+	if n := to.Sub(from) / step; n > maxTrackPoints {
+		step = to.Sub(from) / maxTrackPoints
+	}
+
+	s.mu.Lock()
+	b, err := s.lookupBody(BodyRef{ID: id})
+	var calc visibilityCalc
+	if err == nil {
+		calc = visibilityCalc{
+			body:         b.Body,
+			place:        s.place,
+			refr:         s.refraction,
+			minElevation: s.minElevation,
+			maxElevation: s.maxElevation,
+		}
+		if s.avoid != nil {
+			calc.mask = s.avoid.mask
+		}
+	}
+	s.mu.Unlock()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	vis := Visibility{
+		ID:           id,
+		Name:         calc.body.Name(),
+		From:         from,
+		To:           to,
+		MinElevation: calc.minElevation,
+		MaxElevation: calc.maxElevation,
+		Windows:      calc.windows(from, to),
+		Track:        calc.track(from, to, step),
+	}
+	w.Header().Set("Content-Type", "application/json")
+	data, err := json.Marshal(vis)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	w.Write(data)
+}
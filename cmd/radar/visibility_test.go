@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/pebbe/novas"
+)
+
+type fakeRotator struct{}
+
+func (fakeRotator) Stop()                        {}
+func (fakeRotator) SetAzimuthPosition(float64)   {}
+func (fakeRotator) SetElevationPosition(float64) {}
+func (fakeRotator) SetAzimuthVelocity(float64)   {}
+func (fakeRotator) SetElevationVelocity(float64) {}
+
+func newTestServer() *Server {
+	s := &Server{
+		place:         novas.NewPlace(42.36, -71.09, 10, 10, 1010),
+		refraction:    novas.REFR_PLACE,
+		r:             fakeRotator{},
+		trackMode:     "position",
+		trackInterval: time.Millisecond,
+		lockTimeout:   time.Minute,
+		maxElevation:  90,
+	}
+	s.statusCond = sync.NewCond(s.statusMu.RLocker())
+	return s
+}
+
+// TestVisibilityWhileTracking runs a visibility prediction while the
+// tracking loop is computing positions. Run it with -race.
+func TestVisibilityWhileTracking(t *testing.T) {
+	s := newTestServer()
+	s.mu.Lock()
+	s.track(s.addBody(novas.Sun(), "sun", kindSun, "", nil))
+	moon := s.addBody(novas.Moon(), "moon", kindMoon, "", nil)
+	s.mu.Unlock()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		s.trackLoop(ctx)
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	r := httptest.NewRequest(http.MethodGet, "/api/bodies/moon/visibility?step=1m", nil)
+	r = mux.SetURLVars(r, map[string]string{"id": moon.id})
+	w := httptest.NewRecorder()
+	s.VisibilityHandler(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	var vis Visibility
+	if err := json.Unmarshal(w.Body.Bytes(), &vis); err != nil {
+		t.Fatal(err)
+	}
+	if len(vis.Track) == 0 {
+		t.Error("no track points")
+	}
+	for _, p := range vis.Track {
+		if p.El < -90 || p.El > 90 {
+			t.Errorf("point %v: elevation %v out of range", p.Time, p.El)
+		}
+	}
+}
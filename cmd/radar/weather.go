@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/pebbe/novas"
+	"github.com/w1xm/rci_interface/weather"
+)
+
+// weatherInterval is how often the age of the weather is updated in the status.
+const weatherInterval = 10 * time.Second
+
+// WeatherStatus describes the conditions used to compute refraction.
+type WeatherStatus struct {
+	// Refraction is false if positions are computed without refraction.
+	Refraction bool
+	// Source is "flags" until a weather source reports conditions.
+	Source     string
+	Conditions weather.Conditions
+	// Age is the time since the conditions were measured (seconds).
+	Age float64
+	// Stale is true if the conditions are older than the configured maximum age.
+	Stale bool
+}
+
+// setWeather updates the atmosphere used for refraction.
+func (s *Server) setWeather(source string, c weather.Conditions) {
+	if err := c.Validate(); err != nil {
+		log.Printf("ignoring weather from %s: %v", source, err)
+		return
+	}
+	place := novas.NewPlace(s.latitude, s.longitude, s.height, c.Temperature, c.Pressure)
+	s.mu.Lock()
+	s.place = place
+	// Recompute the trajectory with the new refraction.
+	s.traj = nil
+	s.mu.Unlock()
+	s.statusMu.Lock()
+	defer s.statusMu.Unlock()
+	w := *s.status.Weather
+	w.Source = source
+	w.Conditions = c
+	s.updateWeatherAge(&w)
+	s.statusCond.Broadcast()
+}
+
+// updateWeatherAge sets the age of w, and replaces the status with it.
+// It must be called with s.statusMu locked.
+func (s *Server) updateWeatherAge(w *WeatherStatus) {
+	age := time.Since(w.Conditions.Time)
+	w.Age = age.Seconds()
+	stale := s.weatherMaxAge > 0 && age > s.weatherMaxAge
+	if stale && !w.Stale {
+		log.Printf("weather from %s is %v old", w.Source, age.Round(time.Second))
+	}
+	w.Stale = stale
+	s.status.Weather = w
+}
+
+func (s *Server) weatherLoop(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(weatherInterval):
+		}
+		s.statusMu.Lock()
+		if w := *s.status.Weather; !w.Conditions.Time.IsZero() {
+			s.updateWeatherAge(&w)
+			s.statusCond.Broadcast()
+		}
+		s.statusMu.Unlock()
+	}
+}
+
+func weatherSourceName(src weather.Source) string {
+	switch src := src.(type) {
+	case *weather.File:
+		return "file " + src.Path
+	case *weather.Modbus:
+		if src.URL != "" {
+			return "modbus " + src.URL
+		}
+		return "modbus " + src.Port
+	case *weather.Push:
+		return "push"
+	}
+	return fmt.Sprintf("%T", src)
+}
+
+// WeatherHandler accepts weather conditions from local clients if push is enabled.
+func (s *Server) WeatherHandler(w http.ResponseWriter, r *http.Request) {
+	push, ok := s.weatherSource.(*weather.Push)
+	if !ok {
+		http.Error(w, "weather push is not enabled", http.StatusNotFound)
+		return
+	}
+	if !isLocal(r) {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	push.ServeHTTP(w, r)
+}
+
+// setRefraction enables or disables refraction corrections.
+// It must be called with s.mu locked.
+func (s *Server) setRefraction(enabled bool) {
+	s.refraction = novas.REFR_NONE
+	if enabled {
+		s.refraction = novas.REFR_PLACE
+	}
+	s.traj = nil
+	s.statusMu.Lock()
+	defer s.statusMu.Unlock()
+	w := *s.status.Weather
+	w.Refraction = enabled
+	s.status.Weather = &w
+	s.statusCond.Broadcast()
+}
@@ -11,5 +11,6 @@ require (
 	github.com/influxdata/influxdb-client-go v1.4.0
 	github.com/pebbe/novas v1.1.1
 	github.com/tarm/serial v0.0.0-20180830185346-98f6abe2eb07
+	golang.org/x/crypto v0.0.0-20191112222119-e1110fd1c708
 	golang.org/x/sync v0.0.0-20190423024810-112230192c58
 )
@@ -0,0 +1,149 @@
+package pointing
+
+import (
+	"errors"
+	"fmt"
+	"math"
+)
+
+// Observation is a calibration point: the encoder position at which a
+// source was peaked up, and the known position of the source.
+type Observation struct {
+	EncoderAz, EncoderEl   float64
+	ObservedAz, ObservedEl float64
+}
+
+// FitResult describes the quality of a fit.
+type FitResult struct {
+	Model Model
+	// Sigma is the standard error of each coefficient (degrees).
+	Sigma map[string]float64
+	// RMS is the root-mean-square residual on the sky (degrees), before and after the fit.
+	InitialRMS, RMS float64
+}
+
+// Fit finds the coefficients of the named terms that best explain the
+// observations, by linear least squares. Residuals in azimuth are weighted
+// by the cosine of elevation, so that both axes are measured on the sky.
+func Fit(obs []Observation, terms []string) (*FitResult, error) {
+	n := len(terms)
+	if n == 0 {
+		return nil, errors.New("no terms to fit")
+	}
+	for _, name := range terms {
+		if _, ok := Terms[name]; !ok {
+			return nil, fmt.Errorf("unknown pointing term %q", name)
+		}
+	}
+	if 2*len(obs) <= n {
+		return nil, fmt.Errorf("%d observations are not enough to fit %d terms", len(obs), n)
+	}
+	// Build the normal equations A^T A x = A^T b.
+	ata := make([][]float64, n)
+	for i := range ata {
+		ata[i] = make([]float64, n)
+	}
+	atb := make([]float64, n)
+	var sumSq float64
+	row := make([]float64, n)
+	for _, o := range obs {
+		azr, elr := o.EncoderAz*math.Pi/180, o.EncoderEl*math.Pi/180
+		cosEl := math.Cos(o.ObservedEl * math.Pi / 180)
+		dAz := math.Remainder(o.ObservedAz-o.EncoderAz, 360) * cosEl
+		dEl := o.ObservedEl - o.EncoderEl
+		sumSq += dAz*dAz + dEl*dEl
+		for axis, b := range []float64{dAz, dEl} {
+			for j, name := range terms {
+				a, e := Terms[name](azr, elr)
+				if axis == 0 {
+					row[j] = a * cosEl
+				} else {
+					row[j] = e
+				}
+			}
+			for i := 0; i < n; i++ {
+				atb[i] += row[i] * b
+				for j := 0; j < n; j++ {
+					ata[i][j] += row[i] * row[j]
+				}
+			}
+		}
+	}
+	cov, err := invert(ata)
+	if err != nil {
+		return nil, fmt.Errorf("terms are degenerate with these observations: %w", err)
+	}
+	res := &FitResult{
+		Model:      make(Model),
+		Sigma:      make(map[string]float64),
+		InitialRMS: math.Sqrt(sumSq / float64(len(obs))),
+	}
+	coef := make([]float64, n)
+	for i := range coef {
+		for j := range coef {
+			coef[i] += cov[i][j] * atb[j]
+		}
+		res.Model[terms[i]] = coef[i]
+	}
+	var resSq float64
+	for _, o := range obs {
+		az, el := res.Model.Observed(o.EncoderAz, o.EncoderEl)
+		cosEl := math.Cos(o.ObservedEl * math.Pi / 180)
+		dAz := math.Remainder(o.ObservedAz-az, 360) * cosEl
+		dEl := o.ObservedEl - el
+		resSq += dAz*dAz + dEl*dEl
+	}
+	res.RMS = math.Sqrt(resSq / float64(len(obs)))
+	if dof := 2*len(obs) - n; dof > 0 {
+		variance := resSq / float64(dof)
+		for i, name := range terms {
+			res.Sigma[name] = math.Sqrt(variance * cov[i][i])
+		}
+	}
+	return res, nil
+}
+
+// invert inverts a symmetric matrix by Gauss-Jordan elimination with partial pivoting.
+func invert(m [][]float64) ([][]float64, error) {
+	n := len(m)
+	a := make([][]float64, n)
+	for i := range a {
+		a[i] = make([]float64, 2*n)
+		copy(a[i], m[i])
+		a[i][n+i] = 1
+	}
+	var scale float64
+	for i := range m {
+		scale = math.Max(scale, math.Abs(m[i][i]))
+	}
+	for col := 0; col < n; col++ {
+		pivot := col
+		for r := col + 1; r < n; r++ {
+			if math.Abs(a[r][col]) > math.Abs(a[pivot][col]) {
+				pivot = r
+			}
+		}
+		if math.Abs(a[pivot][col]) <= 1e-12*scale {
+			return nil, errors.New("matrix is singular")
+		}
+		a[col], a[pivot] = a[pivot], a[col]
+		p := a[col][col]
+		for j := range a[col] {
+			a[col][j] /= p
+		}
+		for r := 0; r < n; r++ {
+			if r == col || a[r][col] == 0 {
+				continue
+			}
+			f := a[r][col]
+			for j := range a[r] {
+				a[r][j] -= f * a[col][j]
+			}
+		}
+	}
+	out := make([][]float64, n)
+	for i := range out {
+		out[i] = a[i][n:]
+	}
+	return out, nil
+}
@@ -0,0 +1,189 @@
+// Package pointing implements a TPOINT-style pointing model for alt-az antennas.
+//
+// The model gives the correction that is added to the encoder position to
+// obtain the observed (sky) position:
+//
+//	observed = encoder + correction(encoder)
+//
+// All coefficients are in degrees. With only IA and IE set, the model is
+// equivalent to constant azimuth and elevation offsets.
+package pointing
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Term is a pointing model term. Given the encoder azimuth and elevation
+// (radians), it returns the azimuth and elevation corrections (degrees)
+// for a coefficient of 1.
+type Term func(az, el float64) (dAz, dEl float64)
+
+// maxTanEl limits the tangent and secant of the elevation, to keep terms finite at the zenith.
+const maxTanEl = 60
+
+func tan(el float64) float64 {
+	return math.Max(-maxTanEl, math.Min(maxTanEl, math.Tan(el)))
+}
+
+func sec(el float64) float64 {
+	return math.Min(maxTanEl, 1/math.Cos(el))
+}
+
+// Terms are the supported terms, by name.
+var Terms = map[string]Term{
+	// Azimuth index error.
+	"IA": func(az, el float64) (float64, float64) { return 1, 0 },
+	// Elevation index error.
+	"IE": func(az, el float64) (float64, float64) { return 0, 1 },
+	// Left-right collimation error.
+	"CA": func(az, el float64) (float64, float64) { return sec(el), 0 },
+	// Non-perpendicularity of the azimuth and elevation axes.
+	"NPAE": func(az, el float64) (float64, float64) { return tan(el), 0 },
+	// North-south tilt of the azimuth axis.
+	"AN": func(az, el float64) (float64, float64) { return math.Sin(az) * tan(el), math.Cos(az) },
+	// East-west tilt of the azimuth axis.
+	"AW": func(az, el float64) (float64, float64) { return -math.Cos(az) * tan(el), math.Sin(az) },
+	// Tube flexure (gravitational sag), proportional to the cosine of elevation.
+	"TF": func(az, el float64) (float64, float64) { return 0, math.Cos(el) },
+	// Tube flexure, proportional to the cotangent of elevation.
+	"TX": func(az, el float64) (float64, float64) { return 0, 1 / tan(el) },
+	// Azimuth encoder eccentricity.
+	"ACEC": func(az, el float64) (float64, float64) { return math.Cos(az), 0 },
+	"ACES": func(az, el float64) (float64, float64) { return math.Sin(az), 0 },
+	// Elevation encoder eccentricity.
+	"ECEC": func(az, el float64) (float64, float64) { return 0, math.Cos(el) },
+	"ECES": func(az, el float64) (float64, float64) { return 0, math.Sin(el) },
+}
+
+// Model is a set of pointing model coefficients, by term name.
+type Model map[string]float64
+
+// NewModel returns a model with only azimuth and elevation index terms.
+func NewModel(ia, ie float64) Model {
+	return Model{"IA": ia, "IE": ie}
+}
+
+// Validate checks that every term in m is supported.
+func (m Model) Validate() error {
+	for name := range m {
+		if _, ok := Terms[name]; !ok {
+			return fmt.Errorf("unknown pointing term %q", name)
+		}
+	}
+	return nil
+}
+
+// Correction returns the correction (degrees) to add to the encoder position az/el (degrees).
+func (m Model) Correction(az, el float64) (dAz, dEl float64) {
+	azr, elr := az*math.Pi/180, el*math.Pi/180
+	for name, coef := range m {
+		if coef == 0 {
+			continue
+		}
+		a, e := Terms[name](azr, elr)
+		dAz += coef * a
+		dEl += coef * e
+	}
+	return dAz, dEl
+}
+
+// Observed converts an encoder position to the observed position.
+func (m Model) Observed(az, el float64) (float64, float64) {
+	dAz, dEl := m.Correction(az, el)
+	return clampAngle(az + dAz), el + dEl
+}
+
+// Encoder converts an observed position to the encoder position that points at it.
+func (m Model) Encoder(az, el float64) (float64, float64) {
+	// The correction depends on the encoder position, so iterate.
+	encAz, encEl := az, el
+	for i := 0; i < 10; i++ {
+		dAz, dEl := m.Correction(encAz, encEl)
+		nextAz, nextEl := clampAngle(az-dAz), el-dEl
+		done := math.Abs(math.Remainder(nextAz-encAz, 360)) < 1e-9 && math.Abs(nextEl-encEl) < 1e-9
+		encAz, encEl = nextAz, nextEl
+		if done {
+			break
+		}
+	}
+	return encAz, encEl
+}
+
+// Clone returns a copy of m.
+func (m Model) Clone() Model {
+	out := make(Model, len(m))
+	for k, v := range m {
+		out[k] = v
+	}
+	return out
+}
+
+// Load reads a model file.
+func Load(path string) (Model, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	m, err := Read(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return m, nil
+}
+
+// Read parses a model. Each line contains a term name and its coefficient
+// in degrees. Blank lines and text after # are ignored.
+func Read(r io.Reader) (Model, error) {
+	m := make(Model)
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := scanner.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("line %d: expected term and coefficient", n)
+		}
+		name := strings.ToUpper(fields[0])
+		if _, ok := Terms[name]; !ok {
+			return nil, fmt.Errorf("line %d: unknown term %q", n, fields[0])
+		}
+		v, err := strconv.ParseFloat(fields[1], 64)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", n, err)
+		}
+		m[name] = v
+	}
+	return m, scanner.Err()
+}
+
+// Write writes m in the format read by Read.
+func (m Model) Write(w io.Writer) error {
+	var names []string
+	for name := range m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if _, err := fmt.Fprintf(w, "%-5s %.6f\n", name, m[name]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func clampAngle(x float64) float64 {
+	return math.Mod(math.Mod(x, 360)+360, 360)
+}
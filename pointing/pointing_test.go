@@ -0,0 +1,87 @@
+package pointing
+
+import (
+	"math"
+	"strings"
+	"testing"
+)
+
+func TestEncoderInverse(t *testing.T) {
+	m := Model{"IA": 5.5, "IE": -5.5, "CA": 0.1, "NPAE": -0.05, "AN": 0.02, "AW": -0.03, "TF": 0.2}
+	for _, p := range []struct{ az, el float64 }{
+		{0, 10}, {90, 45}, {180, 80}, {359.5, 30}, {270, 5},
+	} {
+		encAz, encEl := m.Encoder(p.az, p.el)
+		az, el := m.Observed(encAz, encEl)
+		if math.Abs(math.Remainder(az-p.az, 360)) > 1e-6 || math.Abs(el-p.el) > 1e-6 {
+			t.Errorf("Observed(Encoder(%v, %v)) = %v, %v", p.az, p.el, az, el)
+		}
+	}
+}
+
+func TestIndexTermsMatchOffsets(t *testing.T) {
+	m := NewModel(5.5, -5.5)
+	az, el := m.Observed(100, 30)
+	if az != 105.5 || el != 24.5 {
+		t.Errorf("Observed(100, 30) = %v, %v; want 105.5, 24.5", az, el)
+	}
+}
+
+func TestFit(t *testing.T) {
+	want := Model{"IA": 1.2, "IE": -0.4, "CA": 0.05, "NPAE": 0.02, "AN": -0.01, "AW": 0.015, "TF": 0.3}
+	var terms []string
+	for name := range want {
+		terms = append(terms, name)
+	}
+	var obs []Observation
+	for az := 0.0; az < 360; az += 30 {
+		for el := 10.0; el < 85; el += 15 {
+			oAz, oEl := want.Observed(az, el)
+			obs = append(obs, Observation{EncoderAz: az, EncoderEl: el, ObservedAz: oAz, ObservedEl: oEl})
+		}
+	}
+	res, err := Fit(obs, terms)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, v := range want {
+		if got := res.Model[name]; math.Abs(got-v) > 1e-6 {
+			t.Errorf("%s = %v, want %v", name, got, v)
+		}
+	}
+	if res.RMS > 1e-6 {
+		t.Errorf("RMS = %v, want 0", res.RMS)
+	}
+}
+
+func TestFitDegenerate(t *testing.T) {
+	obs := []Observation{
+		{EncoderAz: 0, EncoderEl: 30, ObservedAz: 1, ObservedEl: 30},
+		{EncoderAz: 90, EncoderEl: 30, ObservedAz: 91, ObservedEl: 30},
+	}
+	// TF and ECEC are the same function of elevation.
+	if _, err := Fit(obs, []string{"TF", "ECEC"}); err == nil {
+		t.Error("Fit succeeded with degenerate terms")
+	}
+}
+
+func TestReadWrite(t *testing.T) {
+	m, err := Read(strings.NewReader("# model\nIA 5.5\nie -5.5 # index\n\nNPAE 0.01\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var b strings.Builder
+	if err := m.Write(&b); err != nil {
+		t.Fatal(err)
+	}
+	m2, err := Read(strings.NewReader(b.String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m2) != 3 || m2["IA"] != 5.5 || m2["IE"] != -5.5 || m2["NPAE"] != 0.01 {
+		t.Errorf("round trip = %v", m2)
+	}
+	if _, err := Read(strings.NewReader("XX 1\n")); err == nil {
+		t.Error("Read accepted unknown term")
+	}
+}
@@ -0,0 +1,193 @@
+package pointing
+
+import (
+	"sync"
+
+	"github.com/w1xm/rci_interface/rotator"
+)
+
+// Rotator applies a pointing model to an underlying rotator. Positions
+// reported and commanded through it are observed positions.
+type Rotator struct {
+	rotator.Rotator
+	origCallback rotator.StatusCallback
+
+	mu    sync.Mutex
+	model Model
+	// az and el are the last commanded observed positions.
+	az, el           float64
+	azFlags, elFlags string
+	status           Status
+}
+
+type Status struct {
+	rotator.Status
+	// AzPos and ElPos are the observed position.
+	AzPos, ElPos float64
+	// EncoderAzPos and EncoderElPos are the position reported by the underlying rotator.
+	EncoderAzPos, EncoderElPos float64
+	CommandAzPos, CommandElPos float64
+	PointingModel              Model
+}
+
+func (s Status) Clone() rotator.Status {
+	s.Status = s.Status.Clone()
+	s.PointingModel = s.PointingModel.Clone()
+	return s
+}
+
+func (s Status) AzimuthPosition() float64 {
+	return s.AzPos
+}
+
+func (s Status) ElevationPosition() float64 {
+	return s.ElPos
+}
+
+func (s Status) AzimuthCommand() (string, float64) {
+	flags, _ := s.Status.AzimuthCommand()
+	return flags, s.CommandAzPos
+}
+
+func (s Status) ElevationCommand() (string, float64) {
+	flags, _ := s.Status.ElevationCommand()
+	return flags, s.CommandElPos
+}
+
+// NewRotator wraps the rotator created by constructor with model.
+func NewRotator(model Model, constructor func(cb rotator.StatusCallback) (rotator.Rotator, error), cb rotator.StatusCallback) (*Rotator, error) {
+	if err := model.Validate(); err != nil {
+		return nil, err
+	}
+	p := &Rotator{
+		model:        model.Clone(),
+		origCallback: cb,
+	}
+	r, err := constructor(p.statusCallback)
+	if err != nil {
+		return nil, err
+	}
+	p.Rotator = r
+	return p, nil
+}
+
+func (p *Rotator) statusCallback(status rotator.Status) {
+	encAz, encEl := status.AzimuthPosition(), status.ElevationPosition()
+	_, cmdAz := status.AzimuthCommand()
+	_, cmdEl := status.ElevationCommand()
+	p.mu.Lock()
+	s := Status{
+		Status:        status,
+		EncoderAzPos:  encAz,
+		EncoderElPos:  encEl,
+		PointingModel: p.model.Clone(),
+	}
+	s.AzPos, s.ElPos = p.model.Observed(encAz, encEl)
+	s.CommandAzPos, s.CommandElPos = p.model.Observed(cmdAz, cmdEl)
+	p.azFlags, _ = status.AzimuthCommand()
+	p.elFlags, _ = status.ElevationCommand()
+	p.status = s
+	p.mu.Unlock()
+	p.origCallback(s)
+}
+
+// command sends the encoder position for the last commanded observed position.
+// Both axes depend on both observed coordinates, so an axis in position mode
+// is updated whenever the other axis is commanded.
+func (p *Rotator) command(setAz, setEl bool) {
+	p.mu.Lock()
+	encAz, encEl := p.model.Encoder(p.az, p.el)
+	setAz = setAz || p.azFlags == "POSITION"
+	setEl = setEl || p.elFlags == "POSITION"
+	p.mu.Unlock()
+	if setAz {
+		p.Rotator.SetAzimuthPosition(encAz)
+	}
+	if setEl {
+		p.Rotator.SetElevationPosition(encEl)
+	}
+}
+
+func (p *Rotator) SetAzimuthPosition(az float64) {
+	p.mu.Lock()
+	p.az = az
+	if p.elFlags != "POSITION" && p.status.Status != nil {
+		p.el = p.status.ElPos
+	}
+	p.mu.Unlock()
+	p.command(true, false)
+}
+
+func (p *Rotator) SetElevationPosition(el float64) {
+	p.mu.Lock()
+	p.el = el
+	if p.azFlags != "POSITION" && p.status.Status != nil {
+		p.az = p.status.AzPos
+	}
+	p.mu.Unlock()
+	p.command(false, true)
+}
+
+// SetModel replaces the pointing model, and recommands any axis in position mode.
+func (p *Rotator) SetModel(model Model) error {
+	if err := model.Validate(); err != nil {
+		return err
+	}
+	p.mu.Lock()
+	p.model = model.Clone()
+	p.mu.Unlock()
+	p.command(false, false)
+	return nil
+}
+
+// Model returns a copy of the current pointing model.
+func (p *Rotator) Model() Model {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.model.Clone()
+}
+
+// SetAzimuthOffset sets the IA term, for compatibility with rotator.Offsetter.
+func (p *Rotator) SetAzimuthOffset(offset float64) {
+	p.setTerm("IA", offset)
+}
+
+// SetElevationOffset sets the IE term, for compatibility with rotator.Offsetter.
+func (p *Rotator) SetElevationOffset(offset float64) {
+	p.setTerm("IE", offset)
+}
+
+func (p *Rotator) setTerm(name string, value float64) {
+	p.mu.Lock()
+	p.model = p.model.Clone()
+	p.model[name] = value
+	p.mu.Unlock()
+	p.command(false, false)
+}
+
+// The remaining methods pass optional interfaces through to the underlying
+// rotator. Use rotator.Expose to hide the ones it doesn't have.
+
+func (p *Rotator) ExitShutdown() {
+	if r, ok := p.Rotator.(rotator.Shutdowner); ok {
+		r.ExitShutdown()
+	}
+}
+
+func (p *Rotator) SetAcceptableShutdowns(value map[uint8]bool) {
+	if r, ok := p.Rotator.(rotator.Shutdowner); ok {
+		r.SetAcceptableShutdowns(value)
+	}
+}
+
+func (p *Rotator) SetMovingDisabled(blocked bool) {
+	if r, ok := p.Rotator.(rotator.SetMovingDisableder); ok {
+		r.SetMovingDisabled(blocked)
+	}
+}
+
+func (p *Rotator) Write(register int, values ...uint16) {
+	if r, ok := p.Rotator.(rotator.Writer); ok {
+		r.Write(register, values...)
+	}
+}
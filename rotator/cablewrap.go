@@ -0,0 +1,380 @@
+package rotator
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"sync"
+)
+
+// WrapConfig describes the azimuth travel of a mount with a cable wrap.
+type WrapConfig struct {
+	// Min and Max are the limits of travel, in azimuth degrees counting
+	// turns (for example -90 to 450 for 540 degrees of travel).
+	Min, Max float64
+	// Cut is the azimuth that the underlying rotator never moves through in
+	// response to a position command. Moves across it are made with
+	// velocity commands.
+	Cut float64
+	// SlewVelocity is the speed of moves across Cut (degrees/second).
+	SlewVelocity float64
+}
+
+func (c WrapConfig) validate() error {
+	if c.Max-c.Min < 360 {
+		return fmt.Errorf("cable wrap travel %v to %v is less than a full turn", c.Min, c.Max)
+	}
+	if c.SlewVelocity <= 0 {
+		return errors.New("cable wrap slew velocity must be positive")
+	}
+	return nil
+}
+
+// segment returns the index of the turn containing az, counted from Cut.
+func (c WrapConfig) segment(az float64) float64 {
+	return math.Floor((az - c.Cut) / 360)
+}
+
+// Nearest returns the position within the limits that is equivalent to az
+// and closest to from.
+func (c WrapConfig) Nearest(az, from float64) float64 {
+	u := from + math.Remainder(az-from, 360)
+	for u > c.Max {
+		u -= 360
+	}
+	for u < c.Min {
+		u += 360
+	}
+	return u
+}
+
+// UnwrapPath removes jumps of more than 180 degrees between successive
+// azimuths, so that the result is continuous.
+func UnwrapPath(azs []float64) []float64 {
+	out := make([]float64, len(azs))
+	for i, az := range azs {
+		if i == 0 {
+			out[i] = az
+			continue
+		}
+		out[i] = out[i-1] + math.Remainder(az-out[i-1], 360)
+	}
+	return out
+}
+
+// PlanWrap chooses the turn at which to follow a continuous azimuth path
+// so that as much of it as possible stays within the limits. It returns
+// the multiple of 360 degrees to add to path, and the number of points of
+// path that can be followed without unwinding. Among equally long plans,
+// the one starting closest to from is preferred.
+func (c WrapConfig) PlanWrap(path []float64, from float64) (shift float64, n int) {
+	if len(path) == 0 {
+		return 0, 0
+	}
+	bestDist := math.Inf(1)
+	lo, hi := math.Ceil((c.Min-path[0])/360), math.Floor((c.Max-path[0])/360)
+	for k := lo; k <= hi; k++ {
+		s := 360 * k
+		i := 0
+		for i < len(path) && path[i]+s >= c.Min && path[i]+s <= c.Max {
+			i++
+		}
+		dist := math.Abs(path[0] + s - from)
+		if i > n || i == n && dist < bestDist {
+			shift, n, bestDist = s, i, dist
+		}
+	}
+	return shift, n
+}
+
+// CableWrap keeps track of the turns of an azimuth axis whose position is
+// reported modulo 360 degrees, and keeps it within the limits of its cable
+// wrap. The number of turns is not known at startup; it is assumed to be
+// the turn closest to the middle of travel until corrected with SetWrap.
+type CableWrap struct {
+	Rotator
+	origCallback StatusCallback
+
+	mu sync.Mutex
+	// config.Cut can change with SetCut, and the rest of config is fixed.
+	config WrapConfig
+	// known is false until the first status is received.
+	known bool
+	// az is the current position counting turns, and lastAz is the last reported position.
+	az, lastAz float64
+	// slewing is true while moving across Cut to target with a velocity command.
+	slewing bool
+	target  float64
+	// limitStopped is true if a velocity move was stopped at a limit.
+	limitStopped bool
+	// seq counts the azimuth commands sent, so that a command decided on in
+	// the status callback isn't sent after a newer one.
+	seq    int
+	status CableWrapStatus
+	// sendMu orders commands to the rotator. It is never held in the status callback.
+	sendMu sync.Mutex
+}
+
+type CableWrapStatus struct {
+	Status
+	// UnwrappedAzPos is the azimuth counting turns of the cable wrap.
+	UnwrappedAzPos float64
+	// WrapMin and WrapMax are the limits of UnwrappedAzPos.
+	WrapMin, WrapMax float64
+	// WrapSlewTarget is set while moving across the cut with a velocity command.
+	WrapSlewTarget *float64 `json:",omitempty"`
+	// WrapLimit is set if the last velocity move was stopped at a limit.
+	WrapLimit bool
+}
+
+func (s CableWrapStatus) Clone() Status {
+	s.Status = s.Status.Clone()
+	if s.WrapSlewTarget != nil {
+		t := *s.WrapSlewTarget
+		s.WrapSlewTarget = &t
+	}
+	return s
+}
+
+// wrapMargin is the distance from a limit at which velocity moves are stopped, in seconds of travel.
+const wrapMargin = 2.0
+
+// NewCableWrap wraps the rotator created by constructor with a cable wrap.
+func NewCableWrap(config WrapConfig, constructor func(cb StatusCallback) (Rotator, error), cb StatusCallback) (*CableWrap, error) {
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+	w := &CableWrap{
+		config:       config,
+		origCallback: cb,
+	}
+	r, err := constructor(w.statusCallback)
+	if err != nil {
+		return nil, err
+	}
+	w.Rotator = r
+	return w, nil
+}
+
+// Config returns the limits of the cable wrap.
+func (w *CableWrap) Config() WrapConfig {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.config
+}
+
+// SetCut changes the azimuth that the underlying rotator doesn't move
+// through, for example when the rotator's azimuth offset changes.
+func (w *CableWrap) SetCut(cut float64) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.config.Cut = cut
+}
+
+func (w *CableWrap) statusCallback(status Status) {
+	az := status.AzimuthPosition()
+	azVel, _ := status.AzElVelocity()
+	w.mu.Lock()
+	if !w.known {
+		w.az = w.config.Nearest(az, (w.config.Min+w.config.Max)/2)
+		w.known = true
+	} else {
+		w.az += math.Remainder(az-w.lastAz, 360)
+	}
+	w.lastAz = az
+	var finish, stop bool
+	if w.slewing {
+		if w.config.segment(w.az) == w.config.segment(w.target) {
+			// The rest of the move doesn't cross the cut.
+			w.slewing = false
+			finish = true
+		}
+	} else if flags, _ := status.AzimuthCommand(); flags == "VELOCITY" && !w.limitStopped {
+		margin := math.Max(1, math.Abs(azVel)*wrapMargin)
+		if azVel > 0 && w.az > w.config.Max-margin || azVel < 0 && w.az < w.config.Min+margin {
+			w.limitStopped = true
+			stop = true
+		}
+	}
+	target, seq := w.target, w.seq
+	s := CableWrapStatus{
+		Status:         status,
+		UnwrappedAzPos: w.az,
+		WrapMin:        w.config.Min,
+		WrapMax:        w.config.Max,
+		WrapLimit:      w.limitStopped,
+	}
+	if w.slewing {
+		s.WrapSlewTarget = &target
+	}
+	w.status = s
+	w.mu.Unlock()
+	// The underlying rotator may call back with its own lock held, so
+	// commands are sent from another goroutine.
+	if finish {
+		go w.send(seq, func() { w.Rotator.SetAzimuthPosition(clamp(target)) })
+	}
+	if stop {
+		log.Printf("stopping azimuth at cable wrap limit (%.2f)", s.UnwrappedAzPos)
+		go w.send(seq, func() { w.Rotator.SetAzimuthVelocity(0) })
+	}
+	w.origCallback(s)
+}
+
+// send sends a command decided on in the status callback, unless another
+// azimuth command has been sent since.
+func (w *CableWrap) send(seq int, command func()) {
+	w.sendMu.Lock()
+	defer w.sendMu.Unlock()
+	w.mu.Lock()
+	current := w.seq
+	w.mu.Unlock()
+	if current == seq {
+		command()
+	}
+}
+
+func clamp(az float64) float64 {
+	return math.Mod(math.Mod(az, 360)+360, 360)
+}
+
+// Position returns the current azimuth counting turns, and whether it is known yet.
+func (w *CableWrap) Position() (float64, bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.az, w.known
+}
+
+// SetWrap corrects the number of turns of the cable wrap, given the
+// current position counting turns.
+func (w *CableWrap) SetWrap(az float64) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if !w.known {
+		return errors.New("azimuth position is not known yet")
+	}
+	if d := math.Remainder(az-w.lastAz, 360); math.Abs(d) > 5 {
+		return fmt.Errorf("%.2f is not the current azimuth (%.2f)", az, w.lastAz)
+	}
+	u := w.lastAz + 360*math.Round((az-w.lastAz)/360)
+	if u < w.config.Min || u > w.config.Max {
+		return fmt.Errorf("%.2f is outside the cable wrap limits", u)
+	}
+	w.az = u
+	w.slewing = false
+	return nil
+}
+
+// SetAzimuthPosition moves to az by the shortest path within the limits.
+func (w *CableWrap) SetAzimuthPosition(az float64) {
+	w.mu.Lock()
+	from := w.az
+	if w.slewing {
+		from = w.target
+	}
+	u := w.config.Nearest(az, from)
+	w.mu.Unlock()
+	if err := w.SetUnwrappedAzimuthPosition(u); err != nil {
+		log.Print(err)
+	}
+}
+
+// SetUnwrappedAzimuthPosition moves to az, counting turns of the cable wrap.
+func (w *CableWrap) SetUnwrappedAzimuthPosition(az float64) error {
+	if az < w.config.Min || az > w.config.Max {
+		return fmt.Errorf("azimuth %.2f is outside the cable wrap limits (%.2f to %.2f)", az, w.config.Min, w.config.Max)
+	}
+	w.sendMu.Lock()
+	defer w.sendMu.Unlock()
+	w.mu.Lock()
+	if !w.known {
+		w.mu.Unlock()
+		return errors.New("azimuth position is not known yet")
+	}
+	w.seq++
+	w.limitStopped = false
+	if w.config.segment(w.az) == w.config.segment(az) {
+		w.slewing = false
+		w.mu.Unlock()
+		w.Rotator.SetAzimuthPosition(clamp(az))
+		return nil
+	}
+	wasSlewing := w.slewing && (w.target > w.az) == (az > w.az)
+	w.slewing = true
+	w.target = az
+	v := w.config.SlewVelocity
+	if az < w.az {
+		v = -v
+	}
+	w.mu.Unlock()
+	if !wasSlewing {
+		w.Rotator.SetAzimuthVelocity(v)
+	}
+	return nil
+}
+
+func (w *CableWrap) SetAzimuthVelocity(v float64) {
+	w.sendMu.Lock()
+	defer w.sendMu.Unlock()
+	w.mu.Lock()
+	w.seq++
+	w.slewing = false
+	w.limitStopped = false
+	if v > 0 && w.az >= w.config.Max || v < 0 && w.az <= w.config.Min {
+		log.Printf("refusing azimuth velocity %.2f at cable wrap limit (%.2f)", v, w.az)
+		w.limitStopped = true
+		v = 0
+	}
+	w.mu.Unlock()
+	w.Rotator.SetAzimuthVelocity(v)
+}
+
+func (w *CableWrap) Stop() {
+	w.sendMu.Lock()
+	defer w.sendMu.Unlock()
+	w.mu.Lock()
+	w.seq++
+	w.slewing = false
+	w.mu.Unlock()
+	w.Rotator.Stop()
+}
+
+// The remaining methods pass optional interfaces through to the underlying
+// rotator. Use Expose to hide the ones it doesn't have.
+
+func (w *CableWrap) SetAzimuthOffset(offset float64) {
+	if r, ok := w.Rotator.(Offsetter); ok {
+		r.SetAzimuthOffset(offset)
+	}
+}
+
+func (w *CableWrap) SetElevationOffset(offset float64) {
+	if r, ok := w.Rotator.(Offsetter); ok {
+		r.SetElevationOffset(offset)
+	}
+}
+
+func (w *CableWrap) ExitShutdown() {
+	if r, ok := w.Rotator.(Shutdowner); ok {
+		r.ExitShutdown()
+	}
+}
+
+func (w *CableWrap) SetAcceptableShutdowns(value map[uint8]bool) {
+	if r, ok := w.Rotator.(Shutdowner); ok {
+		r.SetAcceptableShutdowns(value)
+	}
+}
+
+func (w *CableWrap) SetMovingDisabled(blocked bool) {
+	if r, ok := w.Rotator.(SetMovingDisableder); ok {
+		r.SetMovingDisabled(blocked)
+	}
+}
+
+func (w *CableWrap) Write(register int, values ...uint16) {
+	if r, ok := w.Rotator.(Writer); ok {
+		r.Write(register, values...)
+	}
+}
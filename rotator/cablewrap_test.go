@@ -0,0 +1,109 @@
+package rotator
+
+import "testing"
+
+func TestNearest(t *testing.T) {
+	c := WrapConfig{Min: -90, Max: 450}
+	for _, tc := range []struct{ az, from, want float64 }{
+		{10, 350, 370},
+		{350, 10, -10},
+		{350, -80, -10},
+		{100, 440, 460 - 360},
+		{0, 180, 0},
+		{45, 400, 405},
+	} {
+		if got := c.Nearest(tc.az, tc.from); got != tc.want {
+			t.Errorf("Nearest(%v, %v) = %v, want %v", tc.az, tc.from, got, tc.want)
+		}
+	}
+}
+
+func TestPlanWrap(t *testing.T) {
+	c := WrapConfig{Min: -90, Max: 450}
+	// A pass that crosses north twice, moving clockwise.
+	path := UnwrapPath([]float64{300, 340, 20, 60, 100, 140, 180, 220, 260, 300, 340, 20, 60})
+	if path[len(path)-1] != 780 {
+		t.Fatalf("UnwrapPath ended at %v, want 780", path[len(path)-1])
+	}
+	shift, n := c.PlanWrap(path, 300)
+	if shift != -360 || n != len(path) {
+		t.Errorf("PlanWrap = %v, %v; want -360, %v", shift, n, len(path))
+	}
+	// The whole path fits two ways; prefer the start closest to the current position.
+	short := path[:3]
+	if shift, n := c.PlanWrap(short, 290); shift != 0 || n != 3 {
+		t.Errorf("PlanWrap(short, 290) = %v, %v; want 0, 3", shift, n)
+	}
+	if shift, n := c.PlanWrap(short, -70); shift != -360 || n != 3 {
+		t.Errorf("PlanWrap(short, -70) = %v, %v; want -360, 3", shift, n)
+	}
+	// A path longer than the travel is followed as far as possible.
+	long := UnwrapPath([]float64{0, 90, 180, 270, 0, 90, 180, 270})
+	if shift, n := c.PlanWrap(long, 0); shift != 0 || n != 6 {
+		t.Errorf("PlanWrap(long, 0) = %v, %v; want 0, 6", shift, n)
+	}
+}
+
+func TestSegment(t *testing.T) {
+	c := WrapConfig{Min: -90, Max: 450, Cut: 5.5}
+	if c.segment(359) != c.segment(365) {
+		t.Error("segment(359) != segment(365)")
+	}
+	if c.segment(5) == c.segment(6) {
+		t.Error("segment(5) == segment(6)")
+	}
+}
+
+func TestSetCut(t *testing.T) {
+	f := &fakeRotator{}
+	w, err := NewCableWrap(WrapConfig{Min: -90, Max: 450, SlewVelocity: 2}, func(cb StatusCallback) (Rotator, error) {
+		return f, nil
+	}, func(Status) {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.statusCallback(fakeStatus{az: 90})
+	// With the cut at 0, a move from 90 to 180 is a position command.
+	if err := w.SetUnwrappedAzimuthPosition(180); err != nil {
+		t.Fatal(err)
+	}
+	if f.az != 180 || f.azVel != 0 {
+		t.Errorf("moving to 180 commanded position %v and velocity %v, want a position command", f.az, f.azVel)
+	}
+	f.az = 0
+	w.SetCut(135)
+	if err := w.SetUnwrappedAzimuthPosition(180); err != nil {
+		t.Fatal(err)
+	}
+	if f.az != 0 || f.azVel != 2 {
+		t.Errorf("moving across the cut commanded position %v and velocity %v, want a velocity command", f.az, f.azVel)
+	}
+	if c := w.Config(); c.Cut != 135 {
+		t.Errorf("Config().Cut = %v, want 135", c.Cut)
+	}
+}
+
+func TestCableWrapStaleCommand(t *testing.T) {
+	f := &fakeRotator{}
+	w, err := NewCableWrap(WrapConfig{Min: -90, Max: 450, SlewVelocity: 2}, func(cb StatusCallback) (Rotator, error) {
+		return f, nil
+	}, func(Status) {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.statusCallback(fakeStatus{az: 350})
+	if err := w.SetUnwrappedAzimuthPosition(370); err != nil {
+		t.Fatal(err)
+	}
+	// The slew is finished with a position command once it crosses the cut.
+	seq := w.seq
+	w.Stop()
+	w.send(seq, func() { f.SetAzimuthPosition(10) })
+	if f.az != 0 {
+		t.Errorf("position %v commanded after a stop, want none", f.az)
+	}
+	w.send(w.seq, func() { f.SetAzimuthPosition(10) })
+	if f.az != 10 {
+		t.Errorf("position %v commanded, want 10", f.az)
+	}
+}
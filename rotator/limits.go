@@ -0,0 +1,372 @@
+package rotator
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"sync"
+	"time"
+)
+
+// Range is an interval of positions (degrees). An azimuth range with Min
+// greater than Max includes north.
+type Range struct {
+	Min, Max float64
+}
+
+// Limits are soft limits of travel, in the coordinates of the wrapped rotator.
+type Limits struct {
+	// Az and El limit each axis, or are nil if the axis is not limited.
+	Az, El *Range
+	// Margin is the distance from a limit at which velocity moves are
+	// stopped, in seconds of travel at the current velocity.
+	Margin float64
+	// AzDecel and ElDecel are the rates (degrees/second/second) at which
+	// each axis slows down when it is stopped, or 0 if it stops at once.
+	// The distance taken to stop is added to Margin.
+	AzDecel, ElDecel float64
+}
+
+func (l Limits) validate() error {
+	if l.El != nil && l.El.Min > l.El.Max {
+		return fmt.Errorf("elevation limits %v to %v are reversed", l.El.Min, l.El.Max)
+	}
+	if l.Az != nil && (l.Az.Min < 0 || l.Az.Min >= 360 || l.Az.Max < 0 || l.Az.Max >= 360) {
+		return fmt.Errorf("azimuth limits %v to %v must be between 0 and 360", l.Az.Min, l.Az.Max)
+	}
+	if l.Margin < 0 {
+		return errors.New("limit margin must not be negative")
+	}
+	if l.AzDecel < 0 || l.ElDecel < 0 {
+		return errors.New("deceleration must not be negative")
+	}
+	return nil
+}
+
+// contains returns whether x is within the range. Azimuth ranges wrap around north.
+func (r Range) contains(x float64, azimuth bool) bool {
+	if azimuth {
+		x = clamp(x)
+		if r.Min > r.Max {
+			return x >= r.Min || x <= r.Max
+		}
+	}
+	return x >= r.Min && x <= r.Max
+}
+
+// clamp returns the position within the range that is closest to x.
+func (r Range) clamp(x float64, azimuth bool) float64 {
+	if r.contains(x, azimuth) {
+		return x
+	}
+	if !azimuth {
+		return math.Max(r.Min, math.Min(r.Max, x))
+	}
+	if math.Abs(math.Remainder(x-r.Min, 360)) < math.Abs(math.Remainder(x-r.Max, 360)) {
+		return r.Min
+	}
+	return r.Max
+}
+
+// distance returns how far x can move in the direction of v before
+// reaching a limit. It is negative if x is outside the range.
+func (r Range) distance(x, v float64, azimuth bool) float64 {
+	if !r.contains(x, azimuth) {
+		return -1
+	}
+	if azimuth {
+		x = clamp(x)
+		if v > 0 {
+			return clamp(r.Max - x)
+		}
+		return clamp(x - r.Min)
+	}
+	if v > 0 {
+		return r.Max - x
+	}
+	return x - r.Min
+}
+
+// LimitEvent records a command that was changed because of a soft limit.
+type LimitEvent struct {
+	Time time.Time
+	// Axis is "azimuth" or "elevation".
+	Axis string
+	// Action is "clamped" for a position outside the limits, "refused"
+	// for a velocity away from the limits, or "stopped" for a velocity
+	// move that reached a limit.
+	Action string
+	// Requested is the commanded position or velocity, and Position is
+	// the position of the axis at the time.
+	Requested, Position float64
+}
+
+// maxLimitEvents is the number of recent events reported in the status.
+const maxLimitEvents = 10
+
+// SoftLimits keeps the rotator created by its constructor within configured
+// limits. Position commands outside the limits are clamped to the nearest
+// limit, and velocity moves are stopped as they approach a limit. The path
+// taken by a position move is up to the underlying rotator.
+type SoftLimits struct {
+	Rotator
+	origCallback StatusCallback
+	limits       Limits
+
+	mu sync.Mutex
+	// known is false until the first status is received.
+	known  bool
+	az, el float64
+	// azVel and elVel are the velocities last commanded, or zero if the
+	// axis was last commanded a position.
+	azVel, elVel float64
+	// azSeq and elSeq count the commands sent to each axis, so that a
+	// limit stop isn't sent after a newer command.
+	azSeq, elSeq int
+	events       []LimitEvent
+	// sendMu orders commands to the rotator. It is never held in the status callback.
+	sendMu sync.Mutex
+}
+
+type SoftLimitStatus struct {
+	Status
+	SoftLimits  Limits
+	LimitEvents []LimitEvent
+}
+
+func (s SoftLimitStatus) Clone() Status {
+	s.Status = s.Status.Clone()
+	s.LimitEvents = append([]LimitEvent{}, s.LimitEvents...)
+	return s
+}
+
+// NewSoftLimits wraps the rotator created by constructor with soft limits.
+func NewSoftLimits(limits Limits, constructor func(cb StatusCallback) (Rotator, error), cb StatusCallback) (*SoftLimits, error) {
+	if err := limits.validate(); err != nil {
+		return nil, err
+	}
+	l := &SoftLimits{
+		limits:       limits,
+		origCallback: cb,
+	}
+	r, err := constructor(l.statusCallback)
+	if err != nil {
+		return nil, err
+	}
+	l.Rotator = r
+	return l, nil
+}
+
+// record must be called with l.mu locked.
+func (l *SoftLimits) record(axis, action string, requested, position float64) {
+	log.Printf("soft limit: %s %s %.2f at %.2f", axis, action, requested, position)
+	l.events = append(l.events, LimitEvent{
+		Time:      time.Now(),
+		Axis:      axis,
+		Action:    action,
+		Requested: requested,
+		Position:  position,
+	})
+	if len(l.events) > maxLimitEvents {
+		l.events = l.events[len(l.events)-maxLimitEvents:]
+	}
+}
+
+func (l *SoftLimits) statusCallback(status Status) {
+	az, el := status.AzimuthPosition(), status.ElevationPosition()
+	azVel, elVel := status.AzElVelocity()
+	l.mu.Lock()
+	l.known = true
+	l.az, l.el = az, el
+	stopAz := l.approaching(l.limits.Az, az, azVel, l.azVel, l.limits.AzDecel, true)
+	stopEl := l.approaching(l.limits.El, el, elVel, l.elVel, l.limits.ElDecel, false)
+	azSeq, elSeq := l.azSeq, l.elSeq
+	if stopAz {
+		l.record("azimuth", "stopped", l.azVel, az)
+		l.azVel = 0
+	}
+	if stopEl {
+		l.record("elevation", "stopped", l.elVel, el)
+		l.elVel = 0
+	}
+	s := SoftLimitStatus{
+		Status:      status,
+		SoftLimits:  l.limits,
+		LimitEvents: append([]LimitEvent{}, l.events...),
+	}
+	l.mu.Unlock()
+	// The underlying rotator may call back with its own lock held, so
+	// commands are sent from another goroutine.
+	if stopAz {
+		go l.stop(true, azSeq)
+	}
+	if stopEl {
+		go l.stop(false, elSeq)
+	}
+	l.origCallback(s)
+}
+
+// stop stops an axis that is approaching a limit, unless it has been sent
+// another command since the stop was decided on.
+func (l *SoftLimits) stop(azimuth bool, seq int) {
+	l.sendMu.Lock()
+	defer l.sendMu.Unlock()
+	l.mu.Lock()
+	current := l.elSeq
+	if azimuth {
+		current = l.azSeq
+	}
+	l.mu.Unlock()
+	if current != seq {
+		return
+	}
+	if azimuth {
+		l.Rotator.SetAzimuthVelocity(0)
+	} else {
+		l.Rotator.SetElevationVelocity(0)
+	}
+}
+
+// approaching returns whether a velocity move of an axis at x must be
+// stopped before it reaches a limit of r, given that the axis slows down
+// at decel.
+func (l *SoftLimits) approaching(r *Range, x, v, commanded, decel float64, azimuth bool) bool {
+	if r == nil || commanded == 0 {
+		return false
+	}
+	if v == 0 || math.Signbit(v) != math.Signbit(commanded) {
+		// Use the commanded direction until the axis starts moving.
+		v = commanded
+	}
+	margin := math.Abs(v) * l.limits.Margin
+	if decel > 0 {
+		margin += v * v / (2 * decel)
+	}
+	margin = math.Max(1, margin)
+	d := r.distance(x, v, azimuth)
+	return d >= 0 && d < margin
+}
+
+func (l *SoftLimits) SetAzimuthPosition(az float64) {
+	l.sendMu.Lock()
+	defer l.sendMu.Unlock()
+	l.mu.Lock()
+	l.azSeq++
+	l.azVel = 0
+	if r := l.limits.Az; r != nil && !r.contains(az, true) {
+		l.record("azimuth", "clamped", az, l.az)
+		az = r.clamp(az, true)
+	}
+	l.mu.Unlock()
+	l.Rotator.SetAzimuthPosition(az)
+}
+
+func (l *SoftLimits) SetElevationPosition(el float64) {
+	l.sendMu.Lock()
+	defer l.sendMu.Unlock()
+	l.mu.Lock()
+	l.elSeq++
+	l.elVel = 0
+	if r := l.limits.El; r != nil && !r.contains(el, false) {
+		l.record("elevation", "clamped", el, l.el)
+		el = r.clamp(el, false)
+	}
+	l.mu.Unlock()
+	l.Rotator.SetElevationPosition(el)
+}
+
+// allowVelocity returns whether an axis at x may move at v. Moves from
+// outside the limits are allowed only toward the limits.
+func allowVelocity(r *Range, x, v float64, azimuth bool, known bool) bool {
+	if r == nil || v == 0 || !known {
+		return true
+	}
+	if !r.contains(x, azimuth) {
+		target := r.clamp(x, azimuth)
+		d := target - x
+		if azimuth {
+			d = math.Remainder(d, 360)
+		}
+		return math.Signbit(d) == math.Signbit(v)
+	}
+	return r.distance(x, v, azimuth) > 0
+}
+
+func (l *SoftLimits) SetAzimuthVelocity(v float64) {
+	l.sendMu.Lock()
+	defer l.sendMu.Unlock()
+	l.mu.Lock()
+	l.azSeq++
+	if !allowVelocity(l.limits.Az, l.az, v, true, l.known) {
+		l.record("azimuth", "refused", v, l.az)
+		v = 0
+	}
+	l.azVel = v
+	l.mu.Unlock()
+	l.Rotator.SetAzimuthVelocity(v)
+}
+
+func (l *SoftLimits) SetElevationVelocity(v float64) {
+	l.sendMu.Lock()
+	defer l.sendMu.Unlock()
+	l.mu.Lock()
+	l.elSeq++
+	if !allowVelocity(l.limits.El, l.el, v, false, l.known) {
+		l.record("elevation", "refused", v, l.el)
+		v = 0
+	}
+	l.elVel = v
+	l.mu.Unlock()
+	l.Rotator.SetElevationVelocity(v)
+}
+
+func (l *SoftLimits) Stop() {
+	l.sendMu.Lock()
+	defer l.sendMu.Unlock()
+	l.mu.Lock()
+	l.azSeq++
+	l.elSeq++
+	l.azVel, l.elVel = 0, 0
+	l.mu.Unlock()
+	l.Rotator.Stop()
+}
+
+// The remaining methods pass optional interfaces through to the underlying
+// rotator. Use Expose to hide the ones it doesn't have.
+
+func (l *SoftLimits) SetAzimuthOffset(offset float64) {
+	if r, ok := l.Rotator.(Offsetter); ok {
+		r.SetAzimuthOffset(offset)
+	}
+}
+
+func (l *SoftLimits) SetElevationOffset(offset float64) {
+	if r, ok := l.Rotator.(Offsetter); ok {
+		r.SetElevationOffset(offset)
+	}
+}
+
+func (l *SoftLimits) ExitShutdown() {
+	if r, ok := l.Rotator.(Shutdowner); ok {
+		r.ExitShutdown()
+	}
+}
+
+func (l *SoftLimits) SetAcceptableShutdowns(value map[uint8]bool) {
+	if r, ok := l.Rotator.(Shutdowner); ok {
+		r.SetAcceptableShutdowns(value)
+	}
+}
+
+func (l *SoftLimits) SetMovingDisabled(blocked bool) {
+	if r, ok := l.Rotator.(SetMovingDisableder); ok {
+		r.SetMovingDisabled(blocked)
+	}
+}
+
+func (l *SoftLimits) Write(register int, values ...uint16) {
+	if r, ok := l.Rotator.(Writer); ok {
+		r.Write(register, values...)
+	}
+}
@@ -0,0 +1,139 @@
+package rotator
+
+import "testing"
+
+type fakeRotator struct {
+	az, el       float64
+	azVel, elVel float64
+}
+
+func (f *fakeRotator) Stop()                          { f.azVel, f.elVel = 0, 0 }
+func (f *fakeRotator) SetAzimuthPosition(a float64)   { f.az = a }
+func (f *fakeRotator) SetElevationPosition(e float64) { f.el = e }
+func (f *fakeRotator) SetAzimuthVelocity(v float64)   { f.azVel = v }
+func (f *fakeRotator) SetElevationVelocity(v float64) { f.elVel = v }
+
+func TestRange(t *testing.T) {
+	r := Range{Min: 300, Max: 60}
+	for _, tc := range []struct {
+		x    float64
+		want bool
+	}{{0, true}, {330, true}, {-30, true}, {60, true}, {100, false}, {299, false}} {
+		if got := r.contains(tc.x, true); got != tc.want {
+			t.Errorf("contains(%v) = %v, want %v", tc.x, got, tc.want)
+		}
+	}
+	if got := r.clamp(100, true); got != 60 {
+		t.Errorf("clamp(100) = %v, want 60", got)
+	}
+	if got := r.clamp(250, true); got != 300 {
+		t.Errorf("clamp(250) = %v, want 300", got)
+	}
+	if got := r.distance(350, 1, true); got != 70 {
+		t.Errorf("distance(350, 1) = %v, want 70", got)
+	}
+	if got := r.distance(350, -1, true); got != 50 {
+		t.Errorf("distance(350, -1) = %v, want 50", got)
+	}
+}
+
+func TestSoftLimits(t *testing.T) {
+	f := &fakeRotator{}
+	var last Status
+	l, err := NewSoftLimits(Limits{El: &Range{Min: 5, Max: 85}, Margin: 2}, func(cb StatusCallback) (Rotator, error) {
+		return f, nil
+	}, func(s Status) { last = s })
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.SetElevationPosition(90)
+	if f.el != 85 {
+		t.Errorf("elevation commanded to %v, want 85", f.el)
+	}
+	l.SetAzimuthPosition(200)
+	if f.az != 200 {
+		t.Errorf("azimuth commanded to %v, want 200", f.az)
+	}
+	l.statusCallback(fakeStatus{el: 85})
+	l.SetElevationVelocity(1)
+	if f.elVel != 0 {
+		t.Errorf("elevation velocity %v at upper limit, want 0", f.elVel)
+	}
+	l.SetElevationVelocity(-1)
+	if f.elVel != -1 {
+		t.Errorf("elevation velocity %v, want -1", f.elVel)
+	}
+	events := last.(SoftLimitStatus).LimitEvents
+	if len(events) != 1 || events[0].Action != "clamped" {
+		t.Errorf("events = %+v, want one clamp", events)
+	}
+}
+
+func TestSoftLimitStop(t *testing.T) {
+	f := &fakeRotator{}
+	l, err := NewSoftLimits(Limits{El: &Range{Min: 5, Max: 85}, Margin: 1, ElDecel: 5}, func(cb StatusCallback) (Rotator, error) {
+		return f, nil
+	}, func(Status) {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// At 10 degrees/second, the axis travels 10 degrees in the margin and 10 more while stopping.
+	if !l.approaching(l.limits.El, 66, 10, 10, l.limits.ElDecel, false) {
+		t.Error("not stopping 19 degrees from the limit at 10 degrees/second")
+	}
+	if l.approaching(l.limits.El, 64, 10, 10, l.limits.ElDecel, false) {
+		t.Error("stopping 21 degrees from the limit at 10 degrees/second")
+	}
+
+	l.statusCallback(fakeStatus{el: 50})
+	l.SetElevationVelocity(10)
+	seq := l.elSeq
+	l.SetElevationVelocity(-10)
+	l.stop(false, seq)
+	if f.elVel != -10 {
+		t.Errorf("elevation velocity %v after a stale limit stop, want -10", f.elVel)
+	}
+	l.stop(false, l.elSeq)
+	if f.elVel != 0 {
+		t.Errorf("elevation velocity %v after a limit stop, want 0", f.elVel)
+	}
+}
+
+type fakeStatus struct {
+	az, el float64
+}
+
+func (s fakeStatus) AzimuthPosition() float64            { return s.az }
+func (s fakeStatus) ElevationPosition() float64          { return s.el }
+func (s fakeStatus) AzElVelocity() (float64, float64)    { return 0, 0 }
+func (s fakeStatus) AzimuthCommand() (string, float64)   { return "NONE", 0 }
+func (s fakeStatus) ElevationCommand() (string, float64) { return "NONE", 0 }
+func (s fakeStatus) Clone() Status                       { return s }
+
+type fakeWriter struct {
+	fakeRotator
+	writes int
+}
+
+func (f *fakeWriter) Write(register int, values ...uint16) { f.writes++ }
+
+func TestSoftLimitsExpose(t *testing.T) {
+	for _, inner := range []Rotator{&fakeRotator{}, &fakeWriter{}} {
+		l, err := NewSoftLimits(Limits{}, func(cb StatusCallback) (Rotator, error) {
+			return inner, nil
+		}, func(Status) {})
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := Expose(l, InterfacesOf(l.Rotator))
+		if got, want := InterfacesOf(r), InterfacesOf(inner); got != want {
+			t.Errorf("wrapping %T exposes %b, want %b", inner, got, want)
+		}
+		if w, ok := r.(Writer); ok {
+			w.Write(1, 2)
+			if inner.(*fakeWriter).writes != 1 {
+				t.Error("write was not passed through")
+			}
+		}
+	}
+}
@@ -0,0 +1,175 @@
+package rotator
+
+// Interfaces is a set of the optional interfaces a rotator can implement.
+type Interfaces uint8
+
+const (
+	OffsetterInterface Interfaces = 1 << iota
+	ShutdownerInterface
+	SetMovingDisablederInterface
+	WriterInterface
+)
+
+// InterfacesOf returns the optional interfaces that r implements.
+func InterfacesOf(r Rotator) Interfaces {
+	var i Interfaces
+	if _, ok := r.(Offsetter); ok {
+		i |= OffsetterInterface
+	}
+	if _, ok := r.(Shutdowner); ok {
+		i |= ShutdownerInterface
+	}
+	if _, ok := r.(SetMovingDisableder); ok {
+		i |= SetMovingDisablederInterface
+	}
+	if _, ok := r.(Writer); ok {
+		i |= WriterInterface
+	}
+	return i
+}
+
+// Expose returns a rotator that passes everything to r, but only
+// implements the optional interfaces of r that are in which. A rotator
+// that wraps another passes the optional interfaces through, and uses
+// Expose so that callers can still tell which ones the wrapped rotator has.
+func Expose(r Rotator, which Interfaces) Rotator {
+	o, _ := r.(Offsetter)
+	s, _ := r.(Shutdowner)
+	m, _ := r.(SetMovingDisableder)
+	w, _ := r.(Writer)
+	if o == nil {
+		which &^= OffsetterInterface
+	}
+	if s == nil {
+		which &^= ShutdownerInterface
+	}
+	if m == nil {
+		which &^= SetMovingDisablederInterface
+	}
+	if w == nil {
+		which &^= WriterInterface
+	}
+	const (
+		O = OffsetterInterface
+		S = ShutdownerInterface
+		M = SetMovingDisablederInterface
+		W = WriterInterface
+	)
+	switch which {
+	case 0:
+		return exposed{r}
+	case O:
+		return exposedO{r, o}
+	case S:
+		return exposedS{r, s}
+	case O | S:
+		return exposedOS{r, o, s}
+	case M:
+		return exposedM{r, m}
+	case O | M:
+		return exposedOM{r, o, m}
+	case S | M:
+		return exposedSM{r, s, m}
+	case O | S | M:
+		return exposedOSM{r, o, s, m}
+	case W:
+		return exposedW{r, w}
+	case O | W:
+		return exposedOW{r, o, w}
+	case S | W:
+		return exposedSW{r, s, w}
+	case O | S | W:
+		return exposedOSW{r, o, s, w}
+	case M | W:
+		return exposedMW{r, m, w}
+	case O | M | W:
+		return exposedOMW{r, o, m, w}
+	case S | M | W:
+		return exposedSMW{r, s, m, w}
+	default:
+		return exposedOSMW{r, o, s, m, w}
+	}
+}
+
+// Each of these types implements Rotator and one combination of the
+// optional interfaces.
+type (
+	exposed  struct{ Rotator }
+	exposedO struct {
+		Rotator
+		Offsetter
+	}
+	exposedS struct {
+		Rotator
+		Shutdowner
+	}
+	exposedOS struct {
+		Rotator
+		Offsetter
+		Shutdowner
+	}
+	exposedM struct {
+		Rotator
+		SetMovingDisableder
+	}
+	exposedOM struct {
+		Rotator
+		Offsetter
+		SetMovingDisableder
+	}
+	exposedSM struct {
+		Rotator
+		Shutdowner
+		SetMovingDisableder
+	}
+	exposedOSM struct {
+		Rotator
+		Offsetter
+		Shutdowner
+		SetMovingDisableder
+	}
+	exposedW struct {
+		Rotator
+		Writer
+	}
+	exposedOW struct {
+		Rotator
+		Offsetter
+		Writer
+	}
+	exposedSW struct {
+		Rotator
+		Shutdowner
+		Writer
+	}
+	exposedOSW struct {
+		Rotator
+		Offsetter
+		Shutdowner
+		Writer
+	}
+	exposedMW struct {
+		Rotator
+		SetMovingDisableder
+		Writer
+	}
+	exposedOMW struct {
+		Rotator
+		Offsetter
+		SetMovingDisableder
+		Writer
+	}
+	exposedSMW struct {
+		Rotator
+		Shutdowner
+		SetMovingDisableder
+		Writer
+	}
+	exposedOSMW struct {
+		Rotator
+		Offsetter
+		Shutdowner
+		SetMovingDisableder
+		Writer
+	}
+)
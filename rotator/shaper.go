@@ -0,0 +1,318 @@
+package rotator
+
+import (
+	"context"
+	"errors"
+	"math"
+	"sync"
+	"time"
+)
+
+// MotionLimits describe how fast each axis of a rotator may be driven.
+type MotionLimits struct {
+	// MaxAzVelocity and MaxElVelocity (degrees/second) and MaxAzAccel and
+	// MaxElAccel (degrees/second/second) limit each axis. Zero is unlimited.
+	MaxAzVelocity, MaxElVelocity float64
+	MaxAzAccel, MaxElAccel       float64
+	// PositionProfiles makes position moves with velocity commands that
+	// follow a trapezoidal profile, for rotators that only do velocity well.
+	PositionProfiles bool
+	// Interval is the period of velocity updates.
+	Interval time.Duration
+}
+
+func (m MotionLimits) validate() error {
+	for _, v := range []float64{m.MaxAzVelocity, m.MaxElVelocity, m.MaxAzAccel, m.MaxElAccel} {
+		if v < 0 {
+			return errors.New("motion limits must not be negative")
+		}
+	}
+	if m.Interval <= 0 {
+		return errors.New("motion update interval must be positive")
+	}
+	if m.PositionProfiles && (m.MaxAzVelocity == 0 || m.MaxElVelocity == 0 || m.MaxAzAccel == 0 || m.MaxElAccel == 0) {
+		return errors.New("position profiles need velocity and acceleration limits")
+	}
+	return nil
+}
+
+// profileTolerance is the distance (degrees) from the target at which a
+// profiled position move hands over to a position command.
+const profileTolerance = 0.05
+
+// Modes of an axis of a Shaper.
+const (
+	motionIdle     = "idle"
+	motionVelocity = "velocity"
+	motionPosition = "position"
+)
+
+type shapedAxis struct {
+	maxVel, maxAccel float64
+	azimuth          bool
+	mode             string
+	// target is the commanded velocity or position.
+	target float64
+	// vel is the velocity last sent to the rotator, and pos and actualVel
+	// are the last reported position and velocity.
+	vel, pos, actualVel float64
+}
+
+// start prepares for a velocity-controlled move. If the axis was not under
+// velocity control, it starts from the reported velocity.
+func (a *shapedAxis) start(mode string, target float64) {
+	if a.mode == motionIdle {
+		a.vel = a.actualVel
+	}
+	a.mode = mode
+	a.target = target
+}
+
+func (a *shapedAxis) clampVelocity(v float64) float64 {
+	if a.maxVel > 0 {
+		return math.Max(-a.maxVel, math.Min(a.maxVel, v))
+	}
+	return v
+}
+
+// step advances the axis by dt. It returns the velocity to send, if any,
+// and the position to hand over to, if the profiled move is done.
+func (a *shapedAxis) step(dt float64) (vel float64, sendVel bool, pos float64, sendPos bool) {
+	var want float64
+	switch a.mode {
+	case motionVelocity:
+		want = a.target
+	case motionPosition:
+		d := a.target - a.pos
+		if a.azimuth {
+			d = math.Remainder(d, 360)
+		}
+		if math.Abs(d) < profileTolerance && math.Abs(a.vel) <= a.maxAccel*dt {
+			a.mode = motionIdle
+			a.vel = 0
+			return 0, false, a.target, true
+		}
+		// Brake so as to stop at the target, allowing for the time until the next step.
+		brake := math.Sqrt(2*a.maxAccel*math.Abs(d)+math.Pow(a.maxAccel*dt, 2)) - a.maxAccel*dt
+		want = math.Copysign(math.Min(a.maxVel, math.Min(brake, math.Abs(d)/dt)), d)
+	default:
+		return 0, false, 0, false
+	}
+	next := want
+	if a.maxAccel > 0 {
+		limit := a.maxAccel * dt
+		next = a.vel + math.Max(-limit, math.Min(limit, want-a.vel))
+	}
+	if next == a.vel && a.mode == motionVelocity {
+		return 0, false, 0, false
+	}
+	a.vel = next
+	return next, true, 0, false
+}
+
+// Shaper limits the velocity and acceleration with which the rotator
+// created by its constructor is driven. Velocity commands are ramped at the
+// maximum acceleration, so that a reversal slows down before turning.
+type Shaper struct {
+	Rotator
+	origCallback StatusCallback
+	limits       MotionLimits
+
+	mu     sync.Mutex
+	az, el shapedAxis
+	// sendMu serializes commands to the rotator. It is never held in the status callback.
+	sendMu sync.Mutex
+}
+
+type ShaperStatus struct {
+	Status
+	MotionLimits MotionLimits
+	// MotionAzMode and MotionElMode are "idle", "velocity", or "position".
+	MotionAzMode, MotionElMode string
+	// MotionAzVelocity and MotionElVelocity are the velocities last sent to the rotator.
+	MotionAzVelocity, MotionElVelocity float64
+}
+
+func (s ShaperStatus) Clone() Status {
+	s.Status = s.Status.Clone()
+	return s
+}
+
+// NewShaper wraps the rotator created by constructor with motion limits.
+func NewShaper(ctx context.Context, limits MotionLimits, constructor func(cb StatusCallback) (Rotator, error), cb StatusCallback) (*Shaper, error) {
+	if err := limits.validate(); err != nil {
+		return nil, err
+	}
+	s := &Shaper{
+		limits:       limits,
+		origCallback: cb,
+		az:           shapedAxis{maxVel: limits.MaxAzVelocity, maxAccel: limits.MaxAzAccel, azimuth: true, mode: motionIdle},
+		el:           shapedAxis{maxVel: limits.MaxElVelocity, maxAccel: limits.MaxElAccel, mode: motionIdle},
+	}
+	r, err := constructor(s.statusCallback)
+	if err != nil {
+		return nil, err
+	}
+	s.Rotator = r
+	go s.loop(ctx)
+	return s, nil
+}
+
+func (s *Shaper) statusCallback(status Status) {
+	azVel, elVel := status.AzElVelocity()
+	s.mu.Lock()
+	s.az.pos, s.az.actualVel = status.AzimuthPosition(), azVel
+	s.el.pos, s.el.actualVel = status.ElevationPosition(), elVel
+	ss := ShaperStatus{
+		Status:           status,
+		MotionLimits:     s.limits,
+		MotionAzMode:     s.az.mode,
+		MotionElMode:     s.el.mode,
+		MotionAzVelocity: s.az.vel,
+		MotionElVelocity: s.el.vel,
+	}
+	s.mu.Unlock()
+	s.origCallback(ss)
+}
+
+func (s *Shaper) loop(ctx context.Context) {
+	t := time.NewTicker(s.limits.Interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		s.step()
+	}
+}
+
+// step sends the next velocity of each axis that is ramping or following a profile.
+func (s *Shaper) step() {
+	s.sendMu.Lock()
+	defer s.sendMu.Unlock()
+	dt := s.limits.Interval.Seconds()
+	s.mu.Lock()
+	azVel, azSendVel, azPos, azSendPos := s.az.step(dt)
+	elVel, elSendVel, elPos, elSendPos := s.el.step(dt)
+	s.mu.Unlock()
+	if azSendVel {
+		s.Rotator.SetAzimuthVelocity(azVel)
+	}
+	if azSendPos {
+		s.Rotator.SetAzimuthPosition(azPos)
+	}
+	if elSendVel {
+		s.Rotator.SetElevationVelocity(elVel)
+	}
+	if elSendPos {
+		s.Rotator.SetElevationPosition(elPos)
+	}
+}
+
+func (s *Shaper) SetAzimuthPosition(az float64) {
+	s.sendMu.Lock()
+	defer s.sendMu.Unlock()
+	s.mu.Lock()
+	if s.limits.PositionProfiles {
+		s.az.start(motionPosition, az)
+		s.mu.Unlock()
+		return
+	}
+	s.az.mode = motionIdle
+	s.az.vel = 0
+	s.mu.Unlock()
+	s.Rotator.SetAzimuthPosition(az)
+}
+
+func (s *Shaper) SetElevationPosition(el float64) {
+	s.sendMu.Lock()
+	defer s.sendMu.Unlock()
+	s.mu.Lock()
+	if s.limits.PositionProfiles {
+		s.el.start(motionPosition, el)
+		s.mu.Unlock()
+		return
+	}
+	s.el.mode = motionIdle
+	s.el.vel = 0
+	s.mu.Unlock()
+	s.Rotator.SetElevationPosition(el)
+}
+
+func (s *Shaper) SetAzimuthVelocity(v float64) {
+	s.sendMu.Lock()
+	defer s.sendMu.Unlock()
+	dt := s.limits.Interval.Seconds()
+	s.mu.Lock()
+	s.az.start(motionVelocity, s.az.clampVelocity(v))
+	s.az.step(dt)
+	vel := s.az.vel
+	s.mu.Unlock()
+	// Always send, in case the rotator is in the middle of a position move.
+	s.Rotator.SetAzimuthVelocity(vel)
+}
+
+func (s *Shaper) SetElevationVelocity(v float64) {
+	s.sendMu.Lock()
+	defer s.sendMu.Unlock()
+	dt := s.limits.Interval.Seconds()
+	s.mu.Lock()
+	s.el.start(motionVelocity, s.el.clampVelocity(v))
+	s.el.step(dt)
+	vel := s.el.vel
+	s.mu.Unlock()
+	// Always send, in case the rotator is in the middle of a position move.
+	s.Rotator.SetElevationVelocity(vel)
+}
+
+// Stop is passed through immediately.
+func (s *Shaper) Stop() {
+	s.sendMu.Lock()
+	defer s.sendMu.Unlock()
+	s.mu.Lock()
+	s.az.mode, s.az.vel = motionIdle, 0
+	s.el.mode, s.el.vel = motionIdle, 0
+	s.mu.Unlock()
+	s.Rotator.Stop()
+}
+
+// The remaining methods pass optional interfaces through to the underlying
+// rotator. Use Expose to hide the ones it doesn't have.
+
+func (s *Shaper) SetAzimuthOffset(offset float64) {
+	if r, ok := s.Rotator.(Offsetter); ok {
+		r.SetAzimuthOffset(offset)
+	}
+}
+
+func (s *Shaper) SetElevationOffset(offset float64) {
+	if r, ok := s.Rotator.(Offsetter); ok {
+		r.SetElevationOffset(offset)
+	}
+}
+
+func (s *Shaper) ExitShutdown() {
+	if r, ok := s.Rotator.(Shutdowner); ok {
+		r.ExitShutdown()
+	}
+}
+
+func (s *Shaper) SetAcceptableShutdowns(value map[uint8]bool) {
+	if r, ok := s.Rotator.(Shutdowner); ok {
+		r.SetAcceptableShutdowns(value)
+	}
+}
+
+func (s *Shaper) SetMovingDisabled(blocked bool) {
+	if r, ok := s.Rotator.(SetMovingDisableder); ok {
+		r.SetMovingDisabled(blocked)
+	}
+}
+
+func (s *Shaper) Write(register int, values ...uint16) {
+	if r, ok := s.Rotator.(Writer); ok {
+		r.Write(register, values...)
+	}
+}
@@ -0,0 +1,62 @@
+package rotator
+
+import (
+	"math"
+	"testing"
+)
+
+func TestShapedAxisReversal(t *testing.T) {
+	a := shapedAxis{maxVel: 10, maxAccel: 5, mode: motionIdle, actualVel: 10}
+	a.start(motionVelocity, a.clampVelocity(-20))
+	if a.target != -10 {
+		t.Fatalf("target = %v, want -10", a.target)
+	}
+	var steps int
+	for a.vel != -10 {
+		v, send, _, _ := a.step(0.1)
+		if !send {
+			t.Fatalf("step %d sent nothing at %v", steps, a.vel)
+		}
+		if steps > 0 && math.Abs(v-(10-0.5*float64(steps+1))) > 1e-9 {
+			t.Fatalf("step %d: velocity %v", steps, v)
+		}
+		steps++
+		if steps > 100 {
+			t.Fatal("velocity never reached target")
+		}
+	}
+	if steps != 40 {
+		t.Errorf("reversal took %d steps, want 40", steps)
+	}
+	if _, send, _, _ := a.step(0.1); send {
+		t.Error("step sent a velocity after reaching the target")
+	}
+}
+
+func TestShapedAxisProfile(t *testing.T) {
+	a := shapedAxis{maxVel: 10, maxAccel: 5, azimuth: true, mode: motionIdle, pos: 350}
+	a.start(motionPosition, 30)
+	dt := 0.05
+	var maxVel float64
+	for i := 0; i < 1000; i++ {
+		v, sendVel, pos, sendPos := a.step(dt)
+		if sendPos {
+			if pos != 30 || math.Abs(math.Remainder(a.pos-30, 360)) > profileTolerance {
+				t.Fatalf("handed over at %v to %v", a.pos, pos)
+			}
+			if maxVel < 9.9 {
+				t.Errorf("peak velocity %v, want 10", maxVel)
+			}
+			return
+		}
+		if !sendVel {
+			t.Fatalf("step %d sent nothing", i)
+		}
+		if v < 0 {
+			t.Fatalf("moved the long way round at step %d", i)
+		}
+		maxVel = math.Max(maxVel, v)
+		a.pos = clamp(a.pos + v*dt)
+	}
+	t.Fatalf("never arrived; at %v", a.pos)
+}
@@ -34,7 +34,19 @@ func (ts TransformerStatus) AzimuthPosition() float64 {
 }
 
 func (ts TransformerStatus) ElevationPosition() float64 {
-	return ts.AzPos
+	return ts.ElPos
+}
+
+func (ts TransformerStatus) AzElVelocity() (float64, float64) {
+	return ts.AzVel, ts.ElVel
+}
+
+func (ts TransformerStatus) AzimuthCommand() (string, float64) {
+	return ts.CommandAzFlags, ts.CommandAzPos
+}
+
+func (ts TransformerStatus) ElevationCommand() (string, float64) {
+	return ts.CommandElFlags, ts.CommandElPos
 }
 
 // equhor converts between azimuth/altitude and hour-angle/declination.
@@ -0,0 +1,164 @@
+package satellite
+
+import (
+	"math"
+	"time"
+)
+
+// Observer is a location on the WGS-84 ellipsoid.
+type Observer struct {
+	// Latitude and Longitude are in degrees.
+	Latitude, Longitude float64
+	// Height is in meters.
+	Height float64
+}
+
+// gmst returns the Greenwich mean sidereal time (radians) at t.
+func gmst(t time.Time) float64 {
+	jd := float64(t.UnixNano())/float64(24*time.Hour) + 2440587.5
+	tut1 := (jd - 2451545) / 36525
+	temp := -6.2e-6*tut1*tut1*tut1 + 0.093104*tut1*tut1 +
+		(876600*3600+8640184.812866)*tut1 + 67310.54841
+	temp = math.Mod(temp*math.Pi/180/240, twoPi)
+	if temp < 0 {
+		temp += twoPi
+	}
+	return temp
+}
+
+// ecef returns the observer's position in earth-centered, earth-fixed coordinates (km).
+func (o Observer) ecef() [3]float64 {
+	const (
+		a  = 6378.137
+		f  = 1 / 298.257223563
+		e2 = f * (2 - f)
+	)
+	sinLat, cosLat := math.Sincos(o.Latitude * math.Pi / 180)
+	sinLon, cosLon := math.Sincos(o.Longitude * math.Pi / 180)
+	n := a / math.Sqrt(1-e2*sinLat*sinLat)
+	h := o.Height / 1000
+	return [3]float64{
+		(n + h) * cosLat * cosLon,
+		(n + h) * cosLat * sinLon,
+		(n*(1-e2) + h) * sinLat,
+	}
+}
+
+// LookAngles returns the azimuth and elevation (degrees) and range (km) of
+// the satellite as seen by o at t. Refraction is not applied.
+func (s *Satellite) LookAngles(t time.Time, o Observer) (az, el, rng float64, err error) {
+	pos, _, err := s.Propagate(t)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	// Rotate TEME into ECEF, ignoring polar motion.
+	sinG, cosG := math.Sincos(gmst(t))
+	sat := [3]float64{
+		cosG*pos[0] + sinG*pos[1],
+		-sinG*pos[0] + cosG*pos[1],
+		pos[2],
+	}
+	obs := o.ecef()
+	rx, ry, rz := sat[0]-obs[0], sat[1]-obs[1], sat[2]-obs[2]
+
+	sinLat, cosLat := math.Sincos(o.Latitude * math.Pi / 180)
+	sinLon, cosLon := math.Sincos(o.Longitude * math.Pi / 180)
+	south := sinLat*cosLon*rx + sinLat*sinLon*ry - cosLat*rz
+	east := -sinLon*rx + cosLon*ry
+	zenith := cosLat*cosLon*rx + cosLat*sinLon*ry + sinLat*rz
+
+	rng = math.Sqrt(rx*rx + ry*ry + rz*rz)
+	el = math.Asin(zenith/rng) * 180 / math.Pi
+	az = math.Atan2(east, -south) * 180 / math.Pi
+	if az < 0 {
+		az += 360
+	}
+	return az, el, rng, nil
+}
+
+// Pass is a period during which a satellite is above the observer's minimum elevation.
+type Pass struct {
+	AOS, LOS         time.Time
+	MaxElevation     float64
+	MaxElevationTime time.Time
+}
+
+const (
+	passStep      = 30 * time.Second
+	passPrecision = time.Second
+)
+
+// Passes returns the passes that are in progress or begin between start and end.
+// A pass in progress at start has its AOS set to start.
+func (s *Satellite) Passes(o Observer, start, end time.Time, minElevation float64) []Pass {
+	elevation := func(t time.Time) float64 {
+		_, el, _, err := s.LookAngles(t, o)
+		if err != nil {
+			return math.Inf(-1)
+		}
+		return el
+	}
+	// crossing finds the time between t1 and t2 where the elevation crosses minElevation.
+	crossing := func(t1, t2 time.Time) time.Time {
+		up := elevation(t1) < minElevation
+		for t2.Sub(t1) > passPrecision {
+			mid := t1.Add(t2.Sub(t1) / 2)
+			if (elevation(mid) >= minElevation) == up {
+				t2 = mid
+			} else {
+				t1 = mid
+			}
+		}
+		return t2
+	}
+
+	var out []Pass
+	var cur *Pass
+	prev := start
+	if el := elevation(start); el >= minElevation {
+		cur = &Pass{AOS: start, MaxElevation: el, MaxElevationTime: start}
+	}
+	// Keep going past end to finish a pass in progress, but not forever.
+	for t := start.Add(passStep); (cur != nil || !t.After(end)) && t.Before(end.Add(24*time.Hour)); t = t.Add(passStep) {
+		el := elevation(t)
+		if math.IsInf(el, -1) {
+			break
+		}
+		switch {
+		case cur == nil && el >= minElevation:
+			cur = &Pass{AOS: crossing(prev, t), MaxElevation: el, MaxElevationTime: t}
+		case cur != nil && el < minElevation:
+			cur.LOS = crossing(prev, t)
+			out = append(out, *cur)
+			cur = nil
+		case cur != nil && el > cur.MaxElevation:
+			cur.MaxElevation, cur.MaxElevationTime = el, t
+		}
+		prev = t
+	}
+	for i := range out {
+		p := &out[i]
+		// Refine the maximum elevation by golden-section search around the coarse maximum.
+		lo, hi := p.MaxElevationTime.Add(-passStep), p.MaxElevationTime.Add(passStep)
+		if lo.Before(p.AOS) {
+			lo = p.AOS
+		}
+		if hi.After(p.LOS) {
+			hi = p.LOS
+		}
+		for hi.Sub(lo) > passPrecision {
+			m1 := lo.Add(hi.Sub(lo) * 382 / 1000)
+			m2 := lo.Add(hi.Sub(lo) * 618 / 1000)
+			if elevation(m1) < elevation(m2) {
+				lo = m1
+			} else {
+				hi = m2
+			}
+		}
+		mid := lo.Add(hi.Sub(lo) / 2)
+		if el := elevation(mid); el > p.MaxElevation {
+			p.MaxElevation, p.MaxElevationTime = el, mid
+		}
+	}
+	return out
+}
@@ -0,0 +1,267 @@
+package satellite
+
+import (
+	"errors"
+	"math"
+	"time"
+)
+
+// This is the near-earth portion of SGP4, following Vallado et al.,
+// "Revisiting Spacetrack Report #3" (AIAA 2006-6753), with WGS-72
+// constants. Deep-space (SDP4) orbits are not supported.
+
+const (
+	mu            = 398600.8 // km^3/s^2
+	radiusEarthKm = 6378.135
+	j2            = 0.001082616
+	j3            = -0.00000253881
+	j4            = -0.00000165597
+	j3oj2         = j3 / j2
+	x2o3          = 2.0 / 3.0
+	twoPi         = 2 * math.Pi
+)
+
+var (
+	xke       = 60 / math.Sqrt(radiusEarthKm*radiusEarthKm*radiusEarthKm/mu)
+	vkmpersec = radiusEarthKm * xke / 60
+)
+
+var (
+	ErrDeepSpace = errors.New("deep-space orbits (period >= 225 minutes) are not supported")
+	ErrDecayed   = errors.New("satellite has decayed")
+)
+
+type sgp4State struct {
+	isimp                                    bool
+	no, ao, con41, x1mth2, x7thm1, eta       float64
+	cc1, cc4, cc5, d2, d3, d4, delmo, sinmao float64
+	mdot, argpdot, nodedot, omgcof, xmcof    float64
+	nodecf, t2cof, t3cof, t4cof, t5cof       float64
+	xlcof, aycof                             float64
+}
+
+func (st *sgp4State) init(s *Satellite) error {
+	ecco, inclo := s.ecco, s.inclo
+
+	eccsq := ecco * ecco
+	omeosq := 1 - eccsq
+	rteosq := math.Sqrt(omeosq)
+	cosio := math.Cos(inclo)
+	cosio2 := cosio * cosio
+
+	// Un-Kozai the mean motion.
+	ak := math.Pow(xke/s.noKozai, x2o3)
+	d1 := 0.75 * j2 * (3*cosio2 - 1) / (rteosq * omeosq)
+	del := d1 / (ak * ak)
+	adel := ak * (1 - del*del - del*(1.0/3.0+134*del*del/81))
+	del = d1 / (adel * adel)
+	st.no = s.noKozai / (1 + del)
+	if twoPi/st.no >= 225 {
+		return ErrDeepSpace
+	}
+
+	st.ao = math.Pow(xke/st.no, x2o3)
+	sinio := math.Sin(inclo)
+	po := st.ao * omeosq
+	con42 := 1 - 5*cosio2
+	st.con41 = -con42 - cosio2 - cosio2
+	posq := po * po
+	rp := st.ao * (1 - ecco)
+	if omeosq < 0 || st.no < 0 {
+		return errors.New("invalid elements")
+	}
+
+	st.isimp = rp < 220/radiusEarthKm+1
+	sfour := 78/radiusEarthKm + 1
+	qzms24 := math.Pow((120-78)/radiusEarthKm, 4)
+	perige := (rp - 1) * radiusEarthKm
+	if perige < 156 {
+		sfour = perige - 78
+		if perige < 98 {
+			sfour = 20
+		}
+		qzms24 = math.Pow((120-sfour)/radiusEarthKm, 4)
+		sfour = sfour/radiusEarthKm + 1
+	}
+	pinvsq := 1 / posq
+	tsi := 1 / (st.ao - sfour)
+	st.eta = st.ao * ecco * tsi
+	etasq := st.eta * st.eta
+	eeta := ecco * st.eta
+	psisq := math.Abs(1 - etasq)
+	coef := qzms24 * math.Pow(tsi, 4)
+	coef1 := coef / math.Pow(psisq, 3.5)
+	cc2 := coef1 * st.no * (st.ao*(1+1.5*etasq+eeta*(4+etasq)) +
+		0.375*j2*tsi/psisq*st.con41*(8+3*etasq*(8+etasq)))
+	st.cc1 = s.bstar * cc2
+	cc3 := 0.0
+	if ecco > 1e-4 {
+		cc3 = -2 * coef * tsi * j3oj2 * st.no * sinio / ecco
+	}
+	st.x1mth2 = 1 - cosio2
+	st.cc4 = 2 * st.no * coef1 * st.ao * omeosq *
+		(st.eta*(2+0.5*etasq) + ecco*(0.5+2*etasq) -
+			j2*tsi/(st.ao*psisq)*
+				(-3*st.con41*(1-2*eeta+etasq*(1.5-0.5*eeta))+
+					0.75*st.x1mth2*(2*etasq-eeta*(1+etasq))*math.Cos(2*s.argpo)))
+	st.cc5 = 2 * coef1 * st.ao * omeosq * (1 + 2.75*(etasq+eeta) + eeta*etasq)
+	cosio4 := cosio2 * cosio2
+	temp1 := 1.5 * j2 * pinvsq * st.no
+	temp2 := 0.5 * temp1 * j2 * pinvsq
+	temp3 := -0.46875 * j4 * pinvsq * pinvsq * st.no
+	st.mdot = st.no + 0.5*temp1*rteosq*st.con41 + 0.0625*temp2*rteosq*(13-78*cosio2+137*cosio4)
+	st.argpdot = -0.5*temp1*con42 + 0.0625*temp2*(7-114*cosio2+395*cosio4) +
+		temp3*(3-36*cosio2+49*cosio4)
+	xhdot1 := -temp1 * cosio
+	st.nodedot = xhdot1 + (0.5*temp2*(4-19*cosio2)+2*temp3*(3-7*cosio2))*cosio
+	st.omgcof = s.bstar * cc3 * math.Cos(s.argpo)
+	if ecco > 1e-4 {
+		st.xmcof = -x2o3 * coef * s.bstar / eeta
+	}
+	st.nodecf = 3.5 * omeosq * xhdot1 * st.cc1
+	st.t2cof = 1.5 * st.cc1
+	if math.Abs(cosio+1) > 1.5e-12 {
+		st.xlcof = -0.25 * j3oj2 * sinio * (3 + 5*cosio) / (1 + cosio)
+	} else {
+		st.xlcof = -0.25 * j3oj2 * sinio * (3 + 5*cosio) / 1.5e-12
+	}
+	st.aycof = -0.5 * j3oj2 * sinio
+	st.delmo = math.Pow(1+st.eta*math.Cos(s.mo), 3)
+	st.sinmao = math.Sin(s.mo)
+	st.x7thm1 = 7*cosio2 - 1
+
+	if !st.isimp {
+		cc1sq := st.cc1 * st.cc1
+		st.d2 = 4 * st.ao * tsi * cc1sq
+		temp := st.d2 * tsi * st.cc1 / 3
+		st.d3 = (17*st.ao + sfour) * temp
+		st.d4 = 0.5 * temp * st.ao * tsi * (221*st.ao + 31*sfour) * st.cc1
+		st.t3cof = st.d2 + 2*cc1sq
+		st.t4cof = 0.25 * (3*st.d3 + st.cc1*(12*st.d2+10*cc1sq))
+		st.t5cof = 0.2 * (3*st.d4 + 12*st.cc1*st.d3 + 6*st.d2*st.d2 + 15*cc1sq*(2*st.d2+cc1sq))
+	}
+	return nil
+}
+
+// Propagate returns the position (km) and velocity (km/s) of the satellite
+// at t, in the true-equator, mean-equinox (TEME) frame.
+func (s *Satellite) Propagate(t time.Time) (pos, vel [3]float64, err error) {
+	st := &s.sgp4
+	tsince := t.Sub(s.Epoch).Minutes()
+
+	xmdf := s.mo + st.mdot*tsince
+	argpdf := s.argpo + st.argpdot*tsince
+	nodedf := s.nodeo + st.nodedot*tsince
+	argpm := argpdf
+	mm := xmdf
+	t2 := tsince * tsince
+	nodem := nodedf + st.nodecf*t2
+	tempa := 1 - st.cc1*tsince
+	tempe := s.bstar * st.cc4 * tsince
+	templ := st.t2cof * t2
+
+	if !st.isimp {
+		delomg := st.omgcof * tsince
+		delm := st.xmcof * (math.Pow(1+st.eta*math.Cos(xmdf), 3) - st.delmo)
+		temp := delomg + delm
+		mm = xmdf + temp
+		argpm = argpdf - temp
+		t3 := t2 * tsince
+		t4 := t3 * tsince
+		tempa = tempa - st.d2*t2 - st.d3*t3 - st.d4*t4
+		tempe = tempe + s.bstar*st.cc5*(math.Sin(mm)-st.sinmao)
+		templ = templ + st.t3cof*t3 + t4*(st.t4cof+tsince*st.t5cof)
+	}
+
+	am := math.Pow(xke/st.no, x2o3) * tempa * tempa
+	nm := xke / math.Pow(am, 1.5)
+	em := s.ecco - tempe
+	if em >= 1 || em < -0.001 || am < 0.95 {
+		return pos, vel, ErrDecayed
+	}
+	if em < 1e-6 {
+		em = 1e-6
+	}
+	mm = mm + st.no*templ
+	xlm := mm + argpm + nodem
+	nodem = math.Mod(nodem, twoPi)
+	argpm = math.Mod(argpm, twoPi)
+	xlm = math.Mod(xlm, twoPi)
+	mm = math.Mod(xlm-argpm-nodem, twoPi)
+
+	sinip, cosip := math.Sincos(s.inclo)
+
+	// Long period periodics.
+	axnl := em * math.Cos(argpm)
+	temp := 1 / (am * (1 - em*em))
+	aynl := em*math.Sin(argpm) + temp*st.aycof
+	xl := mm + argpm + nodem + temp*st.xlcof*axnl
+
+	// Solve Kepler's equation.
+	u := math.Mod(xl-nodem, twoPi)
+	eo1 := u
+	tem5 := 9999.9
+	var sineo1, coseo1 float64
+	for ktr := 1; math.Abs(tem5) >= 1e-12 && ktr <= 10; ktr++ {
+		sineo1, coseo1 = math.Sincos(eo1)
+		tem5 = 1 - coseo1*axnl - sineo1*aynl
+		tem5 = (u - aynl*coseo1 + axnl*sineo1 - eo1) / tem5
+		if math.Abs(tem5) >= 0.95 {
+			tem5 = math.Copysign(0.95, tem5)
+		}
+		eo1 += tem5
+	}
+
+	// Short period preliminary quantities.
+	ecose := axnl*coseo1 + aynl*sineo1
+	esine := axnl*sineo1 - aynl*coseo1
+	el2 := axnl*axnl + aynl*aynl
+	pl := am * (1 - el2)
+	if pl < 0 {
+		return pos, vel, ErrDecayed
+	}
+	rl := am * (1 - ecose)
+	rdotl := math.Sqrt(am) * esine / rl
+	rvdotl := math.Sqrt(pl) / rl
+	betal := math.Sqrt(1 - el2)
+	temp = esine / (1 + betal)
+	sinu := am / rl * (sineo1 - aynl - axnl*temp)
+	cosu := am / rl * (coseo1 - axnl + aynl*temp)
+	su := math.Atan2(sinu, cosu)
+	sin2u := (cosu + cosu) * sinu
+	cos2u := 1 - 2*sinu*sinu
+	temp = 1 / pl
+	temp1 := 0.5 * j2 * temp
+	temp2 := temp1 * temp
+
+	// Update for short period periodics.
+	mrt := rl*(1-1.5*temp2*betal*st.con41) + 0.5*temp1*st.x1mth2*cos2u
+	su = su - 0.25*temp2*st.x7thm1*sin2u
+	xnode := nodem + 1.5*temp2*cosip*sin2u
+	xinc := s.inclo + 1.5*temp2*cosip*sinip*cos2u
+	mvt := rdotl - nm*temp1*st.x1mth2*sin2u/xke
+	rvdot := rvdotl + nm*temp1*(st.x1mth2*cos2u+1.5*st.con41)/xke
+
+	sinsu, cossu := math.Sincos(su)
+	snod, cnod := math.Sincos(xnode)
+	sini, cosi := math.Sincos(xinc)
+	xmx := -snod * cosi
+	xmy := cnod * cosi
+	ux := xmx*sinsu + cnod*cossu
+	uy := xmy*sinsu + snod*cossu
+	uz := sini * sinsu
+	vx := xmx*cossu - cnod*sinsu
+	vy := xmy*cossu - snod*sinsu
+	vz := sini * cossu
+
+	if mrt < 1 {
+		return pos, vel, ErrDecayed
+	}
+	pos = [3]float64{mrt * ux * radiusEarthKm, mrt * uy * radiusEarthKm, mrt * uz * radiusEarthKm}
+	vel = [3]float64{
+		(mvt*ux + rvdot*vx) * vkmpersec,
+		(mvt*uy + rvdot*vy) * vkmpersec,
+		(mvt*uz + rvdot*vz) * vkmpersec,
+	}
+	return pos, vel, nil
+}
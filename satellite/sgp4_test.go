@@ -0,0 +1,122 @@
+package satellite
+
+import (
+	"errors"
+	"math"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPropagate(t *testing.T) {
+	// Test cases from Vallado et al., "Revisiting Spacetrack Report #3".
+	for _, test := range []struct {
+		name         string
+		line1, line2 string
+		tsince       float64
+		pos          [3]float64
+		vel          [3]float64
+	}{
+		{
+			"00005",
+			"1 00005U 58002B   00179.78495062  .00000023  00000-0  28098-4 0  4753",
+			"2 00005  34.2682 348.7242 1859667 331.7664  19.3264 10.82419157413667",
+			0,
+			[3]float64{7022.46529266, -1400.08296755, 0.03995155},
+			[3]float64{1.893841015, 6.405893759, 4.534807250},
+		},
+		{
+			"00005 +360",
+			"1 00005U 58002B   00179.78495062  .00000023  00000-0  28098-4 0  4753",
+			"2 00005  34.2682 348.7242 1859667 331.7664  19.3264 10.82419157413667",
+			360,
+			[3]float64{-7154.03120202, -3783.17682504, -3536.19412294},
+			[3]float64{4.741887409, -4.151817765, -2.093935425},
+		},
+		{
+			"88888",
+			"1 88888U          80275.98708465  .00073094  13844-3  66816-4 0    8",
+			"2 88888  72.8435 115.9689 0086731  52.6988 110.5714 16.05824518  105",
+			0,
+			[3]float64{2328.96975262, -5995.22051338, 1719.97297192},
+			[3]float64{2.912073280, -0.983415460, -7.090816210},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			s, err := Parse("", test.line1, test.line2)
+			if err != nil {
+				t.Fatal(err)
+			}
+			pos, vel, err := s.Propagate(s.Epoch.Add(time.Duration(test.tsince * float64(time.Minute))))
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := range pos {
+				if math.Abs(pos[i]-test.pos[i]) > 1e-3 {
+					t.Errorf("position = %v, want %v", pos, test.pos)
+					break
+				}
+				if math.Abs(vel[i]-test.vel[i]) > 1e-5 {
+					t.Errorf("velocity = %v, want %v", vel, test.vel)
+					break
+				}
+			}
+		})
+	}
+}
+
+func TestDeepSpace(t *testing.T) {
+	_, err := Parse("GPS", "1 11801U          80230.29629788  .01431103  00000-0  14311-1 0    13", "2 11801  46.7916 230.4354 7318036  47.4722  10.4117  2.28537848    13")
+	if !errors.Is(err, ErrDeepSpace) {
+		t.Errorf("Parse got %v, want ErrDeepSpace", err)
+	}
+}
+
+func TestParseFileSkipsDeepSpace(t *testing.T) {
+	sats, err := ParseFile(strings.NewReader(`ISS (ZARYA)
+1 25544U 98067A   21275.52543210  .00001264  00000-0  31621-4 0  9993
+2 25544  51.6442 194.5016 0004209  34.6573  76.3469 15.48866640305471
+0 GEO
+1 28626U 05008A   06176.46683397 -.00000205  00000-0  10000-3 0  2190
+2 28626   0.0019 286.9433 0000335  13.7918  55.6504  1.00270176  4891
+1 00005U 58002B   00179.78495062  .00000023  00000-0  28098-4 0  4753
+2 00005  34.2682 348.7242 1859667 331.7664  19.3264 10.82419157413667
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sats) != 2 || sats[0].CatalogNumber != 25544 || sats[1].CatalogNumber != 5 {
+		t.Fatalf("ParseFile got %+v, want 25544 and 5", sats)
+	}
+}
+
+func TestPasses(t *testing.T) {
+	sats, err := ParseFile(strings.NewReader(`ISS (ZARYA)
+1 25544U 98067A   21275.52543210  .00001264  00000-0  31621-4 0  9993
+2 25544  51.6442 194.5016 0004209  34.6573  76.3469 15.48866640305471
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sats) != 1 || sats[0].Name != "ISS (ZARYA)" || sats[0].CatalogNumber != 25544 {
+		t.Fatalf("ParseFile got %+v", sats)
+	}
+	o := Observer{Latitude: 42.360326, Longitude: -71.089324, Height: 100}
+	start := sats[0].Epoch
+	passes := sats[0].Passes(o, start, start.Add(24*time.Hour), 0)
+	if len(passes) < 2 {
+		t.Fatalf("got %d passes in 24 hours, want several", len(passes))
+	}
+	for _, p := range passes {
+		if !p.LOS.After(p.AOS) || p.LOS.Sub(p.AOS) > 15*time.Minute {
+			t.Errorf("implausible pass %+v", p)
+		}
+		if p.MaxElevation < 0 || p.MaxElevation > 90 || p.MaxElevationTime.Before(p.AOS) || p.MaxElevationTime.After(p.LOS) {
+			t.Errorf("implausible maximum elevation in %+v", p)
+		}
+		_, el, _, err := sats[0].LookAngles(p.AOS, o)
+		if err != nil || math.Abs(el) > 0.1 {
+			t.Errorf("elevation at AOS = %v, %v; want 0", el, err)
+		}
+	}
+}
@@ -0,0 +1,146 @@
+package satellite
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Satellite is an earth satellite described by a two-line element set.
+type Satellite struct {
+	Name          string
+	CatalogNumber int
+	Epoch         time.Time
+	// Line1 and Line2 are the original element set.
+	Line1, Line2 string
+
+	// Mean elements, in radians and radians/minute.
+	bstar, inclo, nodeo, ecco, argpo, mo, noKozai float64
+
+	sgp4 sgp4State
+}
+
+// Parse parses a two-line element set. name may be empty, in which case the catalog number is used.
+func Parse(name, line1, line2 string) (*Satellite, error) {
+	line1 = strings.TrimRight(line1, " \r\n")
+	line2 = strings.TrimRight(line2, " \r\n")
+	if len(line1) < 64 || line1[0] != '1' {
+		return nil, fmt.Errorf("malformed TLE line 1 %q", line1)
+	}
+	if len(line2) < 63 || line2[0] != '2' {
+		return nil, fmt.Errorf("malformed TLE line 2 %q", line2)
+	}
+	s := &Satellite{
+		Name:  strings.TrimSpace(name),
+		Line1: line1,
+		Line2: line2,
+	}
+	var err error
+	field := func(line string, start, end int) string {
+		if end > len(line) {
+			end = len(line)
+		}
+		return strings.TrimSpace(line[start:end])
+	}
+	float := func(line string, start, end int) float64 {
+		if err != nil {
+			return 0
+		}
+		var f float64
+		f, err = strconv.ParseFloat(field(line, start, end), 64)
+		if err != nil {
+			err = fmt.Errorf("parsing columns %d-%d of %q: %w", start+1, end, line, err)
+		}
+		return f
+	}
+	if s.CatalogNumber, err = strconv.Atoi(field(line1, 2, 7)); err != nil {
+		return nil, fmt.Errorf("parsing catalog number: %w", err)
+	}
+	if s.Name == "" {
+		s.Name = strconv.Itoa(s.CatalogNumber)
+	}
+	year := int(float(line1, 18, 20))
+	day := float(line1, 20, 32)
+	s.bstar = assumedDecimal(field(line1, 53, 61), &err)
+	s.inclo = float(line2, 8, 16) * math.Pi / 180
+	s.nodeo = float(line2, 17, 25) * math.Pi / 180
+	s.ecco = float("0."+field(line2, 26, 33), 0, 9)
+	s.argpo = float(line2, 34, 42) * math.Pi / 180
+	s.mo = float(line2, 43, 51) * math.Pi / 180
+	s.noKozai = float(line2, 52, 63) * 2 * math.Pi / 1440
+	if err != nil {
+		return nil, err
+	}
+	if year < 57 {
+		year += 2000
+	} else {
+		year += 1900
+	}
+	s.Epoch = time.Date(year, 1, 1, 0, 0, 0, 0, time.UTC).Add(time.Duration((day - 1) * 24 * float64(time.Hour)))
+	if err := s.sgp4.init(s); err != nil {
+		return nil, fmt.Errorf("%s: %w", s.Name, err)
+	}
+	return s, nil
+}
+
+// assumedDecimal parses a TLE field of the form " 12345-3", meaning 0.12345e-3.
+func assumedDecimal(f string, errp *error) float64 {
+	if *errp != nil || f == "" {
+		return 0
+	}
+	sign := ""
+	if f[0] == '-' || f[0] == '+' {
+		sign, f = f[:1], f[1:]
+	}
+	i := strings.LastIndexAny(f, "+-")
+	if i <= 0 {
+		i = len(f)
+		f += "+0"
+	}
+	v, err := strconv.ParseFloat(sign+"0."+strings.TrimSpace(f[:i])+"e"+f[i:], 64)
+	if err != nil {
+		*errp = fmt.Errorf("parsing %q: %w", f, err)
+	}
+	return v
+}
+
+// ParseFile reads element sets in either two-line or three-line (name, line 1, line 2) format.
+// Element sets that Parse rejects, such as deep-space orbits, are logged and skipped.
+func ParseFile(r io.Reader) ([]*Satellite, error) {
+	var out []*Satellite
+	var name, line1 string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), " \r")
+		switch {
+		case line == "":
+			continue
+		case strings.HasPrefix(line, "1 ") && line1 == "":
+			line1 = line
+		case strings.HasPrefix(line, "2 ") && line1 != "":
+			s, err := Parse(name, line1, line)
+			if err != nil {
+				id := name
+				if id == "" {
+					id = line1
+				}
+				log.Printf("skipping element set %q: %v", id, err)
+			} else {
+				out = append(out, s)
+			}
+			name, line1 = "", ""
+		default:
+			name = strings.TrimPrefix(line, "0 ")
+			line1 = ""
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
@@ -97,6 +97,13 @@ func (s *Sequencer) parseRegisters() Status {
 	return status
 }
 
+// Bands returns the number of bands, which is 0 until the sequencer has been polled.
+func (s *Sequencer) Bands() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.bands
+}
+
 func (s *Sequencer) SetBandTX(band int, tx bool) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
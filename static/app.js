@@ -9,7 +9,11 @@ angular.module('app', ['components', 'widgets', 'ngMaterial'])
 	    $scope.rci.track($scope.trackBody);
 	};
 	$scope.login = function() {
-	    $scope.rci.reconnectWithPassword(prompt("Enter password"));
+	    let user = prompt("Enter user name (blank for a shared password)");
+	    if (user === null) {
+		return;
+	    }
+	    $scope.rci.reconnectWithPassword(prompt("Enter password"), user);
 	};
 	$scope.setAzElPosition = function($event) {
 	    $scope.rci.setAzimuthPosition($event.az);
@@ -4,6 +4,7 @@ angular.module('components', [
     .factory('RCI', function($websocket, $window) {
 	var obj = {
 	    status: {},
+	    leaseRenewed: 0,
 	}
 	obj.write = function(register, values) {
 	    obj.socket.send(JSON.stringify({
@@ -59,6 +60,32 @@ angular.module('components', [
 		command: 'stop',
 	    }));
 	};
+	obj.emergencyStop = function(reason) {
+	    obj.socket.send(JSON.stringify({
+		command: 'emergency_stop',
+		reason: reason || '',
+	    }));
+	};
+	obj.resetEmergencyStop = function() {
+	    obj.socket.send(JSON.stringify({
+		command: 'reset_emergency_stop',
+	    }));
+	};
+	obj.takeControl = function() {
+	    obj.socket.send(JSON.stringify({
+		command: 'take_control',
+	    }));
+	};
+	obj.releaseControl = function() {
+	    obj.socket.send(JSON.stringify({
+		command: 'release_control',
+	    }));
+	};
+	obj.stealControl = function() {
+	    obj.socket.send(JSON.stringify({
+		command: 'steal_control',
+	    }));
+	};
 	obj.stopHard = function() {
 	    obj.socket.send(JSON.stringify({
 		command: 'stop_hard',
@@ -84,13 +111,17 @@ angular.module('components', [
 	    }));
 	};
 
-	obj.reconnectWithPassword = function(password) {
+	obj.reconnectWithPassword = function(password, user) {
 	    let host = $window.location.host;
 	    if (obj.socket) {
 		obj.socket.socket.close(1000);
 	    }
 	    let protocols = undefined;
-	    if (password) {
+	    if (password && user) {
+		// Users log in with "user:password" as unpadded base64url.
+		let encoded = btoa(unescape(encodeURIComponent(user + ':' + password)));
+		protocols = [encoded.replace(/\+/g, '-').replace(/\//g, '_').replace(/=+$/, '')];
+	    } else if (password) {
 		protocols = [password];
 	    }
 	    // Open a WebSocket connection
@@ -105,6 +136,13 @@ angular.module('components', [
 		    command: 'ack',
 		    seq: obj.status.SequenceNumber,
 		}));
+		// Velocity moves are stopped unless the lease is renewed.
+		if (obj.status.VelocityLeaseHeld && Date.now() - obj.leaseRenewed > 1000) {
+		    obj.leaseRenewed = Date.now();
+		    obj.socket.send(JSON.stringify({
+			command: 'renew_lease',
+		    }));
+		}
 	    });
 	};
 
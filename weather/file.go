@@ -0,0 +1,96 @@
+package weather
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// File is a Source that polls a file written by another program. The file
+// contains either a JSON object with the same fields as Conditions, or a
+// temperature and pressure separated by whitespace. If the time is not
+// given, the file's modification time is used.
+type File struct {
+	Path string
+	// Interval is the time between reads. It defaults to 10 seconds.
+	Interval time.Duration
+}
+
+func (f *File) Start(ctx context.Context, cb Callback) error {
+	interval := f.Interval
+	if interval == 0 {
+		interval = 10 * time.Second
+	}
+	if _, err := os.Stat(f.Path); err != nil {
+		return err
+	}
+	go func() {
+		var last time.Time
+		for {
+			c, err := f.read()
+			if err != nil {
+				log.Printf("reading weather from %q: %v", f.Path, err)
+			} else if !c.Time.Equal(last) {
+				last = c.Time
+				cb(c)
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(interval):
+			}
+		}
+	}()
+	return nil
+}
+
+func (f *File) read() (Conditions, error) {
+	fi, err := os.Stat(f.Path)
+	if err != nil {
+		return Conditions{}, err
+	}
+	data, err := ioutil.ReadFile(f.Path)
+	if err != nil {
+		return Conditions{}, err
+	}
+	c, err := Parse(data)
+	if err != nil {
+		return Conditions{}, err
+	}
+	if c.Time.IsZero() {
+		c.Time = fi.ModTime()
+	}
+	return c, nil
+}
+
+// Parse parses conditions from a JSON object or a whitespace-separated
+// temperature and pressure. The time is left zero if it is not given.
+func Parse(data []byte) (Conditions, error) {
+	var c Conditions
+	data = bytes.TrimSpace(data)
+	if bytes.HasPrefix(data, []byte("{")) {
+		if err := json.Unmarshal(data, &c); err != nil {
+			return c, err
+		}
+		return c, c.Validate()
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) != 2 {
+		return c, fmt.Errorf("expected temperature and pressure, got %q", data)
+	}
+	var err error
+	if c.Temperature, err = strconv.ParseFloat(fields[0], 64); err != nil {
+		return c, err
+	}
+	if c.Pressure, err = strconv.ParseFloat(fields[1], 64); err != nil {
+		return c, err
+	}
+	return c, c.Validate()
+}
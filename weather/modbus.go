@@ -0,0 +1,59 @@
+package weather
+
+import (
+	"context"
+	"encoding/binary"
+	"time"
+
+	"github.com/w1xm/rci_interface/internal/modbus"
+)
+
+// Modbus is a Source that polls a Modbus RTU sensor. Input register 0 holds
+// the temperature in tenths of a degree Celsius (signed), and input
+// register 1 holds the pressure in tenths of a millibar.
+type Modbus struct {
+	// Port and BaudRate create a local serial connection
+	Port     string
+	BaudRate int
+	SlaveId  byte
+	// URL creates a remote connection
+	URL string
+	// Interval is the time between reads. It defaults to 10 seconds.
+	Interval time.Duration
+
+	client *modbus.Client
+	cb     Callback
+}
+
+func (m *Modbus) Start(ctx context.Context, cb Callback) error {
+	if m.Interval == 0 {
+		m.Interval = 10 * time.Second
+	}
+	m.cb = cb
+	m.client = &modbus.Client{
+		Port:     m.Port,
+		BaudRate: m.BaudRate,
+		SlaveId:  m.SlaveId,
+		URL:      m.URL,
+		Poll:     m.pollOnce,
+	}
+	return m.client.Connect(ctx)
+}
+
+func (m *Modbus) pollOnce() error {
+	results, err := m.client.ReadInputRegisters(0, 2)
+	if err != nil {
+		return err
+	}
+	c := Conditions{
+		Time:        time.Now(),
+		Temperature: float64(int16(binary.BigEndian.Uint16(results))) / 10,
+		Pressure:    float64(binary.BigEndian.Uint16(results[2:])) / 10,
+	}
+	if err := c.Validate(); err != nil {
+		return err
+	}
+	m.cb(c)
+	time.Sleep(m.Interval)
+	return nil
+}
@@ -0,0 +1,53 @@
+package weather
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Push is a Source that receives conditions in HTTP POST requests, in
+// any format accepted by Parse. If the time is not given, the time of the
+// request is used.
+type Push struct {
+	mu sync.Mutex
+	cb Callback
+}
+
+func (p *Push) Start(ctx context.Context, cb Callback) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.cb = cb
+	return nil
+}
+
+func (p *Push) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	data, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, 1<<16))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	c, err := Parse(data)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if c.Time.IsZero() {
+		c.Time = time.Now()
+	}
+	p.mu.Lock()
+	cb := p.cb
+	p.mu.Unlock()
+	if cb == nil {
+		http.Error(w, "weather push is not enabled", http.StatusServiceUnavailable)
+		return
+	}
+	cb(c)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,38 @@
+// Package weather reads the atmospheric conditions used to compute refraction.
+package weather
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// Conditions are the weather at the antenna.
+type Conditions struct {
+	// Time is when the conditions were measured.
+	Time time.Time `json:"time"`
+	// Temperature is the air temperature (degrees Celsius).
+	Temperature float64 `json:"temperature"`
+	// Pressure is the air pressure (millibars).
+	Pressure float64 `json:"pressure"`
+}
+
+// Validate checks that the conditions are physically plausible.
+func (c Conditions) Validate() error {
+	if !(c.Temperature >= -90 && c.Temperature <= 60) {
+		return fmt.Errorf("implausible temperature %v", c.Temperature)
+	}
+	if !(c.Pressure >= 500 && c.Pressure <= 1100) {
+		return fmt.Errorf("implausible pressure %v", c.Pressure)
+	}
+	return nil
+}
+
+// Callback is called with each new measurement.
+type Callback func(c Conditions)
+
+// A Source reports conditions to a callback as they are measured.
+type Source interface {
+	// Start begins reporting conditions to cb until ctx is done.
+	Start(ctx context.Context, cb Callback) error
+}
@@ -0,0 +1,35 @@
+package weather
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParse(t *testing.T) {
+	for _, tc := range []struct {
+		in      string
+		want    Conditions
+		wantErr bool
+	}{
+		{in: "10 1010\n", want: Conditions{Temperature: 10, Pressure: 1010}},
+		{in: "-12.5\t985.2", want: Conditions{Temperature: -12.5, Pressure: 985.2}},
+		{
+			in:   `{"time": "2021-01-02T03:04:05Z", "temperature": 3, "pressure": 1020}`,
+			want: Conditions{Time: time.Date(2021, 1, 2, 3, 4, 5, 0, time.UTC), Temperature: 3, Pressure: 1020},
+		},
+		{in: "10", wantErr: true},
+		{in: "10 1010 5", wantErr: true},
+		{in: "1010 10", wantErr: true},
+		{in: `{"temperature": 10}`, wantErr: true},
+		{in: "NaN 1010", wantErr: true},
+	} {
+		got, err := Parse([]byte(tc.in))
+		if (err != nil) != tc.wantErr {
+			t.Errorf("Parse(%q) error = %v, want error %v", tc.in, err, tc.wantErr)
+			continue
+		}
+		if err == nil && (!got.Time.Equal(tc.want.Time) || got.Temperature != tc.want.Temperature || got.Pressure != tc.want.Pressure) {
+			t.Errorf("Parse(%q) = %+v, want %+v", tc.in, got, tc.want)
+		}
+	}
+}